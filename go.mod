@@ -7,6 +7,7 @@ toolchain go1.23.5
 require golang.org/x/crypto v0.32.0
 
 require (
+	github.com/gorilla/websocket v1.5.3
 	github.com/xchgn/suigo v0.0.8
 	golang.org/x/sys v0.29.0 // indirect
 )
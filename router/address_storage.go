@@ -23,87 +23,185 @@
 package router
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
 
+const (
+	STORAGE_MAX_MESSAGES     = 10000
+	STORAGE_MAX_BYTES        = 16 * 1024 * 1024
+	STORAGE_INITIAL_CAPACITY = 16
+	STORAGE_MESSAGE_TIMEOUT  = 5 * time.Second
+)
+
+// Storage keeps the messages of one address in a ring buffer ordered by id.
+// The oldest messages are dropped when the count or the size limit is exceeded.
 type Storage struct {
 	mtx         sync.Mutex
 	TouchDT     time.Time
 	maxMessages int
-	messages    []*Message
+	maxBytes    int
+
+	// Ring buffer: the oldest message is at head, the buffer grows up to maxMessages
+	messages []*Message
+	head     int
+	count    int
+	bytes    int
+
+	// Closed and replaced by every Put
+	received chan struct{}
+	readers  int
 }
 
 func NewStorage() *Storage {
+	return NewStorageWithLimits(STORAGE_MAX_MESSAGES, STORAGE_MAX_BYTES)
+}
+
+func NewStorageWithLimits(maxMessages int, maxBytes int) *Storage {
 	var c Storage
-	c.maxMessages = 100000000
-	c.messages = make([]*Message, 0, c.maxMessages+1)
+	if maxMessages < 1 {
+		maxMessages = 1
+	}
+	c.maxMessages = maxMessages
+	c.maxBytes = maxBytes
+	capacity := STORAGE_INITIAL_CAPACITY
+	if capacity > c.maxMessages {
+		capacity = c.maxMessages
+	}
+	c.messages = make([]*Message, capacity)
 	c.TouchDT = time.Now()
+	c.received = make(chan struct{})
 	return &c
 }
 
+// at returns the message by its position from the oldest one
+func (c *Storage) at(index int) *Message {
+	return c.messages[(c.head+index)%len(c.messages)]
+}
+
+func (c *Storage) removeOldest() {
+	m := c.messages[c.head]
+	c.messages[c.head] = nil
+	c.bytes -= len(m.data)
+	c.head = (c.head + 1) % len(c.messages)
+	c.count--
+}
+
+func (c *Storage) grow() {
+	capacity := len(c.messages) * 2
+	if capacity > c.maxMessages {
+		capacity = c.maxMessages
+	}
+	messages := make([]*Message, capacity)
+	for i := 0; i < c.count; i++ {
+		messages[i] = c.at(i)
+	}
+	c.messages = messages
+	c.head = 0
+}
+
 func (c *Storage) Clear() {
 	now := time.Now()
 	c.mtx.Lock()
-	oldMessages := c.messages
-	c.messages = make([]*Message, 0, len(oldMessages))
-	for _, m := range oldMessages {
-		if now.Sub(m.TouchDT) < 5*time.Second {
-			c.messages = append(c.messages, m)
-		}
+	for c.count > 0 && now.Sub(c.messages[c.head].TouchDT) >= STORAGE_MESSAGE_TIMEOUT {
+		c.removeOldest()
+	}
+	if c.count == 0 && len(c.messages) > STORAGE_INITIAL_CAPACITY {
+		// Release the memory of the idle address
+		c.messages = make([]*Message, STORAGE_INITIAL_CAPACITY)
+		c.head = 0
 	}
 	c.mtx.Unlock()
 }
 
 func (c *Storage) MessagesCount() (count int) {
 	c.mtx.Lock()
-	count = len(c.messages)
+	count = c.count
 	c.mtx.Unlock()
 	return
 }
 
+func (c *Storage) BytesCount() (bytes int) {
+	c.mtx.Lock()
+	bytes = c.bytes
+	c.mtx.Unlock()
+	return
+}
+
+// Put appends the message, ids must be increasing
 func (c *Storage) Put(id uint64, frame []byte) {
 	c.mtx.Lock()
-	msg := NewMessage(id, frame)
-	c.messages = append(c.messages, msg)
-	if len(c.messages) > c.maxMessages {
-		c.messages = c.messages[1:]
+	for c.count > 0 && (c.count >= c.maxMessages || c.bytes+len(frame) > c.maxBytes) {
+		c.removeOldest()
+	}
+	if c.count == len(c.messages) {
+		c.grow()
 	}
+	c.messages[(c.head+c.count)%len(c.messages)] = NewMessage(id, frame)
+	c.count++
+	c.bytes += len(frame)
 	c.TouchDT = time.Now()
+	close(c.received)
+	c.received = make(chan struct{})
 	c.mtx.Unlock()
 }
 
-func (c *Storage) GetMessage(afterId uint64, maxSize uint64) (data []byte, lastId uint64, count int) {
-	//fmt.Println("addressStorage.GetMessage", afterId)
+// Received returns the channel closed by the next Put
+func (c *Storage) Received() <-chan struct{} {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.received
+}
 
+func (c *Storage) AddReader() {
+	c.mtx.Lock()
+	c.readers++
+	c.mtx.Unlock()
+}
+
+func (c *Storage) RemoveReader() {
+	c.mtx.Lock()
+	c.readers--
+	c.TouchDT = time.Now()
+	c.mtx.Unlock()
+}
+
+// IsIdle - nobody waits for messages and nothing was put for the timeout
+func (c *Storage) IsIdle(timeout time.Duration) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.readers == 0 && time.Since(c.TouchDT) > timeout
+}
+
+func (c *Storage) GetMessage(afterId uint64, maxSize uint64) (data []byte, lastId uint64, count int) {
 	data = make([]byte, 0)
 	lastId = afterId
 	count = 0
-	sendAll := false
 	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-	if len(c.messages) > 0 {
-		if afterId > c.messages[len(c.messages)-1].id {
-			afterId = c.messages[0].id
-			sendAll = true
-		}
+	if c.count == 0 {
+		return
 	}
 
-	for _, m := range c.messages {
-		if m.id > afterId || sendAll {
-			if len(data)+len(m.data) < int(maxSize) {
-				data = append(data, m.data...)
-				lastId = m.id
-				count++
-			}
-		}
+	start := 0
+	if afterId <= c.at(c.count-1).id {
+		start = sort.Search(c.count, func(i int) bool {
+			return c.at(i).id > afterId
+		})
 	}
+	// else the reader is ahead of the storage (e.g. the router was restarted) - send all
 
-	if len(data) == 0 && len(c.messages) > 0 {
-		if afterId > c.messages[len(c.messages)-1].id {
-			lastId = c.messages[0].id
+	for i := start; i < c.count; i++ {
+		m := c.at(i)
+		if len(data) > 0 && len(data)+len(m.data) >= int(maxSize) {
+			// The rest is sent with the next request
+			break
 		}
+		data = append(data, m.data...)
+		lastId = m.id
+		count++
 	}
-	c.mtx.Unlock()
 	return
 }
@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ADDRESS_SHARDS_COUNT = 64
+)
+
+// addressShard is a part of the address table with its own lock
+type addressShard struct {
+	mtx       sync.Mutex
+	addresses map[string]*Storage
+}
+
+type addressTable struct {
+	shards [ADDRESS_SHARDS_COUNT]*addressShard
+}
+
+func newAddressTable() *addressTable {
+	var c addressTable
+	for i := range c.shards {
+		c.shards[i] = &addressShard{addresses: make(map[string]*Storage)}
+	}
+	return &c
+}
+
+func (c *addressTable) shard(address string) *addressShard {
+	h := fnv.New32a()
+	h.Write([]byte(address))
+	return c.shards[h.Sum32()%ADDRESS_SHARDS_COUNT]
+}
+
+func (c *addressTable) get(address string) *Storage {
+	shard := c.shard(address)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	return shard.addresses[address]
+}
+
+// getOrCreateLocked must be called with the shard locked
+func (c *addressShard) getOrCreateLocked(address string) *Storage {
+	addressStorage, ok := c.addresses[address]
+	if !ok || addressStorage == nil {
+		addressStorage = NewStorage()
+		c.addresses[address] = addressStorage
+	}
+	return addressStorage
+}
+
+// removeIdle deletes the idle addresses and returns the rest
+func (c *addressTable) removeIdle(timeout time.Duration) map[string]*Storage {
+	result := make(map[string]*Storage)
+	for _, shard := range c.shards {
+		shard.mtx.Lock()
+		for address, addressStorage := range shard.addresses {
+			if addressStorage.IsIdle(timeout) {
+				delete(shard.addresses, address)
+				continue
+			}
+			result[address] = addressStorage
+		}
+		shard.mtx.Unlock()
+	}
+	return result
+}
+
+func (c *addressTable) all() map[string]*Storage {
+	result := make(map[string]*Storage)
+	for _, shard := range c.shards {
+		shard.mtx.Lock()
+		for address, addressStorage := range shard.addresses {
+			result[address] = addressStorage
+		}
+		shard.mtx.Unlock()
+	}
+	return result
+}
+
+// routerCounters are updated without the router lock
+type routerCounters struct {
+	FramesIn  atomic.Int64
+	FramesOut atomic.Int64
+	BytesIn   atomic.Int64
+	BytesOut  atomic.Int64
+
+	HttpRequests   atomic.Int64
+	HttpRequestsR  atomic.Int64
+	HttpRequestsW  atomic.Int64
+	HttpRequestsN  atomic.Int64
+	HttpRequestsNS atomic.Int64
+	HttpRequestsD  atomic.Int64
+	HttpRequestsS  atomic.Int64
+	HttpRequestsF  atomic.Int64
+	HttpRequestsWS atomic.Int64
+	TcpConnections atomic.Int64
+	UdpRequests    atomic.Int64
+}
+
+func (c *routerCounters) snapshot() (stat RouterStatistics) {
+	stat.FramesIn = int(c.FramesIn.Load())
+	stat.FramesOut = int(c.FramesOut.Load())
+	stat.BytesIn = int(c.BytesIn.Load())
+	stat.BytesOut = int(c.BytesOut.Load())
+
+	stat.HttpRequests = int(c.HttpRequests.Load())
+	stat.HttpRequestsR = int(c.HttpRequestsR.Load())
+	stat.HttpRequestsW = int(c.HttpRequestsW.Load())
+	stat.HttpRequestsN = int(c.HttpRequestsN.Load())
+	stat.HttpRequestsNS = int(c.HttpRequestsNS.Load())
+	stat.HttpRequestsD = int(c.HttpRequestsD.Load())
+	stat.HttpRequestsS = int(c.HttpRequestsS.Load())
+	stat.HttpRequestsF = int(c.HttpRequestsF.Load())
+	stat.HttpRequestsWS = int(c.HttpRequestsWS.Load())
+	stat.TcpConnections = int(c.TcpConnections.Load())
+	stat.UdpRequests = int(c.UdpRequests.Load())
+	return
+}
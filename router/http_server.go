@@ -25,51 +25,96 @@ package router
 import (
 	"context"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
+const (
+	HTTP_PORT = 8084
+)
+
 type HttpServer struct {
+	mtx     sync.Mutex
+	stopped bool
+
 	srv *http.Server
 	//r                    *mux.Router
-	server               *Router
-	longPollingTimeout   time.Duration
-	longPollingTickDelay time.Duration
-	err                  error
+	server             *Router
+	longPollingTimeout time.Duration
+	err                error
 }
 
 func NewHttpServer() *HttpServer {
 	var c HttpServer
 	c.longPollingTimeout = 10 * time.Second
-	c.longPollingTickDelay = 10 * time.Millisecond
 	return &c
 }
 
-func (c *HttpServer) Start(server *Router, port int) {
+// SetRouter attaches the router without listening, the server can be mounted as http.Handler
+func (c *HttpServer) SetRouter(server *Router) {
 	c.server = server
-	c.srv = &http.Server{
-		Addr: ":" + fmt.Sprint(port),
-	}
-	c.srv.Handler = c
-	go c.thListen()
+}
+
+func (c *HttpServer) Start(server *Router, port int) {
+	c.SetRouter(server)
+	go c.thListen(port)
 }
 
 func (c *HttpServer) Stop() error {
-	var err error
+	c.mtx.Lock()
+	c.stopped = true
+	srv := c.srv
+	c.mtx.Unlock()
+
+	if srv == nil {
+		return nil
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
-	if err = c.srv.Shutdown(ctx); err != nil {
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		c.mtx.Lock()
 		c.err = err
+		c.mtx.Unlock()
 	}
 	return err
 }
 
-func (c *HttpServer) thListen() {
-	c.err = c.srv.ListenAndServe()
+func (c *HttpServer) thListen(port int) {
+	listener, err := net.Listen("tcp", ":"+fmt.Sprint(port))
+	if err != nil {
+		c.mtx.Lock()
+		c.err = err
+		c.mtx.Unlock()
+		return
+	}
+	c.Serve(c.server, listener)
+}
+
+// Serve handles the requests of the listener until Stop
+func (c *HttpServer) Serve(server *Router, listener net.Listener) (err error) {
+	c.mtx.Lock()
+	c.SetRouter(server)
+	if c.stopped {
+		c.mtx.Unlock()
+		listener.Close()
+		err = errors.New("stopped")
+		return
+	}
+	srv := &http.Server{Handler: c}
+	c.srv = srv
+	c.mtx.Unlock()
+
+	err = srv.Serve(listener)
+	c.mtx.Lock()
+	c.err = err
+	c.mtx.Unlock()
+	return
 }
 
 func (c *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -88,6 +133,14 @@ func (c *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		c.processR(w, r)
 		return
 	}
+	if r.RequestURI == "/api/n" {
+		c.processN(w, r)
+		return
+	}
+	if r.RequestURI == "/api/ws" {
+		c.processWS(w, r)
+		return
+	}
 	if r.RequestURI == "/api/debug" {
 		c.processDebug(w, r)
 		return
@@ -118,20 +171,15 @@ func (c *HttpServer) processR(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, cancel := context.WithTimeout(r.Context(), c.longPollingTimeout)
+	defer cancel()
 	var resultBS []byte
-	beginLongPollingDT := time.Now()
-	for time.Since(beginLongPollingDT) < c.longPollingTimeout {
-		var count int
-		resultBS, count, err = c.server.GetMessages(dataBS)
-		if count > 0 || err != nil {
-			break
-		}
-		if errors.Is(r.Context().Err(), context.Canceled) {
-			break
-		}
-		time.Sleep(c.longPollingTickDelay)
-	}
+	resultBS, _, err = c.server.GetMessagesWait(ctx, dataBS)
 	if err != nil {
+		if err.Error() == ERR_ROUTER_ACCESS_DENIED {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(err.Error()))
+		}
 		return
 	}
 	resultStr := base64.StdEncoding.EncodeToString(resultBS)
@@ -140,6 +188,18 @@ func (c *HttpServer) processR(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(result))
 }
 
+// processN issues the nonce for the signed read request
+func (c *HttpServer) processN(w http.ResponseWriter, r *http.Request) {
+	c.server.DeclareHttpRequestN()
+	nonce, err := c.server.NextNonce(r.RemoteAddr)
+	if err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(nonce[:])))
+}
+
 func (c *HttpServer) processW(w http.ResponseWriter, r *http.Request) {
 	c.server.DeclareHttpRequestW()
 
@@ -158,20 +218,7 @@ func (c *HttpServer) processW(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	offset := 0
-	for offset < len(dataBS) {
-		if offset+69 <= len(dataBS) {
-			frameLen := int(binary.LittleEndian.Uint32(dataBS[offset:]))
-			if offset+frameLen <= len(dataBS) {
-				c.server.Put(dataBS[offset : offset+frameLen])
-			} else {
-				break
-			}
-			offset += frameLen
-		} else {
-			break
-		}
-	}
+	c.server.PutFrames(dataBS)
 }
 
 func (c *HttpServer) processDebug(w http.ResponseWriter, _ *http.Request) {
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Nonces are one-time values issued to the readers of the mailboxes.
+// [0:4] - index in the pool, [4:16] - random
+// A nonce expires after NONCE_LIFETIME or when its slot is issued again.
+type Nonces struct {
+	mtx          sync.Mutex
+	nonces       [][NONCE_SIZE]byte
+	issuedDT     []time.Time
+	currentIndex int
+}
+
+func NewNonces(size int) *Nonces {
+	var c Nonces
+	c.nonces = make([][NONCE_SIZE]byte, size)
+	c.issuedDT = make([]time.Time, size)
+	for i := 0; i < size; i++ {
+		c.fillNonce(i)
+	}
+	return &c
+}
+
+func (c *Nonces) fillNonce(index int) {
+	binary.LittleEndian.PutUint32(c.nonces[index][:], uint32(index))
+	rand.Read(c.nonces[index][4:])
+}
+
+func (c *Nonces) Next() [NONCE_SIZE]byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.fillNonce(c.currentIndex)
+	c.issuedDT[c.currentIndex] = time.Now()
+	result := c.nonces[c.currentIndex]
+	c.currentIndex++
+	if c.currentIndex >= len(c.nonces) {
+		c.currentIndex = 0
+	}
+	return result
+}
+
+// Check accepts every issued nonce only once and only within its lifetime
+func (c *Nonces) Check(nonce []byte) bool {
+	if len(nonce) != NONCE_SIZE {
+		return false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	index := int(binary.LittleEndian.Uint32(nonce))
+	if index < 0 || index >= len(c.nonces) {
+		return false
+	}
+	for i := 0; i < NONCE_SIZE; i++ {
+		if c.nonces[index][i] != nonce[i] {
+			return false
+		}
+	}
+	c.fillNonce(index)
+	return time.Since(c.issuedDT[index]) <= NONCE_LIFETIME
+}
+
+// NonceLimiter counts the nonces issued without a signed request to every remote host.
+// The counters are reset every second.
+type NonceLimiter struct {
+	mtx      sync.Mutex
+	limit    int
+	counters map[string]int
+	periodDT time.Time
+}
+
+func NewNonceLimiter(limit int) *NonceLimiter {
+	var c NonceLimiter
+	c.limit = limit
+	c.counters = make(map[string]int)
+	c.periodDT = time.Now()
+	return &c
+}
+
+// Allow declares the nonce for the remote address (host:port or host)
+func (c *NonceLimiter) Allow(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if now := time.Now(); now.Sub(c.periodDT) >= time.Second {
+		c.counters = make(map[string]int)
+		c.periodDT = now
+	}
+	if c.counters[host] >= c.limit {
+		return false
+	}
+	c.counters[host]++
+	return true
+}
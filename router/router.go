@@ -23,37 +23,46 @@
 package router
 
 import (
+	"context"
+	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	VERSION = int(24)
+	VERSION = int(25)
 )
 
 type Router struct {
-	// Sync
+	// Sync - the state, the background operations and the debug info.
+	// Frames and counters do not use it.
 	mtx sync.Mutex
 
 	// State
 	started  bool
 	stopping bool
+	stop     chan struct{}
+	stopped  chan struct{}
 
 	// Data
-	//nonces *Nonces
+	nonces       *Nonces
+	nonceLimiter *NonceLimiter
 
 	//network *Network
-	nextId uint64
+	nextId atomic.Uint64
 
-	addresses map[string]*Storage
+	addresses *addressTable
 
 	// Statistics
-	stat       RouterStatistics
+	stat       routerCounters
 	statLast   RouterStatistics
 	statLastDT time.Time
 	statSpeed  RouterSpeedStatistics
@@ -61,11 +70,45 @@ type Router struct {
 	lastDebugInfo []byte
 	lastStatInfo  []byte
 
+	options    RouterOptions
 	httpServer *HttpServer
+	tcpServer  *TcpServer
+	udpServer  *UdpServer
+	httpAddr   net.Addr
+	tcpAddr    net.Addr
+	udpAddr    net.Addr
 
 	clearAddressesLastDT time.Time
 }
 
+type RouterOptions struct {
+	// Listen addresses of the services, the service is disabled if the address is empty
+	HttpAddress string
+	TcpAddress  string
+	UdpAddress  string
+
+	// HttpListener is used instead of HttpAddress if it is set
+	HttpListener net.Listener
+
+	// LongPollingTimeout of /api/r
+	LongPollingTimeout time.Duration
+
+	// NonceRateLimit is the number of nonces per second issued to one remote host
+	// without a signed read request (/api/n and the connection handshakes), NONCE_RATE_LIMIT by default
+	NonceRateLimit int
+}
+
+// DefaultRouterOptions listens on all interfaces: HTTP 8084, TCP 8085 and UDP 8086
+func DefaultRouterOptions() RouterOptions {
+	var options RouterOptions
+	options.HttpAddress = ":" + fmt.Sprint(HTTP_PORT)
+	options.TcpAddress = ":" + fmt.Sprint(TCP_PORT)
+	options.UdpAddress = ":" + fmt.Sprint(UDP_PORT)
+	options.LongPollingTimeout = 10 * time.Second
+	options.NonceRateLimit = NONCE_RATE_LIMIT
+	return options
+}
+
 type RouterStatistics struct {
 	FramesIn  int `json:"frames_in"`
 	FramesOut int `json:"frames_out"`
@@ -80,6 +123,9 @@ type RouterStatistics struct {
 	HttpRequestsD  int `json:"http_requests_d"`
 	HttpRequestsS  int `json:"http_requests_s"`
 	HttpRequestsF  int `json:"http_requests_f"`
+	HttpRequestsWS int `json:"http_requests_ws"`
+	TcpConnections int `json:"tcp_connections"`
+	UdpRequests    int `json:"udp_requests"`
 }
 
 type RouterSpeedStatistics struct {
@@ -90,6 +136,9 @@ type RouterSpeedStatistics struct {
 	SpeedHttpRequestsNS int `json:"http_requests_ns"`
 	SpeedHttpRequestsD  int `json:"http_requests_d"`
 	SpeedHttpRequestsF  int `json:"http_requests_f"`
+	SpeedHttpRequestsWS int `json:"http_requests_ws"`
+	SpeedTcpConnections int `json:"tcp_connections"`
+	SpeedUdpRequests    int `json:"udp_requests"`
 
 	SpeedFramesIn  int `json:"frames_in"`
 	SpeedFramesOut int `json:"frames_out"`
@@ -106,22 +155,46 @@ type RouterSpeedStatistics struct {
 }
 
 const (
-	NONCE_COUNT       = 1024 * 1024
+	NONCE_COUNT       = 64 * 1024
+	NONCE_SIZE        = 16
+	NONCE_LIFETIME    = 60 * time.Second
+	NONCE_RATE_LIMIT  = 100
 	INPUT_BUFFER_SIZE = 10 * 1024 * 1024
 	STORING_TIMEOUT   = 60 * time.Second
+
+	// Read request: [afterId 8][maxSize 8][address 32][nonce 16][signature 64]
+	// The signature of [0:64] is made by the private key of the address.
+	READ_REQUEST_SIZE = 8 + 8 + 32 + NONCE_SIZE + ed25519.SignatureSize
+	// Read response: [lastId 8][next nonce 16][frames]
+	READ_RESPONSE_HEADER_SIZE = 8 + NONCE_SIZE
+
+	// [len 4][type 1] ... [dest 64:96] ...
+	FRAME_MIN_SIZE = 96
+
+	ERR_ROUTER_ACCESS_DENIED     = "{ERR_XCHG_ROUTER_ACCESS_DENIED}"
+	ERR_ROUTER_TOO_MANY_REQUESTS = "{ERR_XCHG_ROUTER_TOO_MANY_REQUESTS}"
 )
 
-func NewRouter() *Router {
+func NewRouter(options RouterOptions) *Router {
 	var c Router
-	c.addresses = make(map[string]*Storage)
-	c.nextId = 1
+	c.options = options
+	if c.options.LongPollingTimeout <= 0 {
+		c.options.LongPollingTimeout = 10 * time.Second
+	}
+	c.addresses = newAddressTable()
+	if c.options.NonceRateLimit <= 0 {
+		c.options.NonceRateLimit = NONCE_RATE_LIMIT
+	}
+	c.nonces = NewNonces(NONCE_COUNT)
+	c.nonceLimiter = NewNonceLimiter(c.options.NonceRateLimit)
 
 	c.statLastDT = time.Now()
 	c.clearAddressesLastDT = time.Now()
 	return &c
 }
 
-func (c *Router) Start() error {
+// Start binds all listeners before it returns, nothing is started if one of them fails
+func (c *Router) Start() (err error) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
@@ -133,21 +206,95 @@ func (c *Router) Start() error {
 		return errors.New("it is stopping")
 	}
 
-	go c.thBackgroundOperations()
+	var httpListener, tcpListener net.Listener
+	var udpConn *net.UDPConn
+	defer func() {
+		if err == nil {
+			return
+		}
+		if httpListener != nil && httpListener != c.options.HttpListener {
+			httpListener.Close()
+		}
+		if tcpListener != nil {
+			tcpListener.Close()
+		}
+		if udpConn != nil {
+			udpConn.Close()
+		}
+	}()
+
+	httpListener = c.options.HttpListener
+	if httpListener == nil && c.options.HttpAddress != "" {
+		httpListener, err = net.Listen("tcp", c.options.HttpAddress)
+		if err != nil {
+			return
+		}
+	}
+	if c.options.TcpAddress != "" {
+		tcpListener, err = net.Listen("tcp", c.options.TcpAddress)
+		if err != nil {
+			return
+		}
+	}
+	if c.options.UdpAddress != "" {
+		var udpAddr *net.UDPAddr
+		udpAddr, err = net.ResolveUDPAddr("udp", c.options.UdpAddress)
+		if err != nil {
+			return
+		}
+		udpConn, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return
+		}
+	}
+
+	c.started = true
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+	go c.thBackgroundOperations(c.stop, c.stopped)
+
+	if httpListener != nil {
+		c.httpServer = NewHttpServer()
+		c.httpServer.longPollingTimeout = c.options.LongPollingTimeout
+		c.httpAddr = httpListener.Addr()
+		go c.httpServer.Serve(c, httpListener)
+	}
 
-	c.httpServer = NewHttpServer()
-	c.httpServer.Start(c, 8084)
+	if tcpListener != nil {
+		c.tcpServer = NewTcpServer()
+		c.tcpAddr = tcpListener.Addr()
+		go c.tcpServer.Serve(c, tcpListener)
+	}
+
+	if udpConn != nil {
+		c.udpServer = NewUdpServer()
+		c.udpAddr = udpConn.LocalAddr()
+		go c.udpServer.Serve(c, udpConn)
+	}
 
 	return nil
 }
 
-func (c *Router) Stop() error {
+// HttpAddr is the bound address of the HTTP API, nil if the service is disabled
+func (c *Router) HttpAddr() net.Addr {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.httpAddr
+}
 
-	if c.httpServer != nil {
-		c.httpServer.Stop()
-		c.httpServer = nil
-	}
+func (c *Router) TcpAddr() net.Addr {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.tcpAddr
+}
 
+func (c *Router) UdpAddr() net.Addr {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.udpAddr
+}
+
+func (c *Router) Stop() error {
 	c.mtx.Lock()
 	if !c.started {
 		c.mtx.Unlock()
@@ -158,57 +305,77 @@ func (c *Router) Stop() error {
 		return errors.New("already stopping")
 	}
 	c.stopping = true
+	httpServer := c.httpServer
+	tcpServer := c.tcpServer
+	udpServer := c.udpServer
+	c.httpServer = nil
+	c.tcpServer = nil
+	c.udpServer = nil
+	close(c.stop)
+	stopped := c.stopped
 	c.mtx.Unlock()
 
-	for {
-		c.mtx.Lock()
-		started := c.started
-		c.mtx.Unlock()
-		if !started {
-			break
-		}
-		time.Sleep(10 * time.Millisecond)
+	if httpServer != nil {
+		httpServer.Stop()
 	}
 
+	if tcpServer != nil {
+		tcpServer.Stop()
+	}
+
+	if udpServer != nil {
+		udpServer.Stop()
+	}
+
+	<-stopped
+
 	return nil
 }
 
-func (c *Router) thBackgroundOperations() {
-	c.started = true
-	for {
-		c.mtx.Lock()
-		stopping := c.stopping
-		c.mtx.Unlock()
-		if stopping {
-			break
+func (c *Router) thBackgroundOperations(stop chan struct{}, stopped chan struct{}) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	working := true
+	for working {
+		select {
+		case <-stop:
+			working = false
+		case <-ticker.C:
+			c.thStatistics()
+			c.thClearAddresses()
 		}
-		time.Sleep(50 * time.Millisecond)
-		c.thStatistics()
-		c.thClearAddresses()
 	}
+
+	c.mtx.Lock()
 	c.started = false
+	c.stopping = false
+	c.mtx.Unlock()
+	close(stopped)
 }
 
 func (c *Router) thStatistics() {
 	now := time.Now()
 	if now.Sub(c.statLastDT) >= 1*time.Second {
-		c.mtx.Lock()
+		current := c.stat.snapshot()
 		var stat RouterStatistics
-		stat.BytesIn = c.stat.BytesIn - c.statLast.BytesIn
-		stat.BytesOut = c.stat.BytesOut - c.statLast.BytesOut
-		stat.FramesIn = c.stat.FramesIn - c.statLast.FramesIn
-		stat.FramesOut = c.stat.FramesOut - c.statLast.FramesOut
-
-		stat.HttpRequests = c.stat.HttpRequests - c.statLast.HttpRequests
-		stat.HttpRequestsR = c.stat.HttpRequestsR - c.statLast.HttpRequestsR
-		stat.HttpRequestsW = c.stat.HttpRequestsW - c.statLast.HttpRequestsW
-		stat.HttpRequestsN = c.stat.HttpRequestsN - c.statLast.HttpRequestsN
-		stat.HttpRequestsNS = c.stat.HttpRequestsNS - c.statLast.HttpRequestsNS
-		stat.HttpRequestsD = c.stat.HttpRequestsD - c.statLast.HttpRequestsD
-		stat.HttpRequestsF = c.stat.HttpRequestsF - c.statLast.HttpRequestsF
-
-		c.statLast = c.stat
-		c.mtx.Unlock()
+		stat.BytesIn = current.BytesIn - c.statLast.BytesIn
+		stat.BytesOut = current.BytesOut - c.statLast.BytesOut
+		stat.FramesIn = current.FramesIn - c.statLast.FramesIn
+		stat.FramesOut = current.FramesOut - c.statLast.FramesOut
+
+		stat.HttpRequests = current.HttpRequests - c.statLast.HttpRequests
+		stat.HttpRequestsR = current.HttpRequestsR - c.statLast.HttpRequestsR
+		stat.HttpRequestsW = current.HttpRequestsW - c.statLast.HttpRequestsW
+		stat.HttpRequestsN = current.HttpRequestsN - c.statLast.HttpRequestsN
+		stat.HttpRequestsNS = current.HttpRequestsNS - c.statLast.HttpRequestsNS
+		stat.HttpRequestsD = current.HttpRequestsD - c.statLast.HttpRequestsD
+		stat.HttpRequestsF = current.HttpRequestsF - c.statLast.HttpRequestsF
+		stat.HttpRequestsWS = current.HttpRequestsWS - c.statLast.HttpRequestsWS
+		stat.TcpConnections = current.TcpConnections - c.statLast.TcpConnections
+		stat.UdpRequests = current.UdpRequests - c.statLast.UdpRequests
+
+		c.statLast = current
 
 		c.statSpeed.SpeedBytesIn = int(float64(stat.BytesIn) / now.Sub(c.statLastDT).Seconds())
 		c.statSpeed.SpeedBytesOut = int(float64(stat.BytesOut) / now.Sub(c.statLastDT).Seconds())
@@ -226,6 +393,9 @@ func (c *Router) thStatistics() {
 		c.statSpeed.SpeedHttpRequestsNS = int(float64(stat.HttpRequestsNS) / now.Sub(c.statLastDT).Seconds())
 		c.statSpeed.SpeedHttpRequestsD = int(float64(stat.HttpRequestsD) / now.Sub(c.statLastDT).Seconds())
 		c.statSpeed.SpeedHttpRequestsF = int(float64(stat.HttpRequestsF) / now.Sub(c.statLastDT).Seconds())
+		c.statSpeed.SpeedHttpRequestsWS = int(float64(stat.HttpRequestsWS) / now.Sub(c.statLastDT).Seconds())
+		c.statSpeed.SpeedTcpConnections = int(float64(stat.TcpConnections) / now.Sub(c.statLastDT).Seconds())
+		c.statSpeed.SpeedUdpRequests = int(float64(stat.UdpRequests) / now.Sub(c.statLastDT).Seconds())
 		c.statSpeed.Version = VERSION
 
 		c.statLastDT = now
@@ -236,17 +406,7 @@ func (c *Router) thStatistics() {
 func (c *Router) thClearAddresses() {
 	now := time.Now()
 	if now.Sub(c.clearAddressesLastDT) >= 1*time.Second {
-		c.mtx.Lock()
-		addresses := make([]*Storage, 0)
-		for address, addressStorage := range c.addresses {
-			if now.Sub(addressStorage.TouchDT) > 10*time.Second {
-				delete(c.addresses, address)
-				continue
-			}
-			addresses = append(addresses, addressStorage)
-		}
-		c.mtx.Unlock()
-
+		addresses := c.addresses.removeIdle(10 * time.Second)
 		for _, a := range addresses {
 			a.Clear()
 		}
@@ -256,41 +416,164 @@ func (c *Router) thClearAddresses() {
 }
 
 func (c *Router) Put(frame []byte) {
-	var ok bool
-	var addressStorage *Storage
-
 	addressDest := frame[64 : 64+32]
 	// addressSrc := frame[32 : 32+32]
 
 	// logger.Println("ROUTER PUT ", utils.TransactionSummary(frame))
 
-	c.mtx.Lock()
 	addrDestStr := hex.EncodeToString(addressDest)
 	//addrSrcStr := hex.EncodeToString(addressSrc)
 	//fmt.Println("ROUTER dest:", addrDestStr)
 	//fmt.Println("ROUTER src:", addrSrcStr)
-	addressStorage, ok = c.addresses[addrDestStr]
-	if !ok || addressStorage == nil {
-		addressStorage = NewStorage()
-		c.addresses[addrDestStr] = addressStorage
-	}
-	id := c.nextId
-	c.nextId++
-	c.mtx.Unlock()
-
+	shard := c.addresses.shard(addrDestStr)
+	shard.mtx.Lock()
+	addressStorage := shard.getOrCreateLocked(addrDestStr)
+	// Messages of the address must be stored in order of their ids
+	id := c.nextId.Add(1)
 	addressStorage.Put(id, frame)
+	shard.mtx.Unlock()
+
 	//fmt.Println("ROUTER PUT:", tp, len(frame), id)
 
-	c.stat.FramesIn++
-	c.stat.BytesIn += len(frame)
+	c.stat.FramesIn.Add(1)
+	c.stat.BytesIn.Add(int64(len(frame)))
+}
+
+// PutFrames puts the sequence of frames: [frame][frame]...
+func (c *Router) PutFrames(data []byte) {
+	offset := 0
+	for offset+FRAME_MIN_SIZE <= len(data) {
+		frameLen := int(binary.LittleEndian.Uint32(data[offset:]))
+		if frameLen < FRAME_MIN_SIZE || offset+frameLen > len(data) {
+			break
+		}
+		c.Put(data[offset : offset+frameLen])
+		offset += frameLen
+	}
+}
+
+// NextNonce issues the nonce for the next read request of the remote address.
+// Every remote host gets at most NonceRateLimit nonces per second.
+func (c *Router) NextNonce(remoteAddr string) (nonce [NONCE_SIZE]byte, err error) {
+	if !c.nonceLimiter.Allow(remoteAddr) {
+		err = errors.New(ERR_ROUTER_TOO_MANY_REQUESTS)
+		return
+	}
+	nonce = c.nonces.Next()
+	return
+}
+
+// CheckReadRequest verifies that the reader owns the private key of the address
+func (c *Router) CheckReadRequest(frame []byte) (err error) {
+	if len(frame) != READ_REQUEST_SIZE {
+		err = errors.New("wrong frame size")
+		return
+	}
+	address := ed25519.PublicKey(frame[16 : 16+32])
+	nonce := frame[48 : 48+NONCE_SIZE]
+	signature := frame[48+NONCE_SIZE:]
+	if !ed25519.Verify(address, frame[:48+NONCE_SIZE], signature) {
+		err = errors.New(ERR_ROUTER_ACCESS_DENIED)
+		return
+	}
+	if !c.nonces.Check(nonce) {
+		err = errors.New(ERR_ROUTER_ACCESS_DENIED)
+		return
+	}
+	return
+}
+
+// GetMessagesWait is the long polling version of GetMessages for the signed read requests.
+// The reader is woken up by Put to its address, until then it costs nothing.
+// The response contains the nonce for the next request.
+func (c *Router) GetMessagesWait(ctx context.Context, frame []byte) (response []byte, count int, err error) {
+	err = c.CheckReadRequest(frame)
+	if err != nil {
+		return
+	}
+
+	addressStorage := c.addReader(hex.EncodeToString(frame[16 : 16+32]))
+	defer addressStorage.RemoveReader()
+
+	var messages []byte
+	for {
+		// Subscribe before reading - a message put in between wakes us up
+		received := addressStorage.Received()
+		messages, count, err = c.GetMessages(frame[:48])
+		if count > 0 || err != nil || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-received:
+		case <-ctx.Done():
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	nonce := c.nonces.Next()
+	response = make([]byte, READ_RESPONSE_HEADER_SIZE+len(messages)-8)
+	copy(response, messages[:8])
+	copy(response[8:], nonce[:])
+	copy(response[READ_RESPONSE_HEADER_SIZE:], messages[8:])
+	return
+}
+
+// PushMessages sends the mailbox of the checked read request to a persistent connection
+// until ctx is done or write fails. Every message is [lastId 8][frames] of at most maxSize bytes of frames.
+func (c *Router) PushMessages(ctx context.Context, readRequest []byte, maxSize uint64, write func(messages []byte) error, ping func() error, pingInterval time.Duration) {
+	getMessagesRequest := make([]byte, 48)
+	copy(getMessagesRequest, readRequest[:48])
+	binary.LittleEndian.PutUint64(getMessagesRequest[8:], maxSize)
+
+	addressStorage := c.addReader(hex.EncodeToString(readRequest[16:48]))
+	defer addressStorage.RemoveReader()
+
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		// Subscribe before reading - a message put in between wakes us up
+		received := addressStorage.Received()
+		messages, count, err := c.GetMessages(getMessagesRequest)
+		if err != nil {
+			return
+		}
+		if count > 0 {
+			if write(messages) != nil {
+				return
+			}
+			// The next batch starts after the last sent message
+			copy(getMessagesRequest, messages[:8])
+			continue
+		}
+
+		select {
+		case <-received:
+		case <-pingTicker.C:
+			if ping() != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// addReader keeps the storage of the address while somebody waits for it
+func (c *Router) addReader(address string) (addressStorage *Storage) {
+	shard := c.addresses.shard(address)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	addressStorage = shard.getOrCreateLocked(address)
+	addressStorage.AddReader()
+	return
 }
 
 // Get message request
 func (c *Router) GetMessages(frame []byte) (response []byte, count int, err error) {
-	var ok bool
-	var addressStorage *Storage
-
-	if len(frame) < 46 {
+	if len(frame) < 48 {
 		err = errors.New("wrong frame size")
 		return
 	}
@@ -301,11 +584,8 @@ func (c *Router) GetMessages(frame []byte) (response []byte, count int, err erro
 
 	addressSrc := addressSrcBS
 
-	c.mtx.Lock()
-	addressStorage, ok = c.addresses[hex.EncodeToString(addressSrc)]
-	c.mtx.Unlock()
-
-	if !ok || addressStorage == nil {
+	addressStorage := c.addresses.get(hex.EncodeToString(addressSrc))
+	if addressStorage == nil {
 		response = make([]byte, 8)
 		binary.LittleEndian.PutUint64(response[0:], 0)
 		return
@@ -320,11 +600,16 @@ func (c *Router) GetMessages(frame []byte) (response []byte, count int, err erro
 		copy(response[8:], msgData)
 	}
 
-	c.stat.FramesOut += count
-	c.stat.BytesOut += len(msgData)
+	c.stat.FramesOut.Add(int64(count))
+	c.stat.BytesOut.Add(int64(len(msgData)))
 	return
 }
 
+// Statistics returns the totals since the start
+func (c *Router) Statistics() RouterStatistics {
+	return c.stat.snapshot()
+}
+
 func (c *Router) DebugString() (result []byte) {
 	c.mtx.Lock()
 	result = make([]byte, len(c.lastDebugInfo))
@@ -342,52 +627,51 @@ func (c *Router) StatString() (result []byte) {
 }
 
 func (c *Router) DeclareHttpRequestR() {
-	c.mtx.Lock()
-	c.stat.HttpRequests++
-	c.stat.HttpRequestsR++
-	c.mtx.Unlock()
+	c.stat.HttpRequests.Add(1)
+	c.stat.HttpRequestsR.Add(1)
 }
 
 func (c *Router) DeclareHttpRequestW() {
-	c.mtx.Lock()
-	c.stat.HttpRequests++
-	c.stat.HttpRequestsW++
-	c.mtx.Unlock()
+	c.stat.HttpRequests.Add(1)
+	c.stat.HttpRequestsW.Add(1)
 }
 
 func (c *Router) DeclareHttpRequestN() {
-	c.mtx.Lock()
-	c.stat.HttpRequests++
-	c.stat.HttpRequestsN++
-	c.mtx.Unlock()
+	c.stat.HttpRequests.Add(1)
+	c.stat.HttpRequestsN.Add(1)
 }
 
 func (c *Router) DeclareHttpRequestNS() {
-	c.mtx.Lock()
-	c.stat.HttpRequests++
-	c.stat.HttpRequestsNS++
-	c.mtx.Unlock()
+	c.stat.HttpRequests.Add(1)
+	c.stat.HttpRequestsNS.Add(1)
 }
 
 func (c *Router) DeclareHttpRequestD() {
-	c.mtx.Lock()
-	c.stat.HttpRequests++
-	c.stat.HttpRequestsD++
-	c.mtx.Unlock()
+	c.stat.HttpRequests.Add(1)
+	c.stat.HttpRequestsD.Add(1)
 }
 
 func (c *Router) DeclareHttpRequestS() {
-	c.mtx.Lock()
-	c.stat.HttpRequests++
-	c.stat.HttpRequestsS++
-	c.mtx.Unlock()
+	c.stat.HttpRequests.Add(1)
+	c.stat.HttpRequestsS.Add(1)
 }
 
 func (c *Router) DeclareHttpRequestF() {
-	c.mtx.Lock()
-	c.stat.HttpRequests++
-	c.stat.HttpRequestsF++
-	c.mtx.Unlock()
+	c.stat.HttpRequests.Add(1)
+	c.stat.HttpRequestsF.Add(1)
+}
+
+func (c *Router) DeclareHttpRequestWS() {
+	c.stat.HttpRequests.Add(1)
+	c.stat.HttpRequestsWS.Add(1)
+}
+
+func (c *Router) DeclareTcpConnection() {
+	c.stat.TcpConnections.Add(1)
+}
+
+func (c *Router) DeclareUdpRequest() {
+	c.stat.UdpRequests.Add(1)
 }
 
 func (c *Router) buildDebugString() {
@@ -404,21 +688,22 @@ func (c *Router) buildDebugString() {
 		Addresses    []AddressInfo         `json:"addresses"`
 	}
 
-	c.mtx.Lock()
+	addresses := c.addresses.all()
+
 	var di DebugInfo
-	di.AddressCount = len(c.addresses)
-	di.NextMsgId = int(c.nextId)
-	di.Stat = c.stat
+	di.AddressCount = len(addresses)
+	di.NextMsgId = int(c.nextId.Load() + 1)
+	di.Stat = c.stat.snapshot()
 	di.StatSpeed = c.statSpeed
 
-	di.Addresses = make([]AddressInfo, 0, len(c.addresses))
-	for address, a := range c.addresses {
+	// The storage locks are taken without the router lock
+	di.Addresses = make([]AddressInfo, 0, len(addresses))
+	for address, a := range addresses {
 		var ai AddressInfo
 		ai.Address = address
 		ai.MessageCount = a.MessagesCount()
 		di.Addresses = append(di.Addresses, ai)
 	}
-	c.mtx.Unlock()
 
 	sort.Slice(di.Addresses, func(i, j int) bool {
 		return di.Addresses[i].Address < di.Addresses[j].Address
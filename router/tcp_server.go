@@ -0,0 +1,243 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream frames: [len 4][type 1][reserved 3][payload], len includes the header.
+// Transaction frames are sent as they are - Transaction.Marshal starts with the same length.
+const (
+	TCP_PORT = 8085
+
+	TCP_FRAME_HEADER_SIZE = 8
+	TCP_FRAME_PING        = 0x00
+	TCP_FRAME_PONG        = 0x01
+	TCP_FRAME_NONCE       = 0x03
+	TCP_FRAME_READ        = 0x0A
+	TCP_FRAME_MAILBOX     = 0x0B
+
+	TCP_HANDSHAKE_TIMEOUT = 10 * time.Second
+	TCP_PING_INTERVAL     = 20 * time.Second
+	TCP_READ_TIMEOUT      = 2 * TCP_PING_INTERVAL
+	TCP_MAX_FRAME_SIZE    = INPUT_BUFFER_SIZE
+	TCP_MAX_BATCH_SIZE    = 1024 * 1024
+)
+
+// MakeStreamFrame builds a service frame of the TCP stream
+func MakeStreamFrame(frameType byte, payload []byte) []byte {
+	frame := make([]byte, TCP_FRAME_HEADER_SIZE+len(payload))
+	binary.LittleEndian.PutUint32(frame, uint32(len(frame)))
+	frame[4] = frameType
+	copy(frame[TCP_FRAME_HEADER_SIZE:], payload)
+	return frame
+}
+
+// ReadStreamFrame reads one length-prefixed frame of the TCP stream
+func ReadStreamFrame(r io.Reader) (frame []byte, err error) {
+	header := make([]byte, TCP_FRAME_HEADER_SIZE)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return
+	}
+	frameLen := int(binary.LittleEndian.Uint32(header))
+	if frameLen < TCP_FRAME_HEADER_SIZE || frameLen > TCP_MAX_FRAME_SIZE {
+		err = errors.New("wrong frame size: " + fmt.Sprint(frameLen))
+		return
+	}
+	frame = make([]byte, frameLen)
+	copy(frame, header)
+	_, err = io.ReadFull(r, frame[TCP_FRAME_HEADER_SIZE:])
+	return
+}
+
+type TcpServer struct {
+	mtx      sync.Mutex
+	server   *Router
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	stopped  bool
+	wg       sync.WaitGroup
+	err      error
+}
+
+func NewTcpServer() *TcpServer {
+	var c TcpServer
+	c.conns = make(map[net.Conn]struct{})
+	return &c
+}
+
+func (c *TcpServer) Start(server *Router, port int) {
+	c.server = server
+	go c.thListen(port)
+}
+
+func (c *TcpServer) Stop() error {
+	c.mtx.Lock()
+	c.stopped = true
+	listener := c.listener
+	c.listener = nil
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.mtx.Unlock()
+
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	c.wg.Wait()
+	return err
+}
+
+func (c *TcpServer) thListen(port int) {
+	listener, err := net.Listen("tcp", ":"+fmt.Sprint(port))
+	if err != nil {
+		c.mtx.Lock()
+		c.err = err
+		c.mtx.Unlock()
+		return
+	}
+	c.Serve(c.server, listener)
+}
+
+// Serve accepts the connections of the listener until Stop
+func (c *TcpServer) Serve(server *Router, listener net.Listener) (err error) {
+	c.mtx.Lock()
+	c.server = server
+	if c.stopped {
+		c.mtx.Unlock()
+		listener.Close()
+		err = errors.New("stopped")
+		return
+	}
+	c.listener = listener
+	c.mtx.Unlock()
+
+	for {
+		var conn net.Conn
+		conn, err = listener.Accept()
+		if err != nil {
+			return
+		}
+		c.mtx.Lock()
+		if c.listener == nil {
+			c.mtx.Unlock()
+			conn.Close()
+			err = errors.New("stopped")
+			return
+		}
+		c.conns[conn] = struct{}{}
+		c.wg.Add(1)
+		c.mtx.Unlock()
+
+		go func() {
+			defer c.wg.Done()
+			c.serveConn(conn)
+			c.mtx.Lock()
+			delete(c.conns, conn)
+			c.mtx.Unlock()
+		}()
+	}
+}
+
+// serveConn works as /api/ws:
+// router -> peer: NONCE [nonce 16]
+// peer -> router: READ [read request of /api/r]
+// router -> peer: MAILBOX [lastId 8][frames]
+// peer -> router: [frame][frame]...
+func (c *TcpServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	c.server.DeclareTcpConnection()
+
+	var writeMtx sync.Mutex
+	write := func(frame []byte) error {
+		writeMtx.Lock()
+		defer writeMtx.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(TCP_READ_TIMEOUT))
+		_, err := conn.Write(frame)
+		return err
+	}
+
+	// Handshake
+	nonce, err := c.server.NextNonce(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	if write(MakeStreamFrame(TCP_FRAME_NONCE, nonce[:])) != nil {
+		return
+	}
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	conn.SetReadDeadline(time.Now().Add(TCP_HANDSHAKE_TIMEOUT))
+	frame, err := ReadStreamFrame(reader)
+	if err != nil || frame[4] != TCP_FRAME_READ {
+		return
+	}
+	readRequest := frame[TCP_FRAME_HEADER_SIZE:]
+	if c.server.CheckReadRequest(readRequest) != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+		c.server.PushMessages(ctx, readRequest, TCP_MAX_BATCH_SIZE, func(messages []byte) error {
+			return write(MakeStreamFrame(TCP_FRAME_MAILBOX, messages))
+		}, func() error {
+			return write(MakeStreamFrame(TCP_FRAME_PING, nil))
+		}, TCP_PING_INTERVAL)
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(TCP_READ_TIMEOUT))
+		frame, err = ReadStreamFrame(reader)
+		if err != nil {
+			break
+		}
+		switch frame[4] {
+		case TCP_FRAME_PING:
+			err = write(MakeStreamFrame(TCP_FRAME_PONG, nil))
+		case TCP_FRAME_PONG:
+		default:
+			c.server.PutFrames(frame)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	cancel()
+	wg.Wait()
+}
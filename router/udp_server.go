@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// The peers learn their public UDP endpoints from the router to punch holes to each other
+const (
+	UDP_PORT = 8086
+
+	UDP_FRAME_ENDPOINT_REQUEST  = 0x0C
+	UDP_FRAME_ENDPOINT_RESPONSE = 0x0D
+
+	// [header 8][ip 16][port 2]
+	UDP_ENDPOINT_RESPONSE_SIZE = TCP_FRAME_HEADER_SIZE + 16 + 2
+)
+
+type UdpServer struct {
+	mtx     sync.Mutex
+	server  *Router
+	conn    *net.UDPConn
+	stopped bool
+	err     error
+}
+
+func NewUdpServer() *UdpServer {
+	var c UdpServer
+	return &c
+}
+
+func (c *UdpServer) Start(server *Router, port int) {
+	c.server = server
+	go c.thListen(port)
+}
+
+func (c *UdpServer) Stop() error {
+	c.mtx.Lock()
+	c.stopped = true
+	conn := c.conn
+	c.conn = nil
+	c.mtx.Unlock()
+
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (c *UdpServer) thListen(port int) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		c.mtx.Lock()
+		c.err = err
+		c.mtx.Unlock()
+		return
+	}
+	c.Serve(c.server, conn)
+}
+
+// Serve answers the endpoint requests until Stop
+func (c *UdpServer) Serve(server *Router, conn *net.UDPConn) {
+	c.mtx.Lock()
+	c.server = server
+	if c.stopped {
+		c.mtx.Unlock()
+		conn.Close()
+		return
+	}
+	c.conn = conn
+	c.mtx.Unlock()
+
+	buffer := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if n < TCP_FRAME_HEADER_SIZE || int(binary.LittleEndian.Uint32(buffer)) != n {
+			continue
+		}
+		if buffer[4] == UDP_FRAME_ENDPOINT_REQUEST {
+			c.server.DeclareUdpRequest()
+			conn.WriteToUDP(MakeUdpEndpointResponse(addr), addr)
+		}
+	}
+}
+
+// MakeUdpEndpointResponse tells the peer how the router sees its UDP socket
+func MakeUdpEndpointResponse(addr *net.UDPAddr) []byte {
+	payload := make([]byte, 18)
+	copy(payload, addr.IP.To16())
+	binary.LittleEndian.PutUint16(payload[16:], uint16(addr.Port))
+	return MakeStreamFrame(UDP_FRAME_ENDPOINT_RESPONSE, payload)
+}
+
+func ParseUdpEndpointResponse(frame []byte) (addr *net.UDPAddr, err error) {
+	if len(frame) != UDP_ENDPOINT_RESPONSE_SIZE || frame[4] != UDP_FRAME_ENDPOINT_RESPONSE {
+		err = errors.New("wrong endpoint response")
+		return
+	}
+	ip := make(net.IP, 16)
+	copy(ip, frame[TCP_FRAME_HEADER_SIZE:])
+	addr = &net.UDPAddr{IP: ip, Port: int(binary.LittleEndian.Uint16(frame[TCP_FRAME_HEADER_SIZE+16:]))}
+	return
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	WS_HANDSHAKE_TIMEOUT = 10 * time.Second
+	WS_PING_INTERVAL     = 20 * time.Second
+	WS_READ_TIMEOUT      = 2 * WS_PING_INTERVAL
+	WS_MAX_MESSAGE_SIZE  = INPUT_BUFFER_SIZE
+	WS_MAX_BATCH_SIZE    = 1024 * 1024
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  64 * 1024,
+	WriteBufferSize: 64 * 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// processWS serves the persistent binary connection of a peer:
+// router -> peer: [nonce 16]
+// peer -> router: the read request of /api/r, the mailbox of the address is pushed to the connection
+// router -> peer: [lastId 8][frame][frame]...
+// peer -> router: [frame][frame]...
+func (c *HttpServer) processWS(w http.ResponseWriter, r *http.Request) {
+	c.server.DeclareHttpRequestWS()
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(WS_MAX_MESSAGE_SIZE)
+
+	// Handshake
+	nonce, err := c.server.NextNonce(r.RemoteAddr)
+	if err != nil {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()), time.Now().Add(time.Second))
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(WS_HANDSHAKE_TIMEOUT))
+	if err = conn.WriteMessage(websocket.BinaryMessage, nonce[:]); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(WS_HANDSHAKE_TIMEOUT))
+	_, readRequest, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	if err = c.server.CheckReadRequest(readRequest); err != nil {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()), time.Now().Add(time.Second))
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(WS_READ_TIMEOUT))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(WS_READ_TIMEOUT))
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(r.Context())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		c.server.PushMessages(ctx, readRequest, WS_MAX_BATCH_SIZE, func(messages []byte) error {
+			conn.SetWriteDeadline(time.Now().Add(WS_READ_TIMEOUT))
+			return conn.WriteMessage(websocket.BinaryMessage, messages)
+		}, func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WS_READ_TIMEOUT))
+		}, WS_PING_INTERVAL)
+	}()
+
+	for {
+		var data []byte
+		_, data, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(WS_READ_TIMEOUT))
+		c.server.PutFrames(data)
+	}
+
+	cancel()
+	wg.Wait()
+}
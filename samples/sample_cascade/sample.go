@@ -62,20 +62,16 @@ func Run() {
 		}
 		return
 	})
-	peer2 := xchg.StartServerPeer(nil, func(param *xchg.Param) (response []byte, err error) {
-		if param.Function == "" {
-			return
-		}
-		if param.Function == "get_name" {
-			response = []byte("MyName")
-			return
-		}
-		if param.Function == "get_status" {
-			response = []byte("MyStatus")
-			return
-		}
+	mux := xchg.NewServeMux()
+	mux.Handle("get_name", func(param *xchg.Param) (response []byte, err error) {
+		response = []byte("MyName")
+		return
+	})
+	mux.Handle("get_status", func(param *xchg.Param) (response []byte, err error) {
+		response = []byte("MyStatus")
 		return
 	})
+	peer2 := xchg.StartServerPeerHandler(nil, mux)
 
 	logger.Println("peer1", peer1.AddressHex())
 	logger.Println("peer2", peer2.AddressHex())
@@ -0,0 +1,63 @@
+package samplestream
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/xchgn/xchg/utils"
+	"github.com/xchgn/xchg/xchg"
+)
+
+const dataSize = 64 * xchg.XchgMaxTransactionSize
+
+func Run() {
+	serverPrivateKey, _ := utils.GeneratePrivateKey()
+	s := xchg.StartServerPeer(serverPrivateKey, func(param *xchg.Param) (response []byte, err error) {
+		return nil, nil
+	})
+	// The server sends back the hash of the received data and the data itself
+	s.HandleStream("hash", func(param *xchg.StreamParam) error {
+		hash := sha256.New()
+		_, err := io.Copy(param.Response, io.TeeReader(param.Body, hash))
+		if err != nil {
+			return err
+		}
+		fmt.Println("Server Data Hash:", hex.EncodeToString(hash.Sum(nil)))
+		return nil
+	})
+
+	///////////////////////////////////////////////
+	// Make client
+	c := xchg.StartClientPeer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	sentHash := sha256.New()
+	body := io.TeeReader(io.LimitReader(rand.Reader, dataSize), sentHash)
+
+	dtBegin := time.Now()
+	response, err := c.CallStream(ctx, s.Address(), "", "hash", body)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	receivedHash := sha256.New()
+	n, err := io.Copy(receivedHash, response)
+	response.Close()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	fmt.Println("Data Hash:", hex.EncodeToString(sentHash.Sum(nil)))
+	fmt.Println("Received Data Hash:", hex.EncodeToString(receivedHash.Sum(nil)), n, "bytes", time.Since(dtBegin))
+
+	c.Stop()
+	s.Stop()
+}
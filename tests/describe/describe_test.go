@@ -0,0 +1,73 @@
+package describe_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+)
+
+type echoRequest struct {
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags,omitempty"`
+	Data  []byte   `json:"data"`
+	Inner *echoRequest
+	Skip  int `json:"-"`
+}
+
+type echoResponse struct {
+	Text string `json:"text"`
+}
+
+func echo(param *xchg.Param, req echoRequest) (echoResponse, error) {
+	return echoResponse{Text: req.Text}, nil
+}
+
+func TestDescribe(t *testing.T) {
+	mux := xchg.NewServeMux()
+	mux.HandleWithOptions("version", func(param *xchg.Param) ([]byte, error) { return nil, nil }, xchg.RouteOptions{AuthRequired: true, Timeout: time.Second})
+	mux.Handle("files.*", func(param *xchg.Param) ([]byte, error) { return nil, nil })
+	xchg.HandleTypedWithOptions(mux, "echo", echo, xchg.RouteOptions{Version: "1.2", Description: "returns the text", Codec: &xchg.JsonCodec{}})
+
+	functions, opaque := mux.Describe()
+	if opaque {
+		t.Error("mux without not-found handler is not opaque")
+	}
+	if len(functions) != 3 {
+		t.Fatal("wrong count of functions:", len(functions))
+	}
+	if functions[0].Name != "echo" || functions[1].Name != "files.*" || functions[2].Name != "version" {
+		t.Error("wrong order:", functions[0].Name, functions[1].Name, functions[2].Name)
+	}
+
+	e := functions[0]
+	if e.Version != "1.2" || e.Description != "returns the text" || !reflect.DeepEqual(e.Codecs, []string{"json"}) {
+		t.Error("wrong description of echo:", e)
+	}
+	request, ok := e.Request.(map[string]interface{})
+	if !ok {
+		t.Fatal("wrong request schema:", e.Request)
+	}
+	if request["text"] != "string" || request["data"] != "bytes" || !reflect.DeepEqual(request["tags"], []interface{}{"string"}) {
+		t.Error("wrong request schema:", request)
+	}
+	if _, ok := request["Inner"]; !ok {
+		t.Error("no nested field in the schema")
+	}
+	if _, ok := request["Skip"]; ok {
+		t.Error("ignored field in the schema")
+	}
+
+	if !functions[1].Prefix || functions[1].Request != nil {
+		t.Error("wrong description of files.*:", functions[1])
+	}
+	if !functions[2].AuthRequired || functions[2].Timeout != "1s" {
+		t.Error("wrong description of version:", functions[2])
+	}
+
+	mux.HandleNotFound(func(param *xchg.Param) ([]byte, error) { return nil, nil })
+	if _, opaque = mux.Describe(); !opaque {
+		t.Error("mux with not-found handler is opaque")
+	}
+}
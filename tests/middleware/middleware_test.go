@@ -0,0 +1,68 @@
+package middleware_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+)
+
+type testLogger struct {
+	lines []string
+}
+
+func (c *testLogger) Println(v ...interface{}) {
+	c.lines = append(c.lines, fmt.Sprint(v...))
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	logger := &testLogger{}
+	handler := xchg.RecoveryMiddleware(logger)(func(param *xchg.Param) ([]byte, error) {
+		panic("boom")
+	})
+
+	response, err := handler(&xchg.Param{Function: "f"})
+	if response != nil {
+		t.Error("unexpected response")
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), xchg.ERR_XCHG_SRV_FUNCTION_PANIC) || !strings.Contains(err.Error(), "boom") {
+		t.Error("wrong error:", err)
+	}
+	if len(logger.lines) != 1 {
+		t.Error("panic is not logged")
+	}
+}
+
+func TestRecoveryMiddlewarePeerLogger(t *testing.T) {
+	logger := &testLogger{}
+	peer := xchg.NewPeerWithOptions(xchg.PeerOptions{Logger: logger})
+	handler := xchg.RecoveryMiddleware(nil)(func(param *xchg.Param) ([]byte, error) {
+		panic("boom")
+	})
+
+	if _, err := handler(&xchg.Param{Function: "f", LocalPeer: peer}); err == nil {
+		t.Error("panic is not converted")
+	}
+	if len(logger.lines) != 1 {
+		t.Error("panic is not written to the logger of the peer")
+	}
+}
+
+func TestTimingMiddleware(t *testing.T) {
+	var observedFunction string
+	var observedDuration time.Duration
+	handler := xchg.TimingMiddleware(func(param *xchg.Param, duration time.Duration, err error) {
+		observedFunction = param.Function
+		observedDuration = duration
+	})(func(param *xchg.Param) ([]byte, error) {
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil
+	})
+
+	_, _ = handler(&xchg.Param{Function: "f"})
+	if observedFunction != "f" || observedDuration < 10*time.Millisecond {
+		t.Error("wrong observation:", observedFunction, observedDuration)
+	}
+}
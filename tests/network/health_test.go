@@ -0,0 +1,56 @@
+package network_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+)
+
+func TestRouterHealthOfUnavailableRouter(t *testing.T) {
+	peer := xchg.NewPeer(nil)
+	peer.SetNetwork(xchg.NewNetworkFromRouters([]*xchg.RouterInfo{{NetAddress: "127.0.0.1:9"}}))
+
+	remoteAddress, _, _ := ed25519.GenerateKey(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := peer.CallContext(ctx, remoteAddress, "", "f", nil); err == nil {
+		t.Fatal("call without router succeeded")
+	}
+
+	health := peer.RouterHealth()
+	if len(health) != 1 || health[0].Router != "127.0.0.1:9" {
+		t.Fatal("unexpected health:", health)
+	}
+	if health[0].Available || health[0].Score != 0 || health[0].Errors == 0 || health[0].LastError == "" {
+		t.Error("router is not declared failed:", *health[0])
+	}
+}
+
+func TestRouterHealthOfUnavailableTcpRouter(t *testing.T) {
+	options := xchg.DefaultPeerOptions()
+	options.RouterEnabled = false
+	options.LoopbackHub = nil
+	options.LongPollingDelay = 50 * time.Millisecond
+	options.Routers = []*xchg.RouterInfo{{NetAddress: "127.0.0.1:9", TcpAddress: "127.0.0.1:9"}}
+	peer := xchg.NewPeerWithOptions(options)
+	peer.SetDirectUdp(false)
+	peer.SetLanDiscovery(false)
+	peer.Start()
+	defer peer.Stop()
+
+	// Nothing is sent, the receiving reports the connection error
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		health := peer.RouterHealth()
+		if len(health) == 1 && health[0].Errors > 0 && health[0].LastError != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("router without connection is not declared failed:", health)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
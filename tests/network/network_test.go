@@ -0,0 +1,134 @@
+package network_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xchgn/xchg/blockchain"
+	"github.com/xchgn/xchg/xchg"
+)
+
+func TestGetRouterAddrWithoutRouters(t *testing.T) {
+	n := xchg.NewNetwork()
+	if addr := n.GetRouterAddr("00"); addr != xchg.DefaultRouterAddr {
+		t.Error("unexpected router:", addr)
+	}
+}
+
+func TestGetRouterAddrIsStable(t *testing.T) {
+	n := xchg.NewNetworkFromRouters([]*xchg.RouterInfo{
+		{Name: "r1", NetAddress: "10.0.0.1:8084"},
+		{Name: "r2", NetAddress: "10.0.0.2:8084"},
+		{Name: "r3", NetAddress: "10.0.0.3:8084"},
+	})
+
+	address := "2f3c5b1a9e4d7c8b6a5f4e3d2c1b0a99887766554433221100ffeeddccbbaa00"
+	home := n.GetRouterAddr(address)
+	for i := 0; i < 10; i++ {
+		if n.GetRouterAddr(address) != home {
+			t.Fatal("home router changed")
+		}
+	}
+
+	addrs := n.GetRouterAddrs(address, 5)
+	if len(addrs) != 3 || addrs[0] != home {
+		t.Error("wrong router list:", addrs)
+	}
+
+	// Removing another router must not move the address
+	routers := make([]*xchg.RouterInfo, 0)
+	for _, r := range n.GetRouters() {
+		if r.NetAddress == home || len(routers) == 0 {
+			routers = append(routers, r)
+		}
+	}
+	n.SetRouters(routers)
+	if n.GetRouterAddr(address) != home {
+		t.Error("home router moved")
+	}
+}
+
+func TestHomeRouterAddrs(t *testing.T) {
+	n := xchg.NewNetworkFromRouters([]*xchg.RouterInfo{
+		{Name: "r1", NetAddress: "10.0.0.1:8084"},
+		{Name: "r2", NetAddress: "10.0.0.2:8084"},
+		{Name: "r3", NetAddress: "10.0.0.3:8084"},
+	})
+
+	address := "2f3c5b1a9e4d7c8b6a5f4e3d2c1b0a99887766554433221100ffeeddccbbaa00"
+	if n.Redundancy() != xchg.XchgRouterRedundancy {
+		t.Error("unexpected redundancy:", n.Redundancy())
+	}
+	homes := n.GetHomeRouterAddrs(address)
+	if len(homes) != xchg.XchgRouterRedundancy || homes[0] != n.GetRouterAddr(address) {
+		t.Error("wrong home routers:", homes)
+	}
+
+	n.SetRedundancy(0)
+	if homes = n.GetHomeRouterAddrs(address); len(homes) != 1 {
+		t.Error("wrong home routers:", homes)
+	}
+	n.SetRedundancy(10)
+	if homes = n.GetHomeRouterAddrs(address); len(homes) != 3 {
+		t.Error("wrong home routers:", homes)
+	}
+}
+
+func TestCriticalCall(t *testing.T) {
+	if xchg.IsCriticalCall(context.Background()) {
+		t.Error("background context is critical")
+	}
+	if !xchg.IsCriticalCall(xchg.WithCriticalCall(context.Background())) {
+		t.Error("critical mark lost")
+	}
+}
+
+func TestLoadFromValidatorJson(t *testing.T) {
+	n := xchg.NewNetwork()
+	err := n.LoadFromValidatorJson([]byte(`[{"Address":"aa","HttpConnectionPoint":"1.2.3.4:8084","signature":""}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := n.GetRouterAddr("00"); addr != "1.2.3.4:8084" {
+		t.Error("unexpected router:", addr)
+	}
+
+	if err = n.LoadFromValidatorJson([]byte(`[]`)); err == nil {
+		t.Error("empty list accepted")
+	}
+}
+
+func TestLoadFromValidatorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The list is valid, the status is not
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`[{"Address":"aa","HttpConnectionPoint":"1.2.3.4:8084","signature":""}]`))
+	}))
+	defer server.Close()
+
+	n := xchg.NewNetwork()
+	err := n.LoadFromValidator(strings.TrimPrefix(server.URL, "http://"))
+	if err == nil || !strings.HasPrefix(err.Error(), xchg.ERR_XCHG_NETWORK_HTTP_STATUS) {
+		t.Error("wrong status accepted:", err)
+	}
+	if routers := n.GetRouters(); len(routers) != 0 {
+		t.Error("routers are loaded:", routers)
+	}
+}
+
+func TestLoadFromBlockchain(t *testing.T) {
+	n := xchg.NewNetwork()
+	err := n.LoadFromBlockchain([]*blockchain.Network{
+		{Segment: 1, Routers: []*blockchain.Router{{XchgAddr: "0x01", IpAddr: "5.6.7.8"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routers := n.GetRouters()
+	if len(routers) != 1 || routers[0].NetAddress != "5.6.7.8:8084" || routers[0].Segment != 1 {
+		t.Error("unexpected routers:", routers)
+	}
+}
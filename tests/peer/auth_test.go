@@ -0,0 +1,48 @@
+package peer_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+	"github.com/xchgn/xchg/xchgtest"
+)
+
+func TestAuthRejection(t *testing.T) {
+	network := xchgtest.NewNetwork(xchgtest.Options{Seed: 1})
+	defer network.Close()
+	network.AddRouter()
+
+	mux := xchg.NewServeMux()
+	mux.Handle("echo", func(param *xchg.Param) ([]byte, error) {
+		return param.Parameter, nil
+	})
+	mux.HandleAuth(func(param *xchg.Param) ([]byte, error) {
+		if string(param.AuthData) != "secret" {
+			return nil, errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+		}
+		return nil, nil
+	})
+	server := network.AddPeer(nil, mux.Serve)
+	client := network.AddPeer(nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The error of the auth handler reaches the caller before the timeout
+	_, err := client.CallContext(ctx, server.Address(), "wrong", "echo", []byte("1"))
+	if err == nil || !strings.Contains(err.Error(), xchg.ERR_XCHG_ACCESS_DENIED) {
+		t.Fatal("wrong auth data is not rejected:", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("rejection is not sent")
+	}
+
+	result, err := network.AddPeer(nil, nil).CallContext(ctx, server.Address(), "secret", "echo", []byte("1"))
+	if err != nil || string(result) != "1" {
+		t.Fatal("call after rejection failed:", err)
+	}
+}
@@ -0,0 +1,64 @@
+package peer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+	"github.com/xchgn/xchg/xchgtest"
+)
+
+func TestCancelCall(t *testing.T) {
+	network := xchgtest.NewNetwork(xchgtest.Options{Seed: 1})
+	defer network.Close()
+	network.AddRouter()
+
+	started := make(chan struct{}, 1)
+	cancelled := make(chan error, 1)
+	release := make(chan struct{})
+	server := network.AddPeer(nil, func(param *xchg.Param) ([]byte, error) {
+		if param.Function != "slow" {
+			return param.Parameter, nil
+		}
+		started <- struct{}{}
+		select {
+		case <-param.Context.Done():
+			cancelled <- param.Context.Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+		<-release
+		return []byte("late"), nil
+	})
+	client := network.AddPeer(nil, nil)
+
+	// The session is ready before the slow call
+	if _, err := client.CallContext(context.Background(), server.Address(), "", "echo", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.CallContext(ctx, server.Address(), "", "slow", nil)
+		result <- err
+	}()
+
+	<-started
+	cancel()
+	if err := <-result; !xchg.IsCancelled(err) {
+		t.Fatal("call is not cancelled:", err)
+	}
+	if err := <-cancelled; err == nil {
+		t.Fatal("context of the handler is not cancelled")
+	}
+
+	// Nothing is written after the handler returns
+	frames := network.Stat().Frames
+	close(release)
+	time.Sleep(200 * time.Millisecond)
+	if network.Stat().Frames != frames {
+		t.Fatal("response of the cancelled call is sent")
+	}
+}
@@ -0,0 +1,102 @@
+package peer_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+	"github.com/xchgn/xchg/xchgtest"
+)
+
+func TestGo(t *testing.T) {
+	network := xchgtest.NewNetwork(xchgtest.Options{Seed: 1})
+	defer network.Close()
+	network.AddRouter()
+	server := network.AddPeer(nil, func(param *xchg.Param) ([]byte, error) {
+		return param.Parameter, nil
+	})
+	client := network.AddPeer(nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	done := make(chan *xchg.PendingCall, 5)
+	calls := make(map[*xchg.PendingCall]string)
+	for i := 0; i < 5; i++ {
+		data := fmt.Sprint("call-", i)
+		calls[client.Go(ctx, server.Address(), "", "echo", []byte(data), done)] = data
+	}
+	for i := 0; i < 5; i++ {
+		call := <-done
+		data, ok := calls[call]
+		if !ok || call.Err != nil || string(call.Result) != data {
+			t.Fatal("wrong call result:", ok, call.Err, string(call.Result))
+		}
+		if result, err := call.Wait(); err != nil || string(result) != data {
+			t.Fatal("wrong Wait result:", err, string(result))
+		}
+	}
+
+	// The channel is allocated if not set
+	call := client.Go(ctx, server.Address(), "", "echo", []byte("single"), nil)
+	if result := <-call.Done; string(result.Result) != "single" {
+		t.Fatal("wrong result:", result.Err, string(result.Result))
+	}
+}
+
+func TestGoUnbufferedChannel(t *testing.T) {
+	peer := xchg.NewPeerWithOptions(xchg.PeerOptions{})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("unbuffered channel accepted")
+		}
+	}()
+	peer.Go(context.Background(), nil, "", "echo", nil, make(chan *xchg.PendingCall))
+}
+
+func TestConcurrentCallsShareHandshake(t *testing.T) {
+	network := xchgtest.NewNetwork(xchgtest.Options{Seed: 1})
+	defer network.Close()
+	network.AddRouter()
+	var auths int32
+	server := network.AddPeer(nil, func(param *xchg.Param) ([]byte, error) {
+		if param.Function == "" {
+			atomic.AddInt32(&auths, 1)
+			return nil, nil
+		}
+		return param.Parameter, nil
+	})
+	client := network.AddPeer(nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := fmt.Sprint("call-", i)
+			result, err := client.CallContext(ctx, server.Address(), "", "echo", []byte(data))
+			if err == nil && string(result) != data {
+				err = fmt.Errorf("wrong result %s", result)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&auths); n != 1 {
+		t.Fatal("handshakes:", n)
+	}
+}
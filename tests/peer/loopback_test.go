@@ -0,0 +1,80 @@
+package peer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+)
+
+func newLoopbackPeer(hub *xchg.LoopbackHub) *xchg.Peer {
+	options := xchg.DefaultPeerOptions()
+	options.RouterEnabled = false
+	options.LoopbackHub = hub
+	// No router is reachable, the frames can go only through the hub
+	options.Routers = []*xchg.RouterInfo{{NetAddress: "127.0.0.1:9", UdpAddress: "127.0.0.1:9"}}
+	peer := xchg.NewPeerWithOptions(options)
+	peer.SetDirectUdp(false)
+	peer.SetLanDiscovery(false)
+	return peer
+}
+
+func TestLoopback(t *testing.T) {
+	hub := xchg.NewLoopbackHub()
+
+	server := newLoopbackPeer(hub)
+	server.Callback = func(param *xchg.Param) ([]byte, error) {
+		if param.Function == "" {
+			if string(param.AuthData) != "secret" {
+				return nil, errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+			}
+			return nil, nil
+		}
+		return param.Parameter, nil
+	}
+	server.Start()
+	defer server.Stop()
+
+	client := newLoopbackPeer(hub)
+	client.Start()
+	defer client.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Several frames per call
+	data := bytes.Repeat([]byte{1, 2, 3}, 300*1024)
+	result, err := client.CallContext(ctx, server.Address(), "secret", "echo", data)
+	if err != nil || !bytes.Equal(result, data) {
+		t.Fatal("call failed:", err, len(result))
+	}
+
+	// The sessions are the same as through the routers
+	other := newLoopbackPeer(hub)
+	other.Start()
+	defer other.Stop()
+	if _, err = other.CallContext(ctx, server.Address(), "wrong", "echo", data); err == nil {
+		t.Error("wrong auth data accepted")
+	}
+}
+
+func TestLoopbackLeftPeer(t *testing.T) {
+	hub := xchg.NewLoopbackHub()
+	server := newLoopbackPeer(hub)
+	server.Callback = func(param *xchg.Param) ([]byte, error) { return param.Parameter, nil }
+	server.Start()
+	server.Stop()
+
+	client := newLoopbackPeer(hub)
+	client.Start()
+	defer client.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := client.CallContext(ctx, server.Address(), "", "echo", nil); err == nil {
+		t.Error("call of the stopped peer succeeded")
+	}
+}
@@ -0,0 +1,52 @@
+package peer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/router"
+	"github.com/xchgn/xchg/xchg"
+)
+
+func TestPeersWithOwnRouters(t *testing.T) {
+	serverOptions := xchg.DefaultPeerOptions()
+	serverOptions.RouterOptions = router.RouterOptions{HttpAddress: "127.0.0.1:0", TcpAddress: "127.0.0.1:0"}
+	serverOptions.LoopbackHub = nil
+	server := xchg.NewPeerWithOptions(serverOptions)
+	server.Callback = func(param *xchg.Param) ([]byte, error) { return param.Parameter, nil }
+	server.SetDirectUdp(false)
+	server.SetLanDiscovery(false)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	routers := server.Network().GetRouters()
+	if len(routers) != 1 {
+		t.Fatal("network does not follow the embedded router:", routers)
+	}
+	if routers[0].TcpAddress == "" {
+		t.Fatal("TCP address of the embedded router is not published")
+	}
+
+	// The client has no router and uses the one of the server
+	clientOptions := xchg.DefaultPeerOptions()
+	clientOptions.RouterEnabled = false
+	clientOptions.LoopbackHub = nil
+	clientOptions.Routers = routers
+	client := xchg.NewPeerWithOptions(clientOptions)
+	client.SetDirectUdp(false)
+	client.SetLanDiscovery(false)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := client.CallContext(ctx, server.Address(), "", "echo", []byte("ping"))
+	if err != nil || string(result) != "ping" {
+		t.Fatal("call failed:", err, string(result))
+	}
+}
@@ -0,0 +1,128 @@
+package peer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/router"
+	"github.com/xchgn/xchg/xchg"
+)
+
+func newUdpPeer(routerInfo *xchg.RouterInfo) *xchg.Peer {
+	options := xchg.DefaultPeerOptions()
+	options.RouterEnabled = false
+	options.LoopbackHub = nil
+	options.Routers = []*xchg.RouterInfo{routerInfo}
+	peer := xchg.NewPeerWithOptions(options)
+	peer.SetHttpOnly(true)
+	peer.SetLanDiscovery(false)
+	return peer
+}
+
+// startUdpRouter serves HTTP and the UDP endpoint requests on the loopback interface
+func startUdpRouter(t *testing.T) (routerInfo *xchg.RouterInfo, httpServer *router.HttpServer) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := router.NewRouter(router.RouterOptions{LongPollingTimeout: time.Second})
+	r.Start()
+	t.Cleanup(func() { r.Stop() })
+	httpServer = router.NewHttpServer()
+	go httpServer.Serve(r, listener)
+	t.Cleanup(func() { httpServer.Stop() })
+	udpServer := router.NewUdpServer()
+	go udpServer.Serve(r, udpConn)
+	t.Cleanup(func() { udpServer.Stop() })
+
+	routerInfo = &xchg.RouterInfo{NetAddress: listener.Addr().String(), UdpAddress: udpConn.LocalAddr().String()}
+	return
+}
+
+func waitUdpEndpoint(t *testing.T, peer *xchg.Peer) *net.UDPAddr {
+	deadline := time.Now().Add(10 * time.Second)
+	for peer.UdpEndpoint() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("no UDP endpoint")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return peer.UdpEndpoint()
+}
+
+func TestDirectUdp(t *testing.T) {
+	routerInfo, httpServer := startUdpRouter(t)
+	server := newUdpPeer(routerInfo)
+	server.Callback = func(param *xchg.Param) ([]byte, error) { return param.Parameter, nil }
+	server.Start()
+	defer server.Stop()
+	client := newUdpPeer(routerInfo)
+	client.Start()
+	defer client.Stop()
+
+	// The calls through the router exchange the endpoints and punch the holes
+	waitUdpEndpoint(t, client)
+	waitUdpEndpoint(t, server)
+	for i := 0; i < 10; i++ {
+		if _, err := client.CallContext(context.Background(), server.Address(), "", "echo", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Without the router the call goes only over UDP, the frame is sent in several datagrams
+	httpServer.Stop()
+	data := make([]byte, 40*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		result, err := client.CallContext(ctx, server.Address(), "", "echo", data)
+		cancel()
+		if err == nil {
+			if !bytes.Equal(result, data) {
+				t.Fatal("wrong result:", len(result))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("call over UDP failed:", err)
+		}
+	}
+}
+
+func TestUdpUnconfirmedSource(t *testing.T) {
+	routerInfo, _ := startUdpRouter(t)
+	server := newUdpPeer(routerInfo)
+	server.Start()
+	defer server.Stop()
+	endpoint := waitUdpEndpoint(t, server)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The sender has not offered its endpoint, the nonce must not be sent to the source of the datagram
+	srcAddress, _, _ := ed25519.GenerateKey(nil)
+	function := "/xchg-get-nonce"
+	data := append([]byte{byte(len(function))}, function...)
+	call := xchg.NewTransaction(xchg.FrameTypeCall, srcAddress, server.Address(), 1, 0, 0, len(data), data)
+	if _, err = conn.WriteToUDP(call.Marshal(), endpoint); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, _, err := conn.ReadFromUDP(make([]byte, 64*1024)); err == nil {
+		t.Fatal("answer to the unconfirmed endpoint:", n)
+	}
+}
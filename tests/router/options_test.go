@@ -0,0 +1,70 @@
+package router_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/xchgn/xchg/router"
+)
+
+func TestRouterOptionsBindSynchronously(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{HttpAddress: "127.0.0.1:0", UdpAddress: "127.0.0.1:0"})
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	if r.HttpAddr() == nil || r.UdpAddr() == nil || r.TcpAddr() != nil {
+		t.Fatal("unexpected addresses:", r.HttpAddr(), r.UdpAddr(), r.TcpAddr())
+	}
+
+	// The listener is ready when Start returns
+	response, err := http.Get("http://" + r.HttpAddr().String() + "/api/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	// The busy port is reported by Start
+	r2 := router.NewRouter(router.RouterOptions{HttpAddress: r.HttpAddr().String()})
+	if err = r2.Start(); err == nil {
+		r2.Stop()
+		t.Fatal("second router started on the same port")
+	}
+}
+
+func TestRouterConcurrentStop(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{HttpAddress: "127.0.0.1:0", UdpAddress: "127.0.0.1:0"})
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- r.Stop()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	stopped := 0
+	for err := range errs {
+		if err == nil {
+			stopped++
+		}
+	}
+	if stopped != 1 {
+		t.Fatal("router stopped", stopped, "times")
+	}
+
+	// The listener is closed
+	if response, err := http.Get("http://" + r.HttpAddr().String() + "/api/stat"); err == nil {
+		response.Body.Close()
+		t.Fatal("HTTP is served after Stop")
+	}
+}
@@ -0,0 +1,200 @@
+package router_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/router"
+)
+
+func makeAddress(b byte) []byte {
+	address := make([]byte, 32)
+	for i := range address {
+		address[i] = b
+	}
+	return address
+}
+
+func makeFrame(dest []byte) []byte {
+	frame := make([]byte, 128)
+	binary.LittleEndian.PutUint32(frame, uint32(len(frame)))
+	frame[4] = 0x10
+	copy(frame[64:], dest)
+	return frame
+}
+
+func makeReadRequest(address []byte) []byte {
+	request := make([]byte, 8+8+32)
+	binary.LittleEndian.PutUint64(request[8:], 1024*1024)
+	copy(request[16:], address)
+	return request
+}
+
+func makeSignedReadRequest(privateKey ed25519.PrivateKey, nonce []byte) []byte {
+	request := make([]byte, router.READ_REQUEST_SIZE)
+	copy(request, makeReadRequest(privateKey.Public().(ed25519.PublicKey)))
+	copy(request[48:], nonce)
+	copy(request[48+router.NONCE_SIZE:], ed25519.Sign(privateKey, request[:48+router.NONCE_SIZE]))
+	return request
+}
+
+func newKey() ed25519.PrivateKey {
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	return privateKey
+}
+
+func TestGetMessagesWait(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{})
+	privateKey := newKey()
+	nonce, _ := r.NextNonce("127.0.0.1:1000")
+
+	type result struct {
+		count int
+		dt    time.Time
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, count, err := r.GetMessagesWait(ctx, makeSignedReadRequest(privateKey, nonce[:]))
+		done <- result{count: count, dt: time.Now(), err: err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	r.Put(makeFrame(makeAddress(2)))
+
+	select {
+	case <-done:
+		t.Fatal("woken up by the message to another address")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dtPut := time.Now()
+	r.Put(makeFrame(privateKey.Public().(ed25519.PublicKey)))
+	res := <-done
+	if res.err != nil || res.count != 1 {
+		t.Error("wrong count of messages:", res.count, res.err)
+	}
+	if res.dt.Sub(dtPut) > 500*time.Millisecond {
+		t.Error("reader was not woken up:", res.dt.Sub(dtPut))
+	}
+}
+
+func TestGetMessagesWaitTimeout(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{})
+	privateKey := newKey()
+	nonce, _ := r.NextNonce("127.0.0.1:1000")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	response, count, err := r.GetMessagesWait(ctx, makeSignedReadRequest(privateKey, nonce[:]))
+	if err != nil || count != 0 || len(response) != router.READ_RESPONSE_HEADER_SIZE {
+		t.Error("wrong empty response:", len(response), count, err)
+	}
+
+	_, _, err = r.GetMessagesWait(ctx, make([]byte, 10))
+	if err == nil {
+		t.Error("short request is accepted")
+	}
+}
+
+func TestNonceRateLimit(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{NonceRateLimit: 3})
+	for i := 0; i < 3; i++ {
+		if _, err := r.NextNonce(fmt.Sprint("10.0.0.1:", 1000+i)); err != nil {
+			t.Fatal("nonce is not issued:", err)
+		}
+	}
+	if _, err := r.NextNonce("10.0.0.1:2000"); err == nil || err.Error() != router.ERR_ROUTER_TOO_MANY_REQUESTS {
+		t.Error("limit of the host is not applied:", err)
+	}
+	if _, err := r.NextNonce("10.0.0.2:1000"); err != nil {
+		t.Error("limit of one host is applied to another:", err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := r.NextNonce("10.0.0.1:2000"); err != nil {
+		t.Error("limit is not reset:", err)
+	}
+}
+
+func TestReadAccess(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{})
+	owner := newKey()
+	r.Put(makeFrame(owner.Public().(ed25519.PublicKey)))
+	ctx := context.Background()
+
+	// Signed by another key
+	nonce, _ := r.NextNonce("127.0.0.1:1000")
+	request := makeSignedReadRequest(newKey(), nonce[:])
+	copy(request[16:], owner.Public().(ed25519.PublicKey))
+	if _, _, err := r.GetMessagesWait(ctx, request); err == nil || err.Error() != router.ERR_ROUTER_ACCESS_DENIED {
+		t.Error("foreign mailbox is readable:", err)
+	}
+
+	// Nonce was not issued by the router
+	if _, _, err := r.GetMessagesWait(ctx, makeSignedReadRequest(owner, make([]byte, router.NONCE_SIZE))); err == nil {
+		t.Error("unknown nonce is accepted")
+	}
+
+	// The owner
+	request = makeSignedReadRequest(owner, nonce[:])
+	response, count, err := r.GetMessagesWait(ctx, request)
+	if err != nil || count != 1 {
+		t.Fatal("owner can not read:", count, err)
+	}
+
+	// Replay
+	if _, _, err = r.GetMessagesWait(ctx, request); err == nil {
+		t.Error("nonce is accepted twice")
+	}
+
+	// The nonce of the response is valid for the next request
+	nextRequest := makeSignedReadRequest(owner, response[8:router.READ_RESPONSE_HEADER_SIZE])
+	binary.LittleEndian.PutUint64(nextRequest, binary.LittleEndian.Uint64(response))
+	copy(nextRequest[48+router.NONCE_SIZE:], ed25519.Sign(owner, nextRequest[:48+router.NONCE_SIZE]))
+	ctxTimeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, count, err = r.GetMessagesWait(ctxTimeout, nextRequest); err != nil || count != 0 {
+		t.Error("next nonce is not accepted:", count, err)
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{})
+
+	addressesCount := 16
+	messagesCount := 200
+
+	var wg sync.WaitGroup
+	for a := 0; a < addressesCount; a++ {
+		for w := 0; w < 2; w++ {
+			wg.Add(1)
+			go func(address []byte) {
+				defer wg.Done()
+				for i := 0; i < messagesCount; i++ {
+					r.Put(makeFrame(address))
+				}
+			}(makeAddress(byte(a)))
+		}
+	}
+	wg.Wait()
+
+	for a := 0; a < addressesCount; a++ {
+		response, count, err := r.GetMessages(makeReadRequest(makeAddress(byte(a))))
+		if err != nil || count != 2*messagesCount || len(response) != 8+count*128 {
+			t.Error("address", a, "received", count, err)
+		}
+	}
+
+	stat := r.Statistics()
+	if stat.FramesIn != addressesCount*2*messagesCount || stat.FramesOut != stat.FramesIn {
+		t.Error("wrong statistics:", stat.FramesIn, stat.FramesOut)
+	}
+}
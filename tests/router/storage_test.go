@@ -0,0 +1,68 @@
+package router_test
+
+import (
+	"testing"
+
+	"github.com/xchgn/xchg/router"
+)
+
+func putMessages(s *router.Storage, fromId uint64, toId uint64, size int) {
+	for id := fromId; id <= toId; id++ {
+		frame := make([]byte, size)
+		frame[0] = byte(id)
+		s.Put(id, frame)
+	}
+}
+
+func TestStorageGetMessage(t *testing.T) {
+	s := router.NewStorageWithLimits(100, 1024*1024)
+	putMessages(s, 1, 50, 10)
+
+	testTable := []struct {
+		afterId uint64
+		maxSize uint64
+		count   int
+		lastId  uint64
+	}{
+		{afterId: 0, maxSize: 1024, count: 50, lastId: 50},
+		{afterId: 20, maxSize: 1024, count: 30, lastId: 50},
+		{afterId: 50, maxSize: 1024, count: 0, lastId: 50},
+		{afterId: 20, maxSize: 55, count: 5, lastId: 25},
+		{afterId: 20, maxSize: 1, count: 1, lastId: 21},
+		// The reader is ahead of the storage - everything is sent again
+		{afterId: 1000, maxSize: 1024, count: 50, lastId: 50},
+	}
+
+	for _, testCase := range testTable {
+		data, lastId, count := s.GetMessage(testCase.afterId, testCase.maxSize)
+		if count != testCase.count || lastId != testCase.lastId || len(data) != count*10 {
+			t.Error("afterId", testCase.afterId, "maxSize", testCase.maxSize, "received", count, lastId, len(data))
+			continue
+		}
+		if count > 0 && data[0] != byte(lastId-uint64(count)+1) {
+			t.Error("wrong first message", data[0])
+		}
+	}
+}
+
+func TestStorageLimits(t *testing.T) {
+	s := router.NewStorageWithLimits(10, 1024*1024)
+	putMessages(s, 1, 25, 10)
+	if s.MessagesCount() != 10 || s.BytesCount() != 100 {
+		t.Fatal("count limit is not applied:", s.MessagesCount(), s.BytesCount())
+	}
+	data, lastId, count := s.GetMessage(0, 1024)
+	if count != 10 || lastId != 25 || data[0] != 16 {
+		t.Error("wrong messages after wrap:", count, lastId, data[0])
+	}
+
+	s = router.NewStorageWithLimits(1000, 100)
+	putMessages(s, 1, 20, 30)
+	if s.MessagesCount() != 3 || s.BytesCount() != 90 {
+		t.Fatal("bytes limit is not applied:", s.MessagesCount(), s.BytesCount())
+	}
+	_, lastId, count = s.GetMessage(17, 1024)
+	if count != 3 || lastId != 20 {
+		t.Error("wrong messages after eviction:", count, lastId)
+	}
+}
@@ -0,0 +1,103 @@
+package router_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/router"
+)
+
+func startTcpServer(t *testing.T, r *router.Router) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := router.NewTcpServer()
+	go s.Serve(r, listener)
+	t.Cleanup(func() { s.Stop() })
+	return listener.Addr().String()
+}
+
+func TestTcpStream(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{})
+	addr := startTcpServer(t, r)
+	privateKey := newKey()
+	address := privateKey.Public().(ed25519.PublicKey)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	frame, err := router.ReadStreamFrame(reader)
+	if err != nil || frame[4] != router.TCP_FRAME_NONCE {
+		t.Fatal("no nonce", err)
+	}
+	_, err = conn.Write(router.MakeStreamFrame(router.TCP_FRAME_READ, makeSignedReadRequest(privateKey, frame[router.TCP_FRAME_HEADER_SIZE:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keepalive
+	conn.Write(router.MakeStreamFrame(router.TCP_FRAME_PING, nil))
+	frame, err = router.ReadStreamFrame(reader)
+	if err != nil || frame[4] != router.TCP_FRAME_PONG || len(frame) != router.TCP_FRAME_HEADER_SIZE {
+		t.Fatal("no pong", err)
+	}
+
+	// Frames from the router
+	callFrame := makeFrame(address)
+	r.Put(callFrame)
+	frame, err = router.ReadStreamFrame(reader)
+	if err != nil || frame[4] != router.TCP_FRAME_MAILBOX {
+		t.Fatal("no mailbox frame", err)
+	}
+	if binary.LittleEndian.Uint64(frame[router.TCP_FRAME_HEADER_SIZE:]) == 0 || !bytes.Equal(frame[router.TCP_FRAME_HEADER_SIZE+8:], callFrame) {
+		t.Fatal("wrong mailbox frame")
+	}
+
+	// Frames to the router
+	other := makeAddress(9)
+	conn.Write(makeFrame(other))
+	dtBegin := time.Now()
+	for {
+		_, count, _ := r.GetMessages(makeReadRequest(other))
+		if count == 1 {
+			break
+		}
+		if time.Since(dtBegin) > 2*time.Second {
+			t.Fatal("frame is not stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTcpAccessDenied(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{})
+	addr := startTcpServer(t, r)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	if _, err = router.ReadStreamFrame(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	// The nonce is not issued by the router
+	conn.Write(router.MakeStreamFrame(router.TCP_FRAME_READ, makeSignedReadRequest(newKey(), make([]byte, router.NONCE_SIZE))))
+	if _, err = router.ReadStreamFrame(reader); err == nil {
+		t.Fatal("connection is not closed")
+	}
+}
@@ -0,0 +1,44 @@
+package router_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/router"
+)
+
+func TestUdpEndpoint(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := router.NewUdpServer()
+	go s.Serve(router.NewRouter(router.RouterOptions{}), serverConn)
+	defer s.Stop()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Wrong frames are ignored
+	conn.WriteToUDP([]byte{1, 2, 3}, serverConn.LocalAddr().(*net.UDPAddr))
+	conn.WriteToUDP(router.MakeStreamFrame(router.UDP_FRAME_ENDPOINT_REQUEST, nil), serverConn.LocalAddr().(*net.UDPAddr))
+
+	buffer := make([]byte, 1024)
+	n, _, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := router.ParseUdpEndpointResponse(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	if !endpoint.IP.Equal(local.IP) || endpoint.Port != local.Port {
+		t.Fatal("wrong endpoint", endpoint, local)
+	}
+}
@@ -0,0 +1,101 @@
+package router_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xchgn/xchg/router"
+)
+
+func startWSServer(t *testing.T, r *router.Router) string {
+	s := router.NewHttpServer()
+	s.SetRouter(r)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws"
+}
+
+func dialWS(t *testing.T, url string, privateKey ed25519.PrivateKey) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, nonce, err := conn.ReadMessage()
+	if err != nil || len(nonce) != router.NONCE_SIZE {
+		t.Fatal("no nonce", err)
+	}
+	if privateKey != nil {
+		err = conn.WriteMessage(websocket.BinaryMessage, makeSignedReadRequest(privateKey, nonce))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn
+}
+
+func TestWSPushAndWrite(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{})
+	url := startWSServer(t, r)
+	privateKey := newKey()
+	address := privateKey.Public().(ed25519.PublicKey)
+	conn := dialWS(t, url, privateKey)
+
+	// Frames from the router
+	frame := makeFrame(address)
+	time.Sleep(50 * time.Millisecond)
+	r.Put(frame)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(message) != 8+len(frame) || binary.LittleEndian.Uint64(message) == 0 || !bytes.Equal(message[8:], frame) {
+		t.Fatal("wrong message", len(message))
+	}
+
+	// Frames to the router
+	other := makeAddress(7)
+	if err = conn.WriteMessage(websocket.BinaryMessage, append(makeFrame(other), makeFrame(other)...)); err != nil {
+		t.Fatal(err)
+	}
+	dtBegin := time.Now()
+	for {
+		_, count, _ := r.GetMessages(makeReadRequest(other))
+		if count == 2 {
+			break
+		}
+		if time.Since(dtBegin) > 2*time.Second {
+			t.Fatal("frames are not stored", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWSAccessDenied(t *testing.T) {
+	r := router.NewRouter(router.RouterOptions{})
+	url := startWSServer(t, r)
+	conn := dialWS(t, url, nil)
+
+	// Signed by another key
+	request := makeSignedReadRequest(newKey(), make([]byte, router.NONCE_SIZE))
+	copy(request[16:], makeAddress(3))
+	if err := conn.WriteMessage(websocket.BinaryMessage, request); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatal("connection is not closed:", err)
+	}
+}
@@ -0,0 +1,60 @@
+package rpc_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xchgn/xchg/xchg"
+)
+
+type sumRequest struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+type sumResponse struct {
+	Sum int `json:"sum"`
+}
+
+func sum(param *xchg.Param, req sumRequest) (sumResponse, error) {
+	return sumResponse{Sum: req.A + req.B}, nil
+}
+
+func withHeader(codecId byte, payload string) []byte {
+	return append([]byte{0xCD, codecId}, []byte(payload)...)
+}
+
+func TestTypedHandler(t *testing.T) {
+	mux := xchg.NewServeMux()
+	xchg.HandleTyped(mux, "sum", sum)
+
+	response, err := mux.Serve(&xchg.Param{Function: "sum", Parameter: withHeader(xchg.CodecIdJson, `{"a":2,"b":3}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != string(withHeader(xchg.CodecIdJson, `{"sum":5}`)) {
+		t.Error("wrong response:", string(response))
+	}
+}
+
+func TestTypedHandlerErrors(t *testing.T) {
+	mux := xchg.NewServeMux()
+	xchg.HandleTypedWithOptions(mux, "sum", sum, xchg.RouteOptions{Codec: &xchg.GobCodec{}})
+
+	testTable := []struct {
+		parameter []byte
+		err       string
+	}{
+		{parameter: []byte(`{"a":2,"b":3}`), err: xchg.ERR_XCHG_CODEC_NO_HEADER},
+		{parameter: withHeader(0x7F, `{}`), err: xchg.ERR_XCHG_CODEC_UNKNOWN},
+		{parameter: withHeader(xchg.CodecIdJson, `{"a":2,"b":3}`), err: xchg.ERR_XCHG_CODEC_MISMATCH},
+		{parameter: withHeader(xchg.CodecIdGob, `garbage`), err: xchg.ERR_XCHG_CODEC_UNMARSHAL},
+	}
+
+	for _, testCase := range testTable {
+		_, err := mux.Serve(&xchg.Param{Function: "sum", Parameter: testCase.parameter})
+		if err == nil || !strings.HasPrefix(err.Error(), testCase.err) {
+			t.Error("expected", testCase.err, "received", err)
+		}
+	}
+}
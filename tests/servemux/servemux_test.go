@@ -0,0 +1,94 @@
+package servemux_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+)
+
+func handlerReturning(value string) xchg.CallbackFunc {
+	return func(param *xchg.Param) ([]byte, error) {
+		return []byte(value), nil
+	}
+}
+
+func TestServeMuxMatch(t *testing.T) {
+	mux := xchg.NewServeMux()
+	mux.Handle("get_name", handlerReturning("exact"))
+	mux.Handle("files.*", handlerReturning("files"))
+	mux.Handle("files.images.*", handlerReturning("images"))
+
+	testTable := []struct {
+		function string
+		response string
+	}{
+		{function: "get_name", response: "exact"},
+		{function: "files.list", response: "files"},
+		{function: "files.images.list", response: "images"},
+	}
+
+	for _, testCase := range testTable {
+		response, err := mux.Serve(&xchg.Param{Function: testCase.function})
+		if err != nil {
+			t.Error(testCase.function, "error:", err)
+		}
+		if string(response) != testCase.response {
+			t.Error(testCase.function, "wrong response:", string(response))
+		}
+	}
+}
+
+func TestServeMuxNotFound(t *testing.T) {
+	mux := xchg.NewServeMux()
+	_, err := mux.Serve(&xchg.Param{Function: "unknown"})
+	var notFoundErr *xchg.FunctionNotFoundError
+	if !errors.As(err, &notFoundErr) || notFoundErr.Function != "unknown" {
+		t.Error("wrong error:", err)
+	}
+	if !xchg.IsFunctionNotFound(errors.New("{ERR_XCHG_CL_CONN_FROM_PEER}:" + err.Error())) {
+		t.Error("not found error is not recognized on the client side")
+	}
+
+	mux.HandleNotFound(handlerReturning("fallback"))
+	response, err := mux.Serve(&xchg.Param{Function: "unknown"})
+	if err != nil || string(response) != "fallback" {
+		t.Error("fallback is not called:", err)
+	}
+}
+
+func TestServeMuxOptions(t *testing.T) {
+	mux := xchg.NewServeMux()
+	mux.HandleWithOptions("private", handlerReturning("ok"), xchg.RouteOptions{AuthRequired: true})
+	mux.HandleWithOptions("slow", func(param *xchg.Param) ([]byte, error) {
+		<-param.Context.Done()
+		return nil, nil
+	}, xchg.RouteOptions{Timeout: 50 * time.Millisecond})
+
+	if _, err := mux.Serve(&xchg.Param{Function: "private"}); err == nil {
+		t.Error("anonymous call is accepted")
+	}
+	if _, err := mux.Serve(&xchg.Param{Function: "private", AuthData: []byte("user")}); err != nil {
+		t.Error("authorized call is rejected:", err)
+	}
+
+	_, err := mux.Serve(&xchg.Param{Function: "slow", Context: context.Background()})
+	if err == nil || err.Error() != xchg.ERR_XCHG_SRV_FUNCTION_TIMEOUT {
+		t.Error("wrong timeout error:", err)
+	}
+}
+
+func TestServeMuxHandler(t *testing.T) {
+	mux := xchg.NewServeMux()
+	mux.Handle("get_name", handlerReturning("mux"))
+
+	handlers := []xchg.Handler{mux, xchg.CallbackFunc(handlerReturning("mux"))}
+	for _, handler := range handlers {
+		response, err := handler.Serve(&xchg.Param{Function: "get_name"})
+		if err != nil || string(response) != "mux" {
+			t.Error("wrong response:", string(response), err)
+		}
+	}
+}
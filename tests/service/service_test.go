@@ -0,0 +1,77 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/xchgn/xchg/xchg"
+)
+
+type Args struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+type Reply struct {
+	Result int `json:"result"`
+}
+
+type Arith struct {
+}
+
+func (c *Arith) Add(ctx context.Context, args *Args) (*Reply, error) {
+	if xchg.ParamFromContext(ctx) == nil {
+		return nil, errors.New("no param")
+	}
+	return &Reply{Result: args.A + args.B}, nil
+}
+
+func (c *Arith) Div(ctx context.Context, args *Args) (*Reply, error) {
+	if args.B == 0 {
+		return nil, errors.New("divide by zero")
+	}
+	return &Reply{Result: args.A / args.B}, nil
+}
+
+// Not exposed: wrong signature
+func (c *Arith) Reset() {
+}
+
+func withHeader(payload string) []byte {
+	return append([]byte{0xCD, xchg.CodecIdJson}, []byte(payload)...)
+}
+
+func TestRegisterService(t *testing.T) {
+	mux := xchg.NewServeMux()
+	if err := mux.RegisterService(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := mux.Serve(&xchg.Param{Function: "Arith.Add", Parameter: withHeader(`{"a":2,"b":3}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != string(withHeader(`{"result":5}`)) {
+		t.Error("wrong response:", string(response))
+	}
+
+	_, err = mux.Serve(&xchg.Param{Function: "Arith.Div", Parameter: withHeader(`{"a":2,"b":0}`)})
+	if err == nil || err.Error() != "divide by zero" {
+		t.Error("wrong error:", err)
+	}
+
+	_, err = mux.Serve(&xchg.Param{Function: "Arith.Reset", Parameter: withHeader(`{}`)})
+	if !xchg.IsFunctionNotFound(err) {
+		t.Error("wrong error:", err)
+	}
+}
+
+func TestRegisterServiceWithoutMethods(t *testing.T) {
+	type Empty struct{}
+	err := xchg.NewServeMux().RegisterService(&Empty{})
+	if err == nil || !strings.HasPrefix(err.Error(), xchg.ERR_XCHG_SRV_SERVICE_NO_METHODS) {
+		t.Error("wrong error:", err)
+	}
+}
@@ -0,0 +1,198 @@
+package stream_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+	"github.com/xchgn/xchg/xchgtest"
+)
+
+func newNetwork() (network *xchgtest.Network, server *xchg.Peer, client *xchg.Peer) {
+	network = xchgtest.NewNetwork(xchgtest.Options{Seed: 1})
+	network.AddRouter()
+	server = network.AddPeer(nil, nil)
+	client = network.AddPeer(nil, nil)
+
+	server.HandleStream("echo", func(param *xchg.StreamParam) error {
+		_, err := io.Copy(param.Response, param.Body)
+		return err
+	})
+	server.HandleStream("download", func(param *xchg.StreamParam) error {
+		_, err := io.Copy(param.Response, io.LimitReader(rand.New(rand.NewSource(2)), 3*1024*1024))
+		return err
+	})
+	server.HandleStream("fail", func(param *xchg.StreamParam) error {
+		param.Response.Write([]byte("partial"))
+		return errors.New("disk is full")
+	})
+	return
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestStreamEcho(t *testing.T) {
+	network, server, client := newNetwork()
+	defer network.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Larger than one transaction
+	data := randomData(3 * xchg.XchgMaxTransactionSize)
+	response, err := client.CallStream(ctx, server.Address(), "", "echo", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Close()
+
+	result, err := io.ReadAll(response)
+	if err != nil || !bytes.Equal(result, data) {
+		t.Fatal("echo failed:", err, len(result))
+	}
+}
+
+func TestStreamDownload(t *testing.T) {
+	network, server, client := newNetwork()
+	defer network.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	response, err := client.CallStream(ctx, server.Address(), "", "download", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Close()
+
+	result, err := io.ReadAll(response)
+	expected, _ := io.ReadAll(io.LimitReader(rand.New(rand.NewSource(2)), 3*1024*1024))
+	if err != nil || !bytes.Equal(result, expected) {
+		t.Fatal("download failed:", err, len(result))
+	}
+}
+
+func TestStreamHandlerError(t *testing.T) {
+	network, server, client := newNetwork()
+	defer network.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	response, err := client.CallStream(ctx, server.Address(), "", "fail", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Close()
+
+	result, err := io.ReadAll(response)
+	if string(result) != "partial" || err == nil || !strings.Contains(err.Error(), "disk is full") {
+		t.Fatal("wrong result:", string(result), err)
+	}
+}
+
+func TestStreamNotFound(t *testing.T) {
+	network, server, client := newNetwork()
+	defer network.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := client.CallStream(ctx, server.Address(), "", "missing", nil)
+	if !xchg.IsFunctionNotFound(err) {
+		t.Fatal("wrong error:", err)
+	}
+}
+
+func TestStreamMiddleware(t *testing.T) {
+	network, server, client := newNetwork()
+	defer network.Close()
+
+	// The session is opened, the functions are denied
+	server.Use(func(next xchg.CallbackFunc) xchg.CallbackFunc {
+		return func(param *xchg.Param) ([]byte, error) {
+			if param.Function != "" {
+				return nil, errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+			}
+			return next(param)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := client.CallStream(ctx, server.Address(), "", "echo", bytes.NewReader([]byte("data")))
+	if err == nil || !strings.Contains(err.Error(), xchg.ERR_XCHG_ACCESS_DENIED) {
+		t.Fatal("stream is not denied:", err)
+	}
+	if _, err = client.Describe(ctx, server.Address(), ""); err == nil || !strings.Contains(err.Error(), xchg.ERR_XCHG_ACCESS_DENIED) {
+		t.Fatal("describe is not denied:", err)
+	}
+}
+
+func TestStreamLoss(t *testing.T) {
+	network, server, client := newNetwork()
+	defer network.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	network.SetFaults(xchgtest.Faults{Loss: 0.05})
+	data := randomData(2 * 1024 * 1024)
+	response, err := client.CallStream(ctx, server.Address(), "", "echo", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Close()
+
+	result, err := io.ReadAll(response)
+	if err != nil || !bytes.Equal(result, data) {
+		t.Fatal("echo failed:", err, len(result))
+	}
+	if network.Stat().Lost == 0 {
+		t.Error("frames are not lost:", network.Stat())
+	}
+}
+
+func TestStreamReadOutOfRange(t *testing.T) {
+	network, server, client := newNetwork()
+	defer network.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	streamId, err := client.CallContext(ctx, server.Address(), "", xchg.FunctionStreamOpen, []byte("download"))
+	if err != nil || len(streamId) != 8 {
+		t.Fatal("open failed:", err)
+	}
+
+	param := make([]byte, 16)
+	copy(param, streamId)
+	binary.LittleEndian.PutUint64(param[8:], 1<<62)
+	_, err = client.CallContext(ctx, server.Address(), "", xchg.FunctionStreamRead, param)
+	if err == nil || !strings.Contains(err.Error(), xchg.ERR_XCHG_SRV_STREAM_WRONG_PARAM) {
+		t.Fatal("wrong error:", err)
+	}
+
+	// The peer and the other streams are alive
+	response, err := client.CallStream(ctx, server.Address(), "", "echo", bytes.NewReader([]byte("alive")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Close()
+	result, err := io.ReadAll(response)
+	if err != nil || string(result) != "alive" {
+		t.Fatal("echo failed:", err, string(result))
+	}
+}
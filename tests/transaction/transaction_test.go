@@ -0,0 +1,56 @@
+package transaction_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/xchgn/xchg/xchg"
+)
+
+func makeBlock(data []byte, offset int, size int) *xchg.Transaction {
+	return xchg.NewTransaction(xchg.FrameTypeResponse, nil, nil, 1, 0, offset, len(data), data[offset:offset+size])
+}
+
+func TestAppendReceivedData(t *testing.T) {
+	data := make([]byte, 3*xchg.XchgMaxFrameSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	tr := xchg.NewTransaction(xchg.FrameTypeResponse, nil, nil, 1, 0, 0, 0, nil)
+	tr.AppendReceivedData(makeBlock(data, 3*xchg.XchgMaxFrameSize, 100))
+	tr.AppendReceivedData(makeBlock(data, xchg.XchgMaxFrameSize, xchg.XchgMaxFrameSize))
+
+	// Duplicates are ignored, overlapping blocks are merged
+	tr.AppendReceivedData(makeBlock(data, xchg.XchgMaxFrameSize, xchg.XchgMaxFrameSize))
+	tr.AppendReceivedData(makeBlock(data, 10, xchg.XchgMaxFrameSize))
+	if tr.Complete {
+		t.Fatal("complete without the blocks")
+	}
+
+	ranges := tr.MissingRanges()
+	if len(ranges) != 2 || ranges[0] != [2]uint32{0, 10} || ranges[1] != [2]uint32{2 * xchg.XchgMaxFrameSize, xchg.XchgMaxFrameSize} {
+		t.Fatal("wrong missing ranges:", ranges)
+	}
+
+	// The UDP datagrams are smaller than a frame
+	tr.AppendReceivedData(makeBlock(data, 0, 10))
+	for offset := 2 * xchg.XchgMaxFrameSize; offset < 3*xchg.XchgMaxFrameSize; offset += xchg.XchgUdpMaxDataSize {
+		if tr.Complete {
+			t.Fatal("complete without the blocks")
+		}
+		tr.AppendReceivedData(makeBlock(data, offset, xchg.XchgUdpMaxDataSize))
+	}
+	if !tr.Complete || !bytes.Equal(tr.Result, data) {
+		t.Fatal("wrong result:", tr.Complete, len(tr.Result))
+	}
+}
+
+func TestAppendReceivedDataSingleFrame(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("single")} {
+		tr := xchg.NewTransaction(xchg.FrameTypeResponse, nil, nil, 1, 0, 0, 0, nil)
+		tr.AppendReceivedData(makeBlock(data, 0, len(data)))
+		if !tr.Complete || !bytes.Equal(tr.Result, data) {
+			t.Fatal("single frame is not complete:", len(data))
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package transport_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+	"github.com/xchgn/xchg/xchgtest"
+)
+
+type fakeTransport struct {
+	xchg.TransportFailures
+	id      string
+	sendErr error
+	sent    []*xchg.Transaction
+	udp     *net.UDPAddr
+}
+
+func (c *fakeTransport) Id() string {
+	return c.id
+}
+
+func (c *fakeTransport) Check(frame20 *xchg.Transaction, network *xchg.Network, remotePublicKeyExists bool) error {
+	if c.Failed() {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (c *fakeTransport) DeclareError(sentViaTransportMap map[string]struct{}) {
+	if _, ok := sentViaTransportMap[c.id]; ok {
+		c.DeclareFailure()
+	}
+}
+
+func (c *fakeTransport) Send(network *xchg.Network, tr *xchg.Transaction) error {
+	if c.sendErr != nil {
+		return c.sendErr
+	}
+	c.sent = append(c.sent, tr)
+	return nil
+}
+
+func (c *fakeTransport) SetRemoteUDPAddress(udpAddress *net.UDPAddr) {
+	c.udp = udpAddress
+}
+
+func newRemotePeer() *xchg.RemotePeer {
+	remoteAddress, _, _ := ed25519.GenerateKey(nil)
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	return xchg.NewRemotePeer(remoteAddress, "", privateKey)
+}
+
+func newTransaction(remotePeer *xchg.RemotePeer) *xchg.Transaction {
+	return xchg.NewTransaction(xchg.XchgFrameCallRequest, remotePeer.RemoteAddress(), remotePeer.RemoteAddress(), 1, 1, 0, 0, nil)
+}
+
+func TestTransportOrder(t *testing.T) {
+	remotePeer := newRemotePeer()
+	direct := &fakeTransport{id: "direct"}
+	lan := &fakeTransport{id: "lan"}
+	remotePeer.AddTransport(direct)
+	remotePeer.AddTransport(lan)
+	remotePeer.AddTransport(&fakeTransport{id: "lan"})
+
+	transports := remotePeer.Transports()
+	if len(transports) != 3 || transports[0].Id() != "lan" || transports[1].Id() != "direct" || transports[2].Id() != "router" {
+		t.Fatal("wrong order")
+	}
+
+	udpAddress := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	remotePeer.SetRemoteUDPAddress(udpAddress)
+	if direct.udp != udpAddress {
+		t.Fatal("udp address is not passed")
+	}
+}
+
+func TestTransportFailover(t *testing.T) {
+	remotePeer := newRemotePeer()
+	network := xchg.NewNetwork()
+	secondary := &fakeTransport{id: "secondary"}
+	primary := &fakeTransport{id: "primary", sendErr: errors.New("unreachable")}
+	remotePeer.AddTransport(secondary)
+	remotePeer.AddTransport(primary)
+
+	// Send error - the next transport
+	if err := remotePeer.Send(network, newTransaction(remotePeer)); err != nil {
+		t.Fatal(err)
+	}
+	if len(secondary.sent) != 1 {
+		t.Fatal("not sent via the secondary transport")
+	}
+
+	// No response - the transport is skipped
+	primary.sendErr = nil
+	remotePeer.Send(network, newTransaction(remotePeer))
+	if len(primary.sent) != 1 {
+		t.Fatal("not sent via the primary transport")
+	}
+	primary.DeclareError(map[string]struct{}{"primary": {}})
+	secondary.DeclareError(map[string]struct{}{"primary": {}})
+	remotePeer.Send(network, newTransaction(remotePeer))
+	if len(primary.sent) != 1 || len(secondary.sent) != 2 {
+		t.Fatal("failed transport is used")
+	}
+}
+
+// deadTransport is never usable, the calls go through the routers
+type deadTransport struct {
+	fakeTransport
+}
+
+func (c *deadTransport) Check(frame20 *xchg.Transaction, network *xchg.Network, remotePublicKeyExists bool) error {
+	return errors.New("dead")
+}
+
+func TestTransportFactoryCallsPeer(t *testing.T) {
+	network := xchgtest.NewNetwork(xchgtest.Options{Seed: 1})
+	defer network.Close()
+	network.AddRouter()
+	server := network.AddPeer(nil, func(param *xchg.Param) ([]byte, error) {
+		return param.Parameter, nil
+	})
+	client := network.AddPeer(nil, nil)
+
+	var factoryNetwork *xchg.Network
+	client.RegisterTransport(func(remotePeer *xchg.RemotePeer) xchg.RemotePeerTransport {
+		// Takes the lock of the local peer
+		factoryNetwork = remotePeer.LocalPeer().Network()
+		return &deadTransport{fakeTransport{id: "dead"}}
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := client.CallContext(ctx, server.Address(), "", "echo", []byte("ping"))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock in the transport factory")
+	}
+	if factoryNetwork == nil {
+		t.Fatal("factory is not called")
+	}
+}
@@ -0,0 +1,52 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/xchgn/xchg/xchg"
+)
+
+func TestSnakeCounter(t *testing.T) {
+	c := xchg.NewSnakeCounter(100, 0)
+
+	if c.TestAndDeclare(0) == nil {
+		t.Fatal("init value accepted twice")
+	}
+	if c.TestAndDeclare(5) != nil || c.LastProcessed() != 5 {
+		t.Fatal("next counter rejected")
+	}
+	// Skipped counters are accepted once
+	for _, counter := range []int{3, 1, 4, 2} {
+		if c.TestAndDeclare(counter) != nil {
+			t.Fatal("skipped counter rejected:", counter)
+		}
+		if c.TestAndDeclare(counter) == nil {
+			t.Fatal("counter accepted twice:", counter)
+		}
+	}
+
+	// The jump over the window forgets the old counters
+	if c.TestAndDeclare(1000) != nil {
+		t.Fatal("jump rejected")
+	}
+	if c.TestAndDeclare(5) == nil {
+		t.Fatal("counter out of the window accepted")
+	}
+	if c.TestAndDeclare(901) != nil || c.TestAndDeclare(901) == nil {
+		t.Fatal("the oldest counter of the window")
+	}
+	if c.TestAndDeclare(900) == nil {
+		t.Fatal("counter out of the window accepted")
+	}
+	if c.TestAndDeclare(999) != nil || c.TestAndDeclare(1000) == nil {
+		t.Fatal("window after the jump")
+	}
+}
+
+func BenchmarkSnakeCounter(b *testing.B) {
+	c := xchg.NewSnakeCounter(xchg.XchgSessionCounterWindow, 0)
+	b.ReportAllocs()
+	for i := 1; i <= b.N; i++ {
+		c.TestAndDeclare(i)
+	}
+}
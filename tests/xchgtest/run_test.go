@@ -0,0 +1,70 @@
+//go:build go1.25
+
+package xchgtest_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/xchgn/xchg/xchgtest"
+)
+
+type runResult struct {
+	failed  int
+	elapsed time.Duration
+	stat    xchgtest.Stat
+}
+
+// lossyRun makes the multi-frame calls through the faulty network, the lost frames fail some of them
+func lossyRun(t *testing.T, seed int64) (result runResult) {
+	xchgtest.Run(t, xchgtest.Options{Seed: seed}, func(t *testing.T, network *xchgtest.Network) {
+		network.AddRouter()
+		network.AddRouter()
+		server := network.AddPeer(nil, echo)
+		client := network.AddPeer(nil, nil)
+		if _, err := call(client, server, "", []byte("1"), 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		network.SetFaults(xchgtest.Faults{
+			Latency:     time.Millisecond,
+			Jitter:      5 * time.Millisecond,
+			Loss:        0.2,
+			Duplication: 0.2,
+			Reordering:  0.3,
+		})
+		data := make([]byte, 500*1024)
+		rand.New(rand.NewSource(1)).Read(data)
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			response, err := call(client, server, "", data, 30*time.Second)
+			if err != nil || !bytes.Equal(response, data) {
+				result.failed++
+			}
+		}
+		result.elapsed = time.Since(start)
+
+		// The acknowledgements are sent in the background
+		synctest.Wait()
+		result.stat = network.Stat()
+	})
+	return
+}
+
+func TestRunReproducible(t *testing.T) {
+	first := lossyRun(t, 1)
+	if first.stat.Lost == 0 || first.stat.Duplicated == 0 || first.stat.Reordered == 0 {
+		t.Fatal("faults are not applied:", first.stat)
+	}
+	for i := 0; i < 3; i++ {
+		if result := lossyRun(t, 1); result != first {
+			t.Fatal("run differs with the same seed:", result, first)
+		}
+	}
+	if result := lossyRun(t, 2); result == first {
+		t.Fatal("run does not depend on the seed:", result)
+	}
+}
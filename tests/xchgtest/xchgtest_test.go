@@ -0,0 +1,216 @@
+package xchgtest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xchgn/xchg/xchg"
+	"github.com/xchgn/xchg/xchgtest"
+)
+
+func newNetwork(routers int) *xchgtest.Network {
+	network := xchgtest.NewNetwork(xchgtest.Options{Seed: 1})
+	for i := 0; i < routers; i++ {
+		network.AddRouter()
+	}
+	return network
+}
+
+func echo(param *xchg.Param) ([]byte, error) {
+	return param.Parameter, nil
+}
+
+func call(client *xchg.Peer, server *xchg.Peer, authData string, data []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return client.CallContext(ctx, server.Address(), authData, "echo", data)
+}
+
+func TestMultiFrameCall(t *testing.T) {
+	network := newNetwork(2)
+	defer network.Close()
+	server := network.AddPeer(nil, echo)
+	client := network.AddPeer(nil, nil)
+
+	data := bytes.Repeat([]byte("0123456789"), 100*1024)
+	result, err := call(client, server, "", data, 5*time.Second)
+	if err != nil || !bytes.Equal(result, data) {
+		t.Fatal("call failed:", err, len(result))
+	}
+}
+
+func TestAuth(t *testing.T) {
+	network := newNetwork(1)
+	defer network.Close()
+
+	mux := xchg.NewServeMux()
+	mux.Handle("echo", echo)
+	mux.HandleAuth(func(param *xchg.Param) ([]byte, error) {
+		if string(param.AuthData) != "secret" {
+			return nil, errors.New(xchg.ERR_XCHG_ACCESS_DENIED)
+		}
+		return nil, nil
+	})
+	server := network.AddPeer(nil, mux.Serve)
+
+	if _, err := call(network.AddPeer(nil, nil), server, "secret", []byte("1"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(network.AddPeer(nil, nil), server, "wrong", []byte("1"), 5*time.Second); err == nil {
+		t.Error("wrong auth data is not rejected")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	network := newNetwork(1)
+	defer network.Close()
+	var auths int32
+	server := network.AddPeer(nil, func(param *xchg.Param) ([]byte, error) {
+		if param.Function == "" {
+			atomic.AddInt32(&auths, 1)
+		}
+		return param.Parameter, nil
+	})
+	client := network.AddPeer(nil, nil)
+
+	if _, err := call(client, server, "", []byte("1"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	network.Advance(30 * time.Second)
+	if _, err := call(client, server, "", []byte("2"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&auths) != 1 {
+		t.Fatal("session expired too early")
+	}
+
+	// The client opens a new session after the expired one is rejected
+	network.Advance(2 * time.Minute)
+	var err error
+	for i := 0; i < 2; i++ {
+		if _, err = call(client, server, "", []byte("3"), 5*time.Second); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&auths) != 2 {
+		t.Error("session is not renewed:", atomic.LoadInt32(&auths))
+	}
+}
+
+func TestRouterOutage(t *testing.T) {
+	network := newNetwork(3)
+	defer network.Close()
+	server := network.AddPeer(nil, echo)
+	client := network.AddPeer(nil, nil)
+
+	if _, err := call(client, server, "", []byte("1"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The home routers of both peers go down one after another
+	for _, peer := range []*xchg.Peer{server, client} {
+		router := network.RouterOf(peer.Address(), 0)
+		router.SetDown(true)
+		for i := 0; i < 5; i++ {
+			if _, err := call(client, server, "", []byte(fmt.Sprint(i)), 5*time.Second); err != nil {
+				t.Fatal("call failed with", router.Name(), "down:", err)
+			}
+		}
+		router.SetDown(false)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	network := newNetwork(2)
+	defer network.Close()
+	var calls int32
+	server := network.AddPeer(nil, func(param *xchg.Param) ([]byte, error) {
+		if param.Function != "" {
+			atomic.AddInt32(&calls, 1)
+		}
+		return param.Parameter, nil
+	})
+	client := network.AddPeer(nil, nil)
+
+	network.SetFaults(xchgtest.Faults{
+		Latency:     time.Millisecond,
+		Jitter:      5 * time.Millisecond,
+		Duplication: 0.5,
+		Reordering:  0.3,
+	})
+	data := bytes.Repeat([]byte{7}, 200*1024)
+	for i := 0; i < 10; i++ {
+		result, err := call(client, server, "", data, 5*time.Second)
+		if err != nil || !bytes.Equal(result, data) {
+			t.Fatal("call failed:", err)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 10 {
+		t.Error("duplicated frames are executed:", atomic.LoadInt32(&calls))
+	}
+	stat := network.Stat()
+	if stat.Duplicated == 0 || stat.Reordered == 0 {
+		t.Error("faults are not applied:", stat)
+	}
+}
+
+func TestLoss(t *testing.T) {
+	network := newNetwork(1)
+	defer network.Close()
+	server := network.AddPeer(nil, echo)
+	client := network.AddPeer(nil, nil)
+
+	if _, err := call(client, server, "", []byte("1"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	network.SetFaults(xchgtest.Faults{Loss: 1})
+	if _, err := call(client, server, "", []byte("2"), 300*time.Millisecond); err == nil {
+		t.Fatal("call succeeded without frames")
+	}
+
+	network.SetFaults(xchgtest.Faults{})
+	var err error
+	for i := 0; i < 2; i++ {
+		if _, err = call(client, server, "", []byte("3"), 5*time.Second); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLossyMultiFrameCalls(t *testing.T) {
+	network := newNetwork(1)
+	defer network.Close()
+	server := network.AddPeer(nil, echo)
+	client := network.AddPeer(nil, nil)
+
+	if _, err := call(client, server, "", []byte("1"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Eight blocks each way (the calls are compressed), almost every call loses some of them
+	network.SetFaults(xchgtest.Faults{Loss: 0.2})
+	data := make([]byte, 500*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	for i := 0; i < 10; i++ {
+		result, err := call(client, server, "", data, 10*time.Second)
+		if err != nil || !bytes.Equal(result, data) {
+			t.Fatal("call", i, "failed:", err, len(result))
+		}
+	}
+	if network.Stat().Lost == 0 {
+		t.Error("frames are not lost:", network.Stat())
+	}
+}
@@ -17,10 +17,24 @@ func TransactionSummary(frame []byte) string {
 			tp = "CR"
 		case 0x11:
 			tp = "cr"
+		case 0x12:
+			tp = "CN"
+		case 0x13:
+			tp = "AK"
+		case 0x14:
+			tp = "NK"
 		case 0x20:
-			tp = "PR"
+			tp = "AR"
 		case 0x21:
+			tp = "ar"
+		case 0x22:
+			tp = "PR"
+		case 0x23:
 			tp = "pr"
+		case 0x24:
+			tp = "UO"
+		case 0x25:
+			tp = "uo"
 		}
 	}
 
@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Codec serializes the parameters and results of typed calls.
+// The codec id travels in front of the payload so that both sides can detect a mismatch.
+type Codec interface {
+	Id() byte
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+const (
+	CodecIdJson = byte(0x01)
+	CodecIdGob  = byte(0x02)
+
+	// [magic][codecId][payload]
+	codecHeaderMagic = byte(0xCD)
+	codecHeaderSize  = 2
+)
+
+var (
+	codecsMtx sync.Mutex
+	codecs    = map[byte]Codec{
+		CodecIdJson: &JsonCodec{},
+		CodecIdGob:  &GobCodec{},
+	}
+)
+
+// RegisterCodec makes the codec available for the incoming typed calls
+func RegisterCodec(codec Codec) {
+	codecsMtx.Lock()
+	codecs[codec.Id()] = codec
+	codecsMtx.Unlock()
+}
+
+func codecNames() []string {
+	codecsMtx.Lock()
+	ids := make([]int, 0, len(codecs))
+	for id := range codecs {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, codecs[byte(id)].Name())
+	}
+	codecsMtx.Unlock()
+	return names
+}
+
+func GetCodec(id byte) Codec {
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+	return codecs[id]
+}
+
+type JsonCodec struct {
+}
+
+func (c *JsonCodec) Id() byte {
+	return CodecIdJson
+}
+
+func (c *JsonCodec) Name() string {
+	return "json"
+}
+
+func (c *JsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c *JsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type GobCodec struct {
+}
+
+func (c *GobCodec) Id() byte {
+	return CodecIdGob
+}
+
+func (c *GobCodec) Name() string {
+	return "gob"
+}
+
+func (c *GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func encodeWithCodec(codec Codec, v interface{}) (result []byte, err error) {
+	payload, err := codec.Marshal(v)
+	if err != nil {
+		err = errors.New(ERR_XCHG_CODEC_MARSHAL + ":" + err.Error())
+		return
+	}
+	result = make([]byte, codecHeaderSize+len(payload))
+	result[0] = codecHeaderMagic
+	result[1] = codec.Id()
+	copy(result[codecHeaderSize:], payload)
+	return
+}
+
+func decodeCodecHeader(data []byte) (codec Codec, payload []byte, err error) {
+	if len(data) < codecHeaderSize || data[0] != codecHeaderMagic {
+		err = errors.New(ERR_XCHG_CODEC_NO_HEADER)
+		return
+	}
+	codec = GetCodec(data[1])
+	if codec == nil {
+		err = errors.New(ERR_XCHG_CODEC_UNKNOWN + ":" + fmt.Sprint(data[1]))
+		return
+	}
+	payload = data[codecHeaderSize:]
+	return
+}
@@ -22,6 +22,8 @@
 
 package xchg
 
+import "time"
+
 const (
 	XchgMaxFrameSize       = 64 * 1024
 	XchgMaxTransactionSize = 1024 * 1024
@@ -30,12 +32,85 @@ const (
 	XchgNonceSize          = 16
 	XchgAesKeySize         = 32
 
+	// Replay window of the session call counters - the limit of the calls in flight per session
+	XchgSessionCounterWindow = 4096
+
+	// Keep-alive connections to one router - parallel calls must not open a connection per frame
+	XchgHttpMaxIdleConnsPerHost = 64
+
+	// Router requests: the short ones and the mailbox reads (longer than the long polling of the router)
+	XchgHttpTimeout      = 2 * time.Second
+	XchgLongPollingDelay = 12 * time.Second
+
+	// HTTP long polling is used for a while after the router refused the WebSocket connection
+	XchgRouterWSRetryDelay = 10 * time.Second
+
+	// Reconnect of the TCP router connection, the delay doubles up to the max
+	XchgRouterConnReconnectDelayMin = 100 * time.Millisecond
+	XchgRouterConnReconnectDelayMax = 5 * time.Second
+
+	// A transport is skipped for a while after the transaction sent through it is not answered
+	XchgTransportFailureDelay = 10 * time.Second
+
+	// Direct UDP: the datagram payload, the keepalive of the holes and the offers of the endpoint
+	XchgUdpMaxDataSize       = 16 * 1024
+	XchgUdpSocketBufferSize  = 4 * 1024 * 1024
+	XchgUdpKeepAliveInterval = 10 * time.Second
+	XchgUdpPeerTimeout       = 30 * time.Second
+	XchgUdpOfferInterval     = 5 * time.Second
+
+	// LAN discovery: the multicast group of the ARP requests and their rate per remote peer
+	XchgLanGroup           = "239.255.84.84:8087"
+	XchgLanRequestInterval = 5 * time.Second
+
+	// Multi-router redundancy: mailboxes per peer, the window of the duplicate frames
+	// and the pause of the router after an error
+	XchgRouterRedundancy   = 2
+	XchgFrameDedupWindow   = 30 * time.Second
+	XchgRouterFailureDelay = 10 * time.Second
+
+	// Router health: the weight of the last result in the moving averages,
+	// the latency that halves the score and the step of the scores treated as equal
+	XchgRouterHealthAlpha      = 0.2
+	XchgRouterHealthLatencyRef = 100 * time.Millisecond
+	XchgRouterHealthScoreStep  = 0.1
+
+	// Reliable delivery of the multi-frame transactions: the pause in the blocks before the receiver
+	// asks for the missing ones, the period of the checks, the requests per transaction,
+	// the wait of the acknowledgement of the request and the blocks of the responses kept for the retransmission
+	XchgNackDelay            = 200 * time.Millisecond
+	XchgNackInterval         = 100 * time.Millisecond
+	XchgRetransmitMax        = 5
+	XchgAckTimeout           = 1 * time.Second
+	XchgResponseCacheTimeout = 10 * time.Second
+	XchgResponseCacheSize    = 64 * 1024 * 1024
+
+	// Streaming calls: the data of one chunk call, the chunk calls in flight per direction,
+	// the wait of the server for the data of the chunk, the attempts of the failed chunk call
+	// and the stream without the calls dropped by the server
+	XchgStreamChunkSize   = 256 * 1024
+	XchgStreamWindow      = 4
+	XchgStreamPollTimeout = 2 * time.Second
+	XchgStreamCallTimeout = 5 * time.Second
+	XchgStreamRetries     = 3
+	XchgStreamIdleTimeout = 60 * time.Second
+
 	// Cheque
 	XchgChequeDataSize = 8 + 20 + 8
 
 	// Frame Type Code
 	XchgFrameCallRequest          = 0x10
 	XchgFrameCallResponse         = 0x11
-	XchgFrameGetPublicKeyRequest  = 0x20
-	XchgFrameGetPublicKeyResponse = 0x21
+	XchgFrameCancelRequest        = 0x12
+	XchgFrameAck                  = 0x13
+	XchgFrameNack                 = 0x14
+	XchgFrameLanArpRequest        = 0x20
+	XchgFrameLanArpResponse       = 0x21
+	XchgFrameGetPublicKeyRequest  = 0x22
+	XchgFrameGetPublicKeyResponse = 0x23
+	XchgFrameUdpEndpointOffer     = 0x24
+	XchgFrameUdpEndpointAnswer    = 0x25
+
+	// UDP only: [len 4][0x0E][reserved 3][src address 32]
+	XchgFrameUdpPunch = 0x0E
 )
@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	FunctionDescribe = "/xchg-describe"
+)
+
+type FunctionDescription struct {
+	Name         string      `json:"name"`
+	Prefix       bool        `json:"prefix,omitempty"`
+	Codecs       []string    `json:"codecs,omitempty"`
+	Request      interface{} `json:"request,omitempty"`
+	Response     interface{} `json:"response,omitempty"`
+	Version      string      `json:"version,omitempty"`
+	Description  string      `json:"description,omitempty"`
+	AuthRequired bool        `json:"auth_required,omitempty"`
+	Timeout      string      `json:"timeout,omitempty"`
+	Stream       bool        `json:"stream,omitempty"`
+}
+
+type ServiceDescription struct {
+	Address   string                `json:"address"`
+	Functions []FunctionDescription `json:"functions"`
+
+	// The peer serves functions that are not listed (CallbackFunc or not-found handler)
+	Opaque bool `json:"opaque"`
+}
+
+// Describe lists the registered functions sorted by name
+func (c *ServeMux) Describe() (functions []FunctionDescription, opaque bool) {
+	c.mtx.Lock()
+	routes := make([]*route, 0, len(c.routes)+len(c.prefixes))
+	for _, r := range c.routes {
+		routes = append(routes, r)
+	}
+	routes = append(routes, c.prefixes...)
+	streams := make([]*streamRoute, 0, len(c.streams))
+	for _, r := range c.streams {
+		streams = append(streams, r)
+	}
+	opaque = c.notFound != nil
+	c.mtx.Unlock()
+
+	functions = make([]FunctionDescription, 0, len(routes))
+	for _, r := range routes {
+		var f FunctionDescription
+		f.Name = r.pattern
+		f.Prefix = r.prefix
+		if r.prefix {
+			f.Name += "*"
+		}
+		f.Version = r.options.Version
+		f.Description = r.options.Description
+		f.AuthRequired = r.options.AuthRequired
+		if r.options.Timeout > 0 {
+			f.Timeout = r.options.Timeout.String()
+		}
+		if r.typed {
+			if r.options.Codec != nil {
+				f.Codecs = []string{r.options.Codec.Name()}
+			} else {
+				f.Codecs = codecNames()
+			}
+			f.Request = schemaHint(r.requestType, 0)
+			f.Response = schemaHint(r.responseType, 0)
+		}
+		functions = append(functions, f)
+	}
+	for _, r := range streams {
+		var f FunctionDescription
+		f.Name = r.function
+		f.Stream = true
+		f.Version = r.options.Version
+		f.Description = r.options.Description
+		f.AuthRequired = r.options.AuthRequired
+		if r.options.Timeout > 0 {
+			f.Timeout = r.options.Timeout.String()
+		}
+		functions = append(functions, f)
+	}
+
+	sort.Slice(functions, func(i, j int) bool {
+		return functions[i].Name < functions[j].Name
+	})
+	return
+}
+
+// schemaHint describes the type in the JSON form: {"field":"int","items":["string"]}
+func schemaHint(t reflect.Type, depth int) interface{} {
+	if depth > 8 {
+		return t.String()
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaHint(t.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return []interface{}{schemaHint(t.Elem(), depth+1)}
+	case reflect.Map:
+		return map[string]interface{}{"<" + t.Key().Kind().String() + ">": schemaHint(t.Elem(), depth+1)}
+	case reflect.Struct:
+		fields := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := field.Name
+			if tag, ok := field.Tag.Lookup("json"); ok {
+				tagName := strings.Split(tag, ",")[0]
+				if tagName == "-" {
+					continue
+				}
+				if tagName != "" {
+					name = tagName
+				}
+			}
+			fields[name] = schemaHint(field.Type, depth+1)
+		}
+		return fields
+	case reflect.Interface:
+		return "any"
+	}
+	return t.Kind().String()
+}
+
+func (c *Peer) describe() (response []byte, err error) {
+	c.mtx.Lock()
+	mux := c.mux
+	callback := c.Callback
+	c.mtx.Unlock()
+
+	var description ServiceDescription
+	description.Address = c.AddressHex()
+	description.Functions = make([]FunctionDescription, 0)
+	if mux != nil {
+		description.Functions, description.Opaque = mux.Describe()
+	} else {
+		description.Opaque = callback != nil
+	}
+	return json.Marshal(description)
+}
+
+// Describe requests the list of the functions served by the remote peer
+func (c *Peer) Describe(ctx context.Context, remoteAddress ed25519.PublicKey, authData string) (description *ServiceDescription, err error) {
+	result, err := c.CallContext(ctx, remoteAddress, authData, FunctionDescribe, nil)
+	if err != nil {
+		return
+	}
+	description = &ServiceDescription{}
+	err = json.Unmarshal(result, description)
+	if err != nil {
+		description = nil
+		err = errors.New(ERR_XCHG_CL_CONN_CALL_DESCRIBE + ":" + err.Error())
+		return
+	}
+	if description.Address != hex.EncodeToString(remoteAddress) {
+		description = nil
+		err = errors.New(ERR_XCHG_CL_CONN_CALL_DESCRIBE + ":wrong address")
+	}
+	return
+}
@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	xchgrouter "github.com/xchgn/xchg/router"
+)
+
+// embeddedRouter is shared by the peers of the process listening on the same address
+type embeddedRouter struct {
+	key    string
+	router *xchgrouter.Router
+	refs   int
+}
+
+var embeddedRoutersMtx sync.Mutex
+var embeddedRouters = make(map[string]*embeddedRouter)
+
+// embeddedRouterKey is empty for the routers that cannot be shared: own listener or a random port
+func embeddedRouterKey(options xchgrouter.RouterOptions) string {
+	if options.HttpListener != nil {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(options.HttpAddress)
+	if err != nil || port == "0" {
+		return ""
+	}
+	return options.HttpAddress
+}
+
+// acquireEmbeddedRouter starts the router or returns the running one of the same address
+func acquireEmbeddedRouter(options xchgrouter.RouterOptions) (r *embeddedRouter, err error) {
+	key := embeddedRouterKey(options)
+
+	embeddedRoutersMtx.Lock()
+	defer embeddedRoutersMtx.Unlock()
+
+	if key != "" {
+		if r = embeddedRouters[key]; r != nil {
+			r.refs++
+			return
+		}
+	}
+
+	router := xchgrouter.NewRouter(options)
+	err = router.Start()
+	if err != nil {
+		return
+	}
+	r = &embeddedRouter{key: key, router: router, refs: 1}
+	if key != "" {
+		embeddedRouters[key] = r
+	}
+	return
+}
+
+// release stops the router when the last peer leaves it
+func (c *embeddedRouter) release() {
+	embeddedRoutersMtx.Lock()
+	c.refs--
+	last := c.refs == 0
+	if last && c.key != "" && embeddedRouters[c.key] == c {
+		delete(embeddedRouters, c.key)
+	}
+	embeddedRoutersMtx.Unlock()
+
+	if last {
+		c.router.Stop()
+	}
+}
+
+// routerInfo describes the bound endpoints of the router for the peers of the process
+func (c *embeddedRouter) routerInfo() *RouterInfo {
+	httpAddr, ok := c.router.HttpAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	var info RouterInfo
+	info.Name = "embedded"
+	info.NetAddress = net.JoinHostPort("localhost", fmt.Sprint(httpAddr.Port))
+	if tcpAddr, ok := c.router.TcpAddr().(*net.TCPAddr); ok {
+		info.TcpAddress = net.JoinHostPort("localhost", fmt.Sprint(tcpAddr.Port))
+	}
+	if udpAddr, ok := c.router.UdpAddr().(*net.UDPAddr); ok {
+		info.UdpAddress = net.JoinHostPort("localhost", fmt.Sprint(udpAddr.Port))
+	}
+	return &info
+}
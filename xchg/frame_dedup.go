@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// frameDeduplicator drops the copies of the frames received through several routers.
+// The key is (frame type, src, transactionId, offset) plus the digest of the frame,
+// the digest keeps the frames of a restarted peer reusing transaction IDs.
+type frameDeduplicator struct {
+	mtx       sync.Mutex
+	window    time.Duration
+	current   map[frameDedupKey]struct{}
+	previous  map[frameDedupKey]struct{}
+	rotatedDT time.Time
+}
+
+type frameDedupKey struct {
+	frameType     byte
+	src           [XchgAddressSize]byte
+	transactionId uint64
+	offset        uint32
+	digest        [8]byte
+}
+
+func newFrameDeduplicator(window time.Duration) *frameDeduplicator {
+	var c frameDeduplicator
+	c.window = window
+	c.current = make(map[frameDedupKey]struct{})
+	c.previous = make(map[frameDedupKey]struct{})
+	c.rotatedDT = time.Now()
+	return &c
+}
+
+// Seen registers the frame and returns true if it has been received within the window
+func (c *frameDeduplicator) Seen(frame []byte) bool {
+	if len(frame) < TransactionHeaderSize {
+		return false
+	}
+	switch frame[4] {
+	case XchgFrameCallRequest, XchgFrameCallResponse, XchgFrameCancelRequest:
+	default:
+		return false
+	}
+
+	var key frameDedupKey
+	key.frameType = frame[4]
+	copy(key.src[:], frame[32:64])
+	key.transactionId = binary.LittleEndian.Uint64(frame[5:])
+	key.offset = binary.LittleEndian.Uint32(frame[21:])
+	digest := sha256.Sum256(frame)
+	copy(key.digest[:], digest[:])
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// Two generations: an entry lives from one to two windows
+	if time.Since(c.rotatedDT) > c.window {
+		c.previous = c.current
+		c.current = make(map[frameDedupKey]struct{})
+		c.rotatedDT = time.Now()
+	}
+
+	if _, ok := c.current[key]; ok {
+		return true
+	}
+	if _, ok := c.previous[key]; ok {
+		c.current[key] = struct{}{}
+		return true
+	}
+	c.current[key] = struct{}{}
+	return false
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps the handler of every incoming call including the session opening,
+// the stream calls and /xchg-describe
+type Middleware func(next CallbackFunc) CallbackFunc
+
+// Use adds middlewares to the chain. The first middleware is the outermost one.
+// The panic recovery is always installed in front of the chain.
+func (c *Peer) Use(middlewares ...Middleware) {
+	c.mtx.Lock()
+	c.middlewares = append(c.middlewares, middlewares...)
+	c.mtx.Unlock()
+}
+
+func (c *Peer) handlerWithMiddlewares(handler CallbackFunc) CallbackFunc {
+	c.mtx.Lock()
+	middlewares := c.middlewares
+	c.mtx.Unlock()
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// RecoveryMiddleware converts a panic of the handler into an error response.
+// If logger is nil the panic is written to the logger of the local peer of the call.
+func RecoveryMiddleware(logger Logger) Middleware {
+	return func(next CallbackFunc) CallbackFunc {
+		return func(param *Param) (response []byte, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger := logger
+					if logger == nil && param.LocalPeer != nil {
+						logger = param.LocalPeer.Logger()
+					}
+					if logger != nil {
+						logger.Println("panic in function", param.Function, ":", r, "\n", string(debug.Stack()))
+					}
+					response = nil
+					err = errors.New(ERR_XCHG_SRV_FUNCTION_PANIC + ":" + fmt.Sprint(r))
+				}
+			}()
+			return next(param)
+		}
+	}
+}
+
+// LoggingMiddleware writes every call to the logger
+func LoggingMiddleware(logger Logger) Middleware {
+	return func(next CallbackFunc) CallbackFunc {
+		return func(param *Param) (response []byte, err error) {
+			dtBegin := time.Now()
+			response, err = next(param)
+			function := param.Function
+			if function == "" {
+				function = "<auth>"
+			}
+			remoteAddress := hex.EncodeToString(param.RemoteAddress)
+			if err != nil {
+				logger.Println("call", function, "from", remoteAddress, "session", param.SessionId, "in", time.Since(dtBegin), "error:", err)
+			} else {
+				logger.Println("call", function, "from", remoteAddress, "session", param.SessionId, "in", time.Since(dtBegin), "bytes:", len(param.Parameter), "->", len(response))
+			}
+			return
+		}
+	}
+}
+
+// TimingMiddleware reports the duration of every call, e.g. to the metrics collector
+func TimingMiddleware(observer func(param *Param, duration time.Duration, err error)) Middleware {
+	return func(next CallbackFunc) CallbackFunc {
+		return func(param *Param) (response []byte, err error) {
+			dtBegin := time.Now()
+			response, err = next(param)
+			observer(param, time.Since(dtBegin), err)
+			return
+		}
+	}
+}
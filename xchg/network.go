@@ -23,20 +23,52 @@
 package xchg
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/xchgn/xchg/utils"
+	"github.com/xchgn/xchg/blockchain"
+	xchgrouter "github.com/xchgn/xchg/router"
+)
+
+const (
+	DefaultRouterAddr = "localhost:8084"
 )
 
 type Network struct {
-	//routers []*RouterConnection
+	mtx        sync.Mutex
+	routers    []*RouterInfo
+	redundancy int
 }
 
 type RouterInfo struct {
-	Name        string
-	NetAddress  string
-	XchgAddress string
+	Name        string `json:"name"`
+	NetAddress  string `json:"net_address"`
+	XchgAddress string `json:"xchg_address"`
+	Segment     int    `json:"segment"`
+
+	// TcpAddress (host:port) replaces HTTP for the router if it is set
+	TcpAddress string `json:"tcp_address,omitempty"`
+
+	// UdpAddress (host:port) of the endpoint service, the host of NetAddress is used by default
+	UdpAddress string `json:"udp_address,omitempty"`
+}
+
+// validatorRouterInfo is the item format of the validator's /api/routers
+type validatorRouterInfo struct {
+	Address             string `json:"Address"`
+	HttpConnectionPoint string `json:"HttpConnectionPoint"`
+	Signature           string `json:"signature"`
 }
 
 func NewNetwork() *Network {
@@ -45,32 +77,233 @@ func NewNetwork() *Network {
 	return &c
 }
 
+func NewNetworkFromRouters(routers []*RouterInfo) *Network {
+	c := NewNetwork()
+	c.SetRouters(routers)
+	return c
+}
+
 func (c *Network) init() {
+	c.routers = make([]*RouterInfo, 0)
+	c.redundancy = XchgRouterRedundancy
 }
 
-func (c *Network) GetRouterAddr(address string) string {
-	fmt.Println("GetRouterAddr for ", address)
-	routers := c.GetRouters()
-	for _, router := range routers {
-		fmt.Println("Router:", router.Name, router.NetAddress, router.XchgAddress)
+// SetRedundancy sets the number of routers keeping the mailbox of every address
+func (c *Network) SetRedundancy(redundancy int) {
+	if redundancy < 1 {
+		redundancy = 1
 	}
-	return "localhost:8084"
+	c.mtx.Lock()
+	c.redundancy = redundancy
+	c.mtx.Unlock()
 }
 
-func (c *Network) GetRouters() []*RouterInfo {
-	result := make([]*RouterInfo, 0)
+func (c *Network) Redundancy() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.redundancy < 1 {
+		return 1
+	}
+	return c.redundancy
+}
 
-	for i := 0; i < 10; i++ {
-		privateKey, _ := utils.GeneratePrivateKey()
-		publicKey := utils.ExtractPublicKey(privateKey)
-		xchgAddress := hex.EncodeToString(publicKey)
+// GetHomeRouterAddrs returns the routers keeping the mailbox of the address
+func (c *Network) GetHomeRouterAddrs(address string) []string {
+	return c.GetRouterAddrs(address, c.Redundancy())
+}
+
+func (c *Network) SetRouters(routers []*RouterInfo) {
+	result := make([]*RouterInfo, 0, len(routers))
+	for _, r := range routers {
+		if r == nil || len(r.NetAddress) == 0 {
+			continue
+		}
+		router := *r
+		result = append(result, &router)
+	}
 
-		result = append(result, &RouterInfo{
+	c.mtx.Lock()
+	c.routers = result
+	c.mtx.Unlock()
+}
+
+// LoadFromJson loads a static router list: [{"name":"","net_address":"host:port","xchg_address":"","segment":0}]
+func (c *Network) LoadFromJson(data []byte) (err error) {
+	var routers []*RouterInfo
+	err = json.Unmarshal(data, &routers)
+	if err != nil {
+		return
+	}
+	if len(routers) == 0 {
+		err = errors.New(ERR_XCHG_NETWORK_NO_ROUTERS)
+		return
+	}
+	c.SetRouters(routers)
+	return
+}
+
+// LoadFromValidatorJson loads the output of the validator's /api/routers
+func (c *Network) LoadFromValidatorJson(data []byte) (err error) {
+	var items []*validatorRouterInfo
+	err = json.Unmarshal(data, &items)
+	if err != nil {
+		return
+	}
+
+	routers := make([]*RouterInfo, 0, len(items))
+	for i, item := range items {
+		routers = append(routers, &RouterInfo{
 			Name:        "router" + fmt.Sprint(i),
-			NetAddress:  "localhost:8084",
-			XchgAddress: xchgAddress,
+			NetAddress:  item.HttpConnectionPoint,
+			XchgAddress: item.Address,
 		})
 	}
+	if len(routers) == 0 {
+		err = errors.New(ERR_XCHG_NETWORK_NO_ROUTERS)
+		return
+	}
+	c.SetRouters(routers)
+	return
+}
+
+// LoadFromValidator fetches the router list from the validator's /api/routers
+func (c *Network) LoadFromValidator(validatorHost string) (err error) {
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	response, err := httpClient.Get("http://" + validatorHost + "/api/routers")
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = errors.New(ERR_XCHG_NETWORK_HTTP_STATUS + ":" + response.Status)
+		return
+	}
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return
+	}
+	err = c.LoadFromValidatorJson(content)
+	return
+}
+
+// LoadFromBlockchain loads the routers of the network segments
+func (c *Network) LoadFromBlockchain(segments []*blockchain.Network) (err error) {
+	routers := make([]*RouterInfo, 0)
+	for _, segment := range segments {
+		if segment == nil {
+			continue
+		}
+		for i, r := range segment.Routers {
+			if len(r.IpAddr) == 0 {
+				continue
+			}
+			netAddress := r.IpAddr
+			if !strings.Contains(netAddress, ":") {
+				netAddress += ":8084"
+			}
+			routers = append(routers, &RouterInfo{
+				Name:        "router" + fmt.Sprint(segment.Segment) + "-" + fmt.Sprint(i),
+				NetAddress:  netAddress,
+				XchgAddress: r.XchgAddr,
+				Segment:     segment.Segment,
+			})
+		}
+	}
+	if len(routers) == 0 {
+		err = errors.New(ERR_XCHG_NETWORK_NO_ROUTERS)
+		return
+	}
+	c.SetRouters(routers)
+	return
+}
+
+// GetRouterAddr returns the home router of the address
+func (c *Network) GetRouterAddr(address string) string {
+	addrs := c.GetRouterAddrs(address, 1)
+	if len(addrs) == 0 {
+		return DefaultRouterAddr
+	}
+	return addrs[0]
+}
+
+// GetRouterAddrs returns up to count routers of the address ordered by preference.
+// Rendezvous hashing keeps the mapping stable when routers join or leave.
+func (c *Network) GetRouterAddrs(address string, count int) []string {
+	c.mtx.Lock()
+	routers := c.routers
+	c.mtx.Unlock()
+
+	if len(routers) == 0 {
+		return []string{DefaultRouterAddr}
+	}
+
+	type routerWeight struct {
+		addr   string
+		weight []byte
+	}
+
+	addressBS, err := hex.DecodeString(address)
+	if err != nil {
+		addressBS = []byte(address)
+	}
+
+	weights := make([]routerWeight, 0, len(routers))
+	for _, r := range routers {
+		h := sha256.New()
+		h.Write(addressBS)
+		h.Write([]byte(r.NetAddress))
+		weights = append(weights, routerWeight{addr: r.NetAddress, weight: h.Sum(nil)})
+	}
+	sort.Slice(weights, func(i, j int) bool {
+		return bytes.Compare(weights[i].weight, weights[j].weight) > 0
+	})
 
+	if count > len(weights) {
+		count = len(weights)
+	}
+	result := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		result = append(result, weights[i].addr)
+	}
+	return result
+}
+
+// GetRouterTcpAddr returns the TCP endpoint of the router or an empty string
+func (c *Network) GetRouterTcpAddr(netAddress string) string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, r := range c.routers {
+		if r.NetAddress == netAddress {
+			return r.TcpAddress
+		}
+	}
+	return ""
+}
+
+// GetRouterUdpAddr returns the UDP endpoint service of the router
+func (c *Network) GetRouterUdpAddr(netAddress string) string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, r := range c.routers {
+		if r.NetAddress == netAddress && r.UdpAddress != "" {
+			return r.UdpAddress
+		}
+	}
+	host, _, err := net.SplitHostPort(netAddress)
+	if err != nil {
+		host = netAddress
+	}
+	return net.JoinHostPort(host, fmt.Sprint(xchgrouter.UDP_PORT))
+}
+
+func (c *Network) GetRouters() []*RouterInfo {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	result := make([]*RouterInfo, 0, len(c.routers))
+	for _, r := range c.routers {
+		router := *r
+		result = append(result, &router)
+	}
 	return result
 }
@@ -23,10 +23,12 @@
 package xchg
 
 import (
+	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"sync"
@@ -41,7 +43,9 @@ type Logger interface {
 }
 
 type Param struct {
+	Context       context.Context
 	LocalPeer     *Peer
+	SessionId     uint64
 	RemoteAddress ed25519.PublicKey
 	AuthData      []byte
 	Function      string
@@ -50,6 +54,16 @@ type Param struct {
 
 type CallbackFunc func(param *Param) (response []byte, err error)
 
+// Serve calls f(param)
+func (f CallbackFunc) Serve(param *Param) (response []byte, err error) {
+	return f(param)
+}
+
+// Handler serves the calls of a server peer, *ServeMux and CallbackFunc implement it
+type Handler interface {
+	Serve(param *Param) (response []byte, err error)
+}
+
 type Peer struct {
 	mtx        sync.Mutex
 	privateKey ed25519.PrivateKey
@@ -57,6 +71,11 @@ type Peer struct {
 	stopping   bool
 	network    *Network
 
+	// Cancelled by Stop, closed by thWork on exit
+	stopCtx    context.Context
+	stopCancel context.CancelFunc
+	stopped    chan struct{}
+
 	TransportPrivateKey []byte
 	TransportPublicKey  []byte
 
@@ -72,21 +91,65 @@ type Peer struct {
 
 	gettingFromInternet   map[string]bool
 	lastReceivedMessageId map[string]uint64
+	routerNonces          map[string][]byte
+
+	// WebSocket transport, HTTP is the fallback
+	httpOnly          bool
+	routerWS          map[string]*routerWS
+	routerWSRetryTime map[string]time.Time
+
+	// TCP transport for the routers with TcpAddress
+	routerConnections map[string]*RouterConnection
+
+	// Direct UDP transport
+	udpEnabled           bool
+	udpConn              *net.UDPConn
+	udpEndpoint          *net.UDPAddr
+	udpRouterAddr        *net.UDPAddr
+	udpEndpointRequestDT time.Time
+	udpPeers             map[string]*udpPeer
+
+	// Multi-router redundancy
+	frameDeduplicator *frameDeduplicator
+	routerHealth      map[string]*routerHealth
+
+	// LAN discovery
+	lanEnabled  bool
+	lanConn     *net.UDPConn
+	lanGroup    *net.UDPAddr
+	lanRequests map[string]*lanRequest
+
+	// Peers of the same process
+	loopback *LoopbackHub
 
 	// Client
 	remotePeers map[string]*RemotePeer
 
 	// Server
-	incomingTransactions map[string]*Transaction
-	sessionsById         map[uint64]*Session
-	authNonces           *Nonces
-	nextSessionId        uint64
-
-	Callback CallbackFunc
+	incomingTransactions  map[string]*Transaction
+	runningCalls          map[string]context.CancelFunc
+	outgoingResponses     map[string]*outgoingResponse
+	outgoingResponsesSize int
+	streams               map[uint64]*serverStream
+	nextStreamId          uint64
+	sessionsById          map[uint64]*Session
+	authNonces            *Nonces
+	nextSessionId         uint64
+
+	transportFactories []RemotePeerTransportFactory
+
+	Callback    CallbackFunc
+	mux         *ServeMux
+	middlewares []Middleware
 
 	lastPurgeSessionsTime time.Time
+	clock                 Clock
 
-	router1 *router.Router
+	// Embedded router, the network follows it if the router list is not set
+	routerEnabled     bool
+	routerOptions     router.RouterOptions
+	router1           *embeddedRouter
+	networkFromRouter bool
 }
 
 type Session struct {
@@ -100,36 +163,82 @@ type Session struct {
 }
 
 func NewPeer(privateKey ed25519.PrivateKey) *Peer {
+	options := DefaultPeerOptions()
+	options.PrivateKey = privateKey
+	return NewPeerWithOptions(options)
+}
+
+func NewPeerWithOptions(options PeerOptions) *Peer {
 	var c Peer
-	c.logger = NewDefaultLogger()
+	c.logger = options.Logger
+	if c.logger == nil {
+		c.logger = NewDefaultLogger()
+	}
 	c.remotePeers = make(map[string]*RemotePeer)
 	c.incomingTransactions = make(map[string]*Transaction)
+	c.runningCalls = make(map[string]context.CancelFunc)
+	c.outgoingResponses = make(map[string]*outgoingResponse)
+	c.streams = make(map[uint64]*serverStream)
+	c.nextStreamId = 1
 	c.authNonces = NewNonces(100)
 	c.sessionsById = make(map[uint64]*Session)
 	c.nextSessionId = 1
-	c.network = NewNetwork()
+	c.network = NewNetworkFromRouters(options.Routers)
+	c.networkFromRouter = len(options.Routers) == 0
+	c.loopback = options.LoopbackHub
+	c.clock = options.Clock
+	if c.clock == nil {
+		c.clock = systemClock{}
+	}
+	c.routerEnabled = options.RouterEnabled
+	c.routerOptions = options.RouterOptions
+	// The peers reach the embedded router by HTTP, the rest of the options are kept
+	if c.routerEnabled && c.routerOptions.HttpAddress == "" && c.routerOptions.HttpListener == nil {
+		c.routerOptions.HttpAddress = router.DefaultRouterOptions().HttpAddress
+	}
 	c.lastReceivedMessageId = make(map[string]uint64)
+	c.routerNonces = make(map[string][]byte)
+	c.routerWS = make(map[string]*routerWS)
+	c.routerWSRetryTime = make(map[string]time.Time)
+	c.routerConnections = make(map[string]*RouterConnection)
+	c.udpEnabled = true
+	c.udpPeers = make(map[string]*udpPeer)
+	c.frameDeduplicator = newFrameDeduplicator(XchgFrameDedupWindow)
+	c.routerHealth = make(map[string]*routerHealth)
+	c.lanEnabled = true
+	c.lanRequests = make(map[string]*lanRequest)
 
 	c.routerStatRead = make(map[string]int)
 
 	c.TransportPrivateKey, c.TransportPublicKey, _ = utils.GenerateCurve25519KeyPair()
 
 	c.gettingFromInternet = make(map[string]bool)
-	c.longPollingDelay = 12 * time.Second
+	c.longPollingDelay = options.LongPollingDelay
+	if c.longPollingDelay <= 0 {
+		c.longPollingDelay = XchgLongPollingDelay
+	}
+	httpTimeout := options.HttpTimeout
+	if httpTimeout <= 0 {
+		httpTimeout = XchgHttpTimeout
+	}
 
-	c.privateKey = privateKey
+	c.middlewares = []Middleware{RecoveryMiddleware(nil)}
+
+	c.privateKey = options.PrivateKey
 	if c.privateKey == nil {
 		c.privateKey, _ = utils.GeneratePrivateKey()
 	}
 
-	{
-		tr := &http.Transport{}
+	c.httpClient = options.HttpClient
+	if c.httpClient == nil {
+		tr := &http.Transport{MaxIdleConnsPerHost: XchgHttpMaxIdleConnsPerHost}
 		jar, _ := cookiejar.New(nil)
 		c.httpClient = &http.Client{Transport: tr, Jar: jar}
-		c.httpClient.Timeout = 2 * time.Second
+		c.httpClient.Timeout = httpTimeout
 	}
 
-	{
+	c.httpClientLong = options.HttpClientLong
+	if c.httpClientLong == nil {
 		tr := &http.Transport{}
 		jar, _ := cookiejar.New(nil)
 		c.httpClientLong = &http.Client{Transport: tr, Jar: jar}
@@ -139,6 +248,7 @@ func NewPeer(privateKey ed25519.PrivateKey) *Peer {
 	return &c
 }
 
+// StartServerPeer starts the peer serving the calls by the callback, its functions are not published
 func StartServerPeer(privateKey ed25519.PrivateKey, callback CallbackFunc) *Peer {
 	c := NewPeer(privateKey)
 	c.Callback = callback
@@ -146,6 +256,20 @@ func StartServerPeer(privateKey ed25519.PrivateKey, callback CallbackFunc) *Peer
 	return c
 }
 
+// StartServerPeerHandler starts the peer serving the calls by the handler.
+// The functions of a *ServeMux are published by /xchg-describe, the other handlers are opaque.
+func StartServerPeerHandler(privateKey ed25519.PrivateKey, handler Handler) *Peer {
+	c := NewPeer(privateKey)
+	if mux, ok := handler.(*ServeMux); ok {
+		c.mux = mux
+	}
+	if handler != nil {
+		c.Callback = handler.Serve
+	}
+	c.Start()
+	return c
+}
+
 func StartClientPeer() *Peer {
 	c := NewPeer(nil)
 	c.Start()
@@ -160,14 +284,37 @@ func (c *Peer) Start() (err error) {
 		err = errors.New("already started")
 		return
 	}
+	c.started = true
+	c.stopCtx, c.stopCancel = context.WithCancel(context.Background())
+	c.stopped = make(chan struct{})
+	ctx := c.stopCtx
+	stopped := c.stopped
 	c.mtx.Unlock()
 
 	c.localAddressBS = utils.ExtractPublicKey(c.privateKey)
 
-	c.router1 = router.NewRouter()
-	c.router1.Start()
+	// A router of another process may serve the address, the peer works without its own one
+	if c.routerEnabled {
+		embedded, routerErr := acquireEmbeddedRouter(c.routerOptions)
+		if routerErr != nil {
+			c.logger.Println("embedded router:", routerErr)
+		} else {
+			c.mtx.Lock()
+			c.router1 = embedded
+			if info := embedded.routerInfo(); info != nil && c.networkFromRouter {
+				c.network.SetRouters([]*RouterInfo{info})
+			}
+			c.mtx.Unlock()
+		}
+	}
 
-	go c.thWork()
+	c.startUdp(ctx)
+
+	if hub := c.loopbackHub(); hub != nil {
+		hub.register(c)
+	}
+
+	go c.thWork(ctx, stopped)
 
 	return
 }
@@ -182,33 +329,42 @@ func (c *Peer) Stop() (err error) {
 		return
 	}
 
+	if c.stopping {
+		c.mtx.Unlock()
+		err = errors.New("already stopping")
+		return
+	}
+
 	c.stopping = true
-	started := c.started
+	c.stopCancel()
+	stopped := c.stopped
+	routerConnections := c.routerConnections
+	c.routerConnections = make(map[string]*RouterConnection)
 	c.mtx.Unlock()
 
-	if c.router1 != nil {
-		c.router1.Stop()
-		c.router1 = nil
+	for _, routerConnection := range routerConnections {
+		routerConnection.Stop()
 	}
+	c.stopUdp()
 
-	dtBegin := time.Now()
-	for started {
-		time.Sleep(10 * time.Millisecond)
-		c.mtx.Lock()
-		started = c.started
-		c.mtx.Unlock()
-
-		if time.Since(dtBegin) > 1000*time.Millisecond {
-			fmt.Println("TIMEOUT")
-			break
-		}
+	if hub := c.loopbackHub(); hub != nil {
+		hub.unregister(c)
 	}
 
 	c.mtx.Lock()
-	started = c.started
+	embedded := c.router1
+	c.router1 = nil
 	c.mtx.Unlock()
+	if embedded != nil {
+		embedded.release()
+	}
 
-	if started {
+	timer := time.NewTimer(1000 * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		fmt.Println("TIMEOUT")
 		err = errors.New("timeout")
 	}
 
@@ -223,48 +379,149 @@ func (c *Peer) AddressHex() string {
 	return hex.EncodeToString(c.Address())
 }
 
+func (c *Peer) Logger() Logger {
+	return c.logger
+}
+
 func (c *Peer) Network() *Network {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	return c.network
 }
 
-func (c *Peer) thWork() {
-	c.started = true
-	lastPurgeSessionsDT := time.Now()
-	lastStatDT := time.Now()
-	for {
-		c.mtx.Lock()
-		stopping := c.stopping
-		c.mtx.Unlock()
-		if stopping {
-			break
+func (c *Peer) Mux() *ServeMux {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.mux
+}
+
+func (c *Peer) SetNetwork(network *Network) {
+	c.mtx.Lock()
+	c.network = network
+	c.networkFromRouter = false
+	c.mtx.Unlock()
+}
+
+func (c *Peer) thWork(ctx context.Context, stopped chan struct{}) {
+	go c.thReceive(ctx)
+
+	purgeSessionsTicker := time.NewTicker(5 * time.Second)
+	defer purgeSessionsTicker.Stop()
+	statTicker := time.NewTicker(10 * time.Second)
+	defer statTicker.Stop()
+	udpTicker := time.NewTicker(XchgUdpKeepAliveInterval)
+	defer udpTicker.Stop()
+	deliveryTicker := time.NewTicker(XchgNackInterval)
+	defer deliveryTicker.Stop()
+
+	working := true
+	for working {
+		select {
+		case <-ctx.Done():
+			working = false
+		case <-purgeSessionsTicker.C:
+			c.PurgeSessions()
+		case <-statTicker.C:
+			c.fixStat()
+		case <-udpTicker.C:
+			c.udpKeepAlive()
+		case <-deliveryTicker.C:
+			c.checkDelivery()
 		}
+	}
 
-		go c.getFramesFromRouters()
+	c.mtx.Lock()
+	c.started = false
+	c.stopping = false
+	c.mtx.Unlock()
+	close(stopped)
+}
 
-		if time.Since(lastPurgeSessionsDT) > 5*time.Second {
-			c.purgeSessions()
-			lastPurgeSessionsDT = time.Now()
+// thReceive keeps one receiver per home router, the set follows the network
+func (c *Peer) thReceive(ctx context.Context) {
+	receivers := make(map[string]context.CancelFunc)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		routers := make(map[string]struct{})
+		if network := c.Network(); network != nil {
+			for _, router := range c.homeRouters(network) {
+				routers[router] = struct{}{}
+			}
+		}
+		for router := range routers {
+			if _, ok := receivers[router]; !ok {
+				routerCtx, cancel := context.WithCancel(ctx)
+				receivers[router] = cancel
+				go c.thReceiveFromRouter(routerCtx, router)
+			}
+		}
+		for router, cancel := range receivers {
+			if _, ok := routers[router]; !ok {
+				cancel()
+				delete(receivers, router)
+			}
 		}
 
-		if time.Since(lastStatDT) > 10*time.Second {
-			c.fixStat()
-			lastStatDT = time.Now()
+		select {
+		case <-ctx.Done():
+			for _, cancel := range receivers {
+				cancel()
+			}
+			return
+		case <-ticker.C:
 		}
+	}
+}
 
-		time.Sleep(10 * time.Millisecond)
+// thReceiveFromRouter keeps the TCP or WebSocket connection or one long polling request to the router
+func (c *Peer) thReceiveFromRouter(ctx context.Context, router string) {
+	for ctx.Err() == nil {
+		err := c.receiveFromRouter(ctx, router)
+		if err != nil {
+			// Router is unavailable - do not flood it
+			select {
+			case <-ctx.Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
 	}
-	c.started = false
 }
 
 func (c *Peer) Call(remoteAddress ed25519.PublicKey, authData string, function string, data []byte, timeout time.Duration) (result []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.CallContext(ctx, remoteAddress, authData, function, data)
+}
+
+// CallContext returns as soon as ctx is done. The server is asked to drop the call.
+func (c *Peer) CallContext(ctx context.Context, remoteAddress ed25519.PublicKey, authData string, function string, data []byte) (result []byte, err error) {
+	remotePeerKey := hex.EncodeToString(remoteAddress)
 	c.mtx.Lock()
-	remotePeer, remotePeerOk := c.remotePeers[hex.EncodeToString(remoteAddress)]
-	if !remotePeerOk || remotePeer == nil {
-		remotePeer = NewRemotePeer(remoteAddress, authData, c.privateKey)
-		c.remotePeers[hex.EncodeToString(remoteAddress)] = remotePeer
-	}
-	network := c.network
+	remotePeer := c.remotePeers[remotePeerKey]
+	transportFactories := c.transportFactories
 	c.mtx.Unlock()
-	result, err = remotePeer.Call(network, function, data, timeout)
+
+	// The factories may call the peer - the remote peer is made outside the lock
+	if remotePeer == nil {
+		newRemotePeer := NewRemotePeer(remoteAddress, authData, c.privateKey)
+		newRemotePeer.localPeer = c
+		newRemotePeer.AddTransport(NewRemotePeerTransportUdp(newRemotePeer))
+		newRemotePeer.AddTransport(NewRemotePeerTransportLan(newRemotePeer))
+		newRemotePeer.AddTransport(NewRemotePeerTransportLoopback(newRemotePeer))
+		for _, factory := range transportFactories {
+			newRemotePeer.AddTransport(factory(newRemotePeer))
+		}
+
+		c.mtx.Lock()
+		if remotePeer = c.remotePeers[remotePeerKey]; remotePeer == nil {
+			remotePeer = newRemotePeer
+			c.remotePeers[remotePeerKey] = remotePeer
+		}
+		c.mtx.Unlock()
+	}
+
+	result, err = remotePeer.CallContext(ctx, c.Network(), function, data)
 	return
 }
@@ -0,0 +1,397 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/xchgn/xchg/utils"
+)
+
+// Reliable delivery of the multi-frame transactions.
+//
+// The receiver of the blocks asks for the missing ones (NACK) after a pause in the blocks,
+// the sender retransmits only the requested ranges. The server acknowledges (ACK) the complete
+// multi-frame request. Without the acknowledgement the client sends the first block again,
+// the server learns the size of the request from it and asks for the rest.
+// The client acknowledges the complete multi-frame response, the server keeps
+// the response until then to answer the requests of the missing blocks.
+//
+// ACK/NACK data: [kind 1][body], the kind is the frame type of the blocks (0x10 or 0x11)
+// body: [transactionId 8]([offset 4][size 4])..., encrypted with the session key if the session is set
+
+// outgoingResponse keeps the multi-frame response until the caller acknowledges it
+type outgoingResponse struct {
+	transaction *Transaction
+	aesKey      []byte
+	retransmits int
+	createdDT   time.Time
+}
+
+func makeDeliveryFrame(frameType byte, kind byte, src []byte, dest []byte, transactionId uint64, sessionId uint64, ranges [][2]uint32, aesKey []byte) (tr *Transaction, err error) {
+	body := make([]byte, 8+len(ranges)*8)
+	binary.LittleEndian.PutUint64(body, transactionId)
+	for i, r := range ranges {
+		binary.LittleEndian.PutUint32(body[8+i*8:], r[0])
+		binary.LittleEndian.PutUint32(body[8+i*8+4:], r[1])
+	}
+
+	if sessionId != 0 {
+		body, err = utils.EncryptAESGCM(body, aesKey)
+		if err != nil {
+			return
+		}
+	}
+
+	data := make([]byte, 1+len(body))
+	data[0] = kind
+	copy(data[1:], body)
+
+	tr = NewTransaction(frameType, src, dest, transactionId, sessionId, 0, 0, data)
+	if frameType == XchgFrameAck {
+		copy(tr.Comment[:], []byte("ACK"))
+	} else {
+		copy(tr.Comment[:], []byte("NACK"))
+	}
+	return
+}
+
+// parseDeliveryFrame checks that the frame is made by the owner of the session
+func parseDeliveryFrame(tr *Transaction, aesKey []byte) (ranges [][2]uint32, err error) {
+	if len(tr.Data) < 1 {
+		err = errors.New(ERR_XCHG_PEER_DELIVERY_WRONG_FRAME)
+		return
+	}
+
+	body := tr.Data[1:]
+	if tr.SessionId != 0 {
+		body, err = utils.DecryptAESGCM(body, aesKey)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(body) < 8 || len(body)%8 != 0 || binary.LittleEndian.Uint64(body) != tr.TransactionId {
+		err = errors.New(ERR_XCHG_PEER_DELIVERY_WRONG_FRAME)
+		return
+	}
+
+	for offset := 8; offset < len(body); offset += 8 {
+		ranges = append(ranges, [2]uint32{binary.LittleEndian.Uint32(body[offset:]), binary.LittleEndian.Uint32(body[offset+4:])})
+	}
+	return
+}
+
+// retransmitBlocks clips and merges the requested ranges, so one request never costs more than the data,
+// and splits them into the blocks of XchgMaxFrameSize
+func retransmitBlocks(ranges [][2]uint32, size int) (blocks [][2]int) {
+	sorted := make([][2]int, 0, len(ranges))
+	for _, r := range ranges {
+		begin := int(r[0])
+		end := begin + int(r[1])
+		if end > size {
+			end = size
+		}
+		if begin < end {
+			sorted = append(sorted, [2]int{begin, end})
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][0] < sorted[j][0]
+	})
+
+	covered := 0
+	for _, r := range sorted {
+		begin := r[0]
+		if begin < covered {
+			begin = covered
+		}
+		for begin < r[1] {
+			end := begin + XchgMaxFrameSize
+			if end > r[1] {
+				end = r[1]
+			}
+			blocks = append(blocks, [2]int{begin, end - begin})
+			begin = end
+		}
+		if r[1] > covered {
+			covered = r[1]
+		}
+	}
+	return
+}
+
+// dataFrames makes the frames of the blocks of the transaction data
+func dataFrames(t *Transaction, blocks [][2]int) (frames []*Transaction) {
+	for _, b := range blocks {
+		frame := NewTransaction(t.FrameType, t.SrcAddress[:], t.DestAddress[:], t.TransactionId, t.SessionId, b[0], len(t.Data), t.Data[b[0]:b[0]+b[1]])
+		frame.Comment = t.Comment
+		frame.FromLocalNode = t.FromLocalNode
+		frame.Critical = t.Critical
+		frames = append(frames, frame)
+	}
+	return
+}
+
+// Server
+
+// sendDirect delivers the frame without a known path back to the peer:
+// through the loopback hub, the confirmed UDP endpoint or the routers
+func (c *Peer) sendDirect(tr *Transaction) {
+	if hub := c.loopbackHub(); hub != nil && hub.send(tr) == nil {
+		return
+	}
+	if c.sendUdp(tr) == nil {
+		return
+	}
+	c.sendFrame(c.Network(), tr)
+}
+
+func (c *Peer) sessionKey(sessionId uint64) []byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if session, ok := c.sessionsById[sessionId]; ok && session != nil {
+		return session.aesKey
+	}
+	return nil
+}
+
+// ackRequest tells the caller that the multi-frame request is complete
+func (c *Peer) ackRequest(incomingTransaction *Transaction) {
+	publicKey := utils.ExtractPublicKey(c.privateKey)
+	ack, err := makeDeliveryFrame(XchgFrameAck, FrameTypeCall, publicKey, incomingTransaction.SrcAddress[:], incomingTransaction.TransactionId, incomingTransaction.SessionId, nil, c.sessionKey(incomingTransaction.SessionId))
+	if err != nil {
+		return
+	}
+	c.sendDirect(ack)
+}
+
+// cacheResponse keeps the multi-frame response for the retransmission of the blocks lost on the way to the caller
+func (c *Peer) cacheResponse(code string, trResponse *Transaction) {
+	aesKey := c.sessionKey(trResponse.SessionId)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.outgoingResponsesSize+len(trResponse.Data) > XchgResponseCacheSize {
+		return
+	}
+	if old, ok := c.outgoingResponses[code]; ok {
+		c.outgoingResponsesSize -= len(old.transaction.Data)
+	}
+	var r outgoingResponse
+	r.transaction = trResponse
+	r.aesKey = aesKey
+	r.createdDT = time.Now()
+	c.outgoingResponses[code] = &r
+	c.outgoingResponsesSize += len(trResponse.Data)
+}
+
+func (c *Peer) dropResponse(code string) {
+	if r, ok := c.outgoingResponses[code]; ok {
+		c.outgoingResponsesSize -= len(r.transaction.Data)
+		delete(c.outgoingResponses, code)
+	}
+}
+
+// checkDelivery asks the callers for the missing blocks of the requests and drops the old responses
+func (c *Peer) checkDelivery() {
+	now := time.Now()
+	publicKey := utils.ExtractPublicKey(c.privateKey)
+	nacks := make([]*Transaction, 0)
+
+	c.mtx.Lock()
+	for _, t := range c.incomingTransactions {
+		if t.Complete || t.nackCount >= XchgRetransmitMax || now.Sub(t.LastReceivedDT) < XchgNackDelay {
+			continue
+		}
+		ranges := t.MissingRanges()
+		if len(ranges) == 0 {
+			continue
+		}
+		var aesKey []byte
+		if session, ok := c.sessionsById[t.SessionId]; ok && session != nil {
+			aesKey = session.aesKey
+		}
+		nack, err := makeDeliveryFrame(XchgFrameNack, FrameTypeCall, publicKey, t.SrcAddress[:], t.TransactionId, t.SessionId, ranges, aesKey)
+		if err != nil {
+			continue
+		}
+		t.nackCount++
+		t.LastReceivedDT = now
+		nacks = append(nacks, nack)
+	}
+	for code, r := range c.outgoingResponses {
+		if now.Sub(r.createdDT) > XchgResponseCacheTimeout {
+			c.dropResponse(code)
+		}
+	}
+	c.mtx.Unlock()
+
+	for _, nack := range nacks {
+		go c.sendDirect(nack)
+	}
+}
+
+func (c *Peer) remotePeerByAddress(address []byte) *RemotePeer {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.remotePeers[hex.EncodeToString(address)]
+}
+
+// Acknowledgement
+// The server acknowledges the request of the local remote peer, the caller acknowledges the response
+func (c *Peer) processFrameAck(frame []byte) {
+	tr, err := Parse(frame)
+	if err != nil || len(tr.Data) < 1 {
+		return
+	}
+
+	switch tr.Data[0] {
+	case FrameTypeCall:
+		if remotePeer := c.remotePeerByAddress(tr.SrcAddress[:]); remotePeer != nil {
+			remotePeer.processFrameAck(tr)
+		}
+	case FrameTypeResponse:
+		code := fmt.Sprint(tr.SrcAddress, "-", tr.TransactionId)
+		c.mtx.Lock()
+		if r, ok := c.outgoingResponses[code]; ok {
+			if _, err = parseDeliveryFrame(tr, r.aesKey); err == nil {
+				c.dropResponse(code)
+			}
+		}
+		c.mtx.Unlock()
+	}
+}
+
+// Negative acknowledgement
+// The server asks the local remote peer for the blocks of the request, the caller asks for the blocks of the response
+func (c *Peer) processFrameNack(frame []byte) (responseFrames []*Transaction) {
+	tr, err := Parse(frame)
+	if err != nil || len(tr.Data) < 1 {
+		return
+	}
+
+	switch tr.Data[0] {
+	case FrameTypeCall:
+		if remotePeer := c.remotePeerByAddress(tr.SrcAddress[:]); remotePeer != nil {
+			remotePeer.processFrameNack(c.Network(), tr)
+		}
+	case FrameTypeResponse:
+		code := fmt.Sprint(tr.SrcAddress, "-", tr.TransactionId)
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		r, ok := c.outgoingResponses[code]
+		if !ok || r.retransmits >= XchgRetransmitMax {
+			return
+		}
+		var ranges [][2]uint32
+		ranges, err = parseDeliveryFrame(tr, r.aesKey)
+		if err != nil {
+			return
+		}
+		r.retransmits++
+		responseFrames = dataFrames(r.transaction, retransmitBlocks(ranges, len(r.transaction.Data)))
+	}
+	return
+}
+
+// Client
+
+// checkDelivery asks the server for the missing blocks of the response
+// and sends the first block of the request again if the server has not acknowledged it
+func (c *RemotePeer) checkDelivery(network *Network, t *Transaction) {
+	now := time.Now()
+	frames := make([]*Transaction, 0)
+
+	c.mtx.Lock()
+	if len(t.ReceivedFrames) > 0 {
+		ranges := t.MissingRanges()
+		if !t.Complete && len(ranges) > 0 && t.nackCount < XchgRetransmitMax && now.Sub(t.LastReceivedDT) >= XchgNackDelay {
+			nack, err := makeDeliveryFrame(XchgFrameNack, FrameTypeResponse, c.publicKey, c.remoteAddress, t.TransactionId, t.SessionId, ranges, t.deliveryKey)
+			if err == nil {
+				t.nackCount++
+				t.LastReceivedDT = now
+				frames = append(frames, nack)
+			}
+		}
+	} else if len(t.Data) > XchgMaxFrameSize && !t.acked && t.retransmits < XchgRetransmitMax && now.Sub(t.BeginDT) >= time.Duration(t.retransmits+1)*XchgAckTimeout {
+		t.retransmits++
+		frames = append(frames, dataFrames(t, retransmitBlocks([][2]uint32{{0, XchgMaxFrameSize}}, len(t.Data)))...)
+	}
+	c.mtx.Unlock()
+
+	for _, f := range frames {
+		go c.Send(network, f)
+	}
+}
+
+// ackResponse lets the server drop the multi-frame response
+func (c *RemotePeer) ackResponse(network *Network, t *Transaction) {
+	if len(t.Result) <= XchgMaxFrameSize {
+		return
+	}
+	ack, err := makeDeliveryFrame(XchgFrameAck, FrameTypeResponse, c.publicKey, c.remoteAddress, t.TransactionId, t.SessionId, nil, t.deliveryKey)
+	if err != nil {
+		return
+	}
+	go c.Send(network, ack)
+}
+
+func (c *RemotePeer) processFrameAck(tr *Transaction) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t, ok := c.outgoingTransactions[tr.TransactionId]
+	if !ok || t.SessionId != tr.SessionId {
+		return
+	}
+	if _, err := parseDeliveryFrame(tr, t.deliveryKey); err == nil {
+		t.acked = true
+	}
+}
+
+func (c *RemotePeer) processFrameNack(network *Network, tr *Transaction) {
+	c.mtx.Lock()
+	t, ok := c.outgoingTransactions[tr.TransactionId]
+	if !ok || t.SessionId != tr.SessionId || t.retransmits >= XchgRetransmitMax {
+		c.mtx.Unlock()
+		return
+	}
+	ranges, err := parseDeliveryFrame(tr, t.deliveryKey)
+	if err != nil {
+		c.mtx.Unlock()
+		return
+	}
+	t.acked = true
+	t.retransmits++
+	frames := dataFrames(t, retransmitBlocks(ranges, len(t.Data)))
+	c.mtx.Unlock()
+
+	for _, f := range frames {
+		go c.Send(network, f)
+	}
+}
@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/xchgn/xchg/utils"
+)
+
+// LAN discovery: the ARP request goes to the multicast group,
+// the owner of the address answers to the UDP socket of the requester.
+type lanRequest struct {
+	nonce []byte
+	dt    time.Time
+}
+
+// startLan joins the multicast group, the errors only disable the discovery
+func (c *Peer) startLan(ctx context.Context) {
+	c.mtx.Lock()
+	enabled := c.lanEnabled && c.udpConn != nil
+	c.mtx.Unlock()
+	if !enabled {
+		return
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", XchgLanGroup)
+	if err != nil {
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		c.logger.Println("LAN discovery is disabled:", err)
+		return
+	}
+
+	c.mtx.Lock()
+	c.lanConn = conn
+	c.lanGroup = group
+	c.mtx.Unlock()
+
+	go c.thLanReceive(ctx, conn)
+}
+
+func (c *Peer) stopLan() {
+	c.mtx.Lock()
+	conn := c.lanConn
+	c.lanConn = nil
+	c.lanRequests = make(map[string]*lanRequest)
+	c.mtx.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// SetLanDiscovery enables the discovery of the peers in the local network (default). It takes effect on Start.
+func (c *Peer) SetLanDiscovery(enabled bool) {
+	c.mtx.Lock()
+	c.lanEnabled = enabled
+	c.mtx.Unlock()
+}
+
+func (c *Peer) thLanReceive(ctx context.Context, conn *net.UDPConn) {
+	buffer := make([]byte, 1024)
+	for ctx.Err() == nil {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if n != TransactionHeaderSize+XchgNonceSize || buffer[4] != XchgFrameLanArpRequest {
+			continue
+		}
+		frame := make([]byte, n)
+		copy(frame, buffer[:n])
+		c.processFrameLanArpRequest(addr, frame)
+	}
+}
+
+// lanArpRequest asks the local network who has the address
+func (c *Peer) lanArpRequest(remoteAddress []byte) {
+	address := hex.EncodeToString(remoteAddress)
+
+	c.mtx.Lock()
+	conn := c.udpConn
+	group := c.lanGroup
+	if conn == nil || c.lanConn == nil {
+		c.mtx.Unlock()
+		return
+	}
+	if r, ok := c.lanRequests[address]; ok && time.Since(r.dt) < XchgLanRequestInterval {
+		c.mtx.Unlock()
+		return
+	}
+	nonce := make([]byte, XchgNonceSize)
+	rand.Read(nonce)
+	c.lanRequests[address] = &lanRequest{nonce: nonce, dt: time.Now()}
+	c.mtx.Unlock()
+
+	request := NewTransaction(XchgFrameLanArpRequest, c.localAddressBS, remoteAddress, 0, 0, 0, 0, nonce)
+	copy(request.Comment[:], []byte("ARP"))
+	conn.WriteToUDP(request.Marshal(), group)
+}
+
+// ARP response: [nonce 16][transport public key 32][signature 64],
+// the signature covers [src 32][dest 32][nonce 16][transport public key 32]
+func lanArpSignedData(srcAddress []byte, destAddress []byte, nonceAndKey []byte) []byte {
+	signed := make([]byte, 0, 32+32+len(nonceAndKey))
+	signed = append(signed, srcAddress...)
+	signed = append(signed, destAddress...)
+	signed = append(signed, nonceAndKey...)
+	return signed
+}
+
+// processFrameLanArpRequest answers if the address is ours
+func (c *Peer) processFrameLanArpRequest(addr *net.UDPAddr, frame []byte) {
+	tr, err := Parse(frame)
+	if err != nil || tr.DestAddressString() != c.AddressHex() {
+		return
+	}
+
+	c.mtx.Lock()
+	conn := c.udpConn
+	c.mtx.Unlock()
+	if conn == nil {
+		return
+	}
+
+	data := make([]byte, XchgNonceSize+32+64)
+	copy(data, tr.Data)
+	copy(data[XchgNonceSize:], c.TransportPublicKey)
+	response := NewTransaction(XchgFrameLanArpResponse, c.localAddressBS, tr.SrcAddress[:], 0, 0, 0, 0, nil)
+	copy(data[XchgNonceSize+32:], utils.SignMessage(c.privateKey, lanArpSignedData(response.SrcAddress[:], response.DestAddress[:], data[:XchgNonceSize+32])))
+	response.Data = data
+	conn.WriteToUDP(response.Marshal(), addr)
+}
+
+// processFrameLanArpResponse makes the direct path to the peer and takes its transport key
+func (c *Peer) processFrameLanArpResponse(addr *net.UDPAddr, frame []byte) {
+	tr, err := Parse(frame)
+	if err != nil || len(tr.Data) != XchgNonceSize+32+64 {
+		return
+	}
+	address := tr.SrcAddressString()
+
+	c.mtx.Lock()
+	r, ok := c.lanRequests[address]
+	c.mtx.Unlock()
+	if !ok || string(r.nonce) != string(tr.Data[:XchgNonceSize]) {
+		return
+	}
+	if !utils.VerifySignature(tr.SrcAddress[:], lanArpSignedData(tr.SrcAddress[:], tr.DestAddress[:], tr.Data[:XchgNonceSize+32]), tr.Data[XchgNonceSize+32:]) {
+		return
+	}
+
+	c.mtx.Lock()
+	delete(c.lanRequests, address)
+	c.udpPeers[address] = &udpPeer{endpoint: addr, confirmedDT: time.Now(), lan: true}
+	remotePeer := c.remotePeers[address]
+	c.mtx.Unlock()
+
+	if remotePeer != nil {
+		remoteTransportPublicKey := make([]byte, 32)
+		copy(remoteTransportPublicKey, tr.Data[XchgNonceSize:])
+		remotePeer.setRemoteTransportPublicKey("lan", remoteTransportPublicKey)
+	}
+}
+
+// lanConfirmedEndpoint returns the endpoint of the peer found in the local network
+func (c *Peer) lanConfirmedEndpoint(address string) *net.UDPAddr {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	p, ok := c.udpPeers[address]
+	if !ok || !p.lan || c.udpConn == nil || time.Since(p.confirmedDT) >= XchgUdpPeerTimeout {
+		return nil
+	}
+	return p.endpoint
+}
+
+// RemotePeerTransportLan delivers frames directly to the peer found by the LAN ARP request.
+// It works without routers.
+type RemotePeerTransportLan struct {
+	TransportFailures
+	remotePeer *RemotePeer
+}
+
+func NewRemotePeerTransportLan(remotePeer *RemotePeer) *RemotePeerTransportLan {
+	var c RemotePeerTransportLan
+	c.remotePeer = remotePeer
+	return &c
+}
+
+func (c *RemotePeerTransportLan) Id() string {
+	return "lan"
+}
+
+// Check sends the ARP request until the peer answers
+func (c *RemotePeerTransportLan) Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) error {
+	localPeer := c.remotePeer.LocalPeer()
+	if localPeer == nil || c.Failed() {
+		return errors.New(ERR_XCHG_PEER_LAN_NOT_FOUND)
+	}
+	if localPeer.lanConfirmedEndpoint(hex.EncodeToString(c.remotePeer.RemoteAddress())) != nil {
+		return nil
+	}
+	localPeer.lanArpRequest(c.remotePeer.RemoteAddress())
+	return errors.New(ERR_XCHG_PEER_LAN_NOT_FOUND)
+}
+
+func (c *RemotePeerTransportLan) DeclareError(sentViaTransportMap map[string]struct{}) {
+	if _, ok := sentViaTransportMap[c.Id()]; !ok {
+		return
+	}
+	c.DeclareFailure()
+	if localPeer := c.remotePeer.LocalPeer(); localPeer != nil {
+		localPeer.udpUnconfirm(hex.EncodeToString(c.remotePeer.RemoteAddress()))
+	}
+}
+
+func (c *RemotePeerTransportLan) Send(network *Network, tr *Transaction) error {
+	localPeer := c.remotePeer.LocalPeer()
+	if localPeer == nil {
+		return errors.New(ERR_XCHG_PEER_LAN_NOT_FOUND)
+	}
+	endpoint := localPeer.lanConfirmedEndpoint(tr.DestAddressString())
+	if endpoint == nil {
+		return errors.New(ERR_XCHG_PEER_LAN_NOT_FOUND)
+	}
+	return localPeer.sendUdpTo(tr, endpoint)
+}
+
+func (c *RemotePeerTransportLan) SetRemoteUDPAddress(udpAddress *net.UDPAddr) {
+}
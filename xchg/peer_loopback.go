@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+)
+
+// LoopbackHub delivers frames between the peers of one process without the network.
+// The frames are the same as through the routers, so are the encryption and the sessions.
+type LoopbackHub struct {
+	mtx   sync.Mutex
+	peers map[string]*Peer
+}
+
+// DefaultLoopbackHub is used by the peers created with DefaultPeerOptions
+var DefaultLoopbackHub = NewLoopbackHub()
+
+func NewLoopbackHub() *LoopbackHub {
+	var c LoopbackHub
+	c.peers = make(map[string]*Peer)
+	return &c
+}
+
+func (c *LoopbackHub) register(peer *Peer) {
+	c.mtx.Lock()
+	c.peers[peer.AddressHex()] = peer
+	c.mtx.Unlock()
+}
+
+func (c *LoopbackHub) unregister(peer *Peer) {
+	c.mtx.Lock()
+	address := peer.AddressHex()
+	if c.peers[address] == peer {
+		delete(c.peers, address)
+	}
+	c.mtx.Unlock()
+}
+
+func (c *LoopbackHub) peer(address string) *Peer {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.peers[address]
+}
+
+// send passes the copy of the frame to the destination peer
+func (c *LoopbackHub) send(tr *Transaction) error {
+	dest := c.peer(tr.DestAddressString())
+	if dest == nil {
+		return errors.New(ERR_XCHG_PEER_LOOPBACK_NOT_FOUND)
+	}
+	go dest.processFrameFromLoopback(c, tr.Marshal())
+	return nil
+}
+
+// SetLoopback sets the hub of the peer before Start, nil disables the loopback transport
+func (c *Peer) SetLoopback(hub *LoopbackHub) {
+	c.mtx.Lock()
+	c.loopback = hub
+	c.mtx.Unlock()
+}
+
+func (c *Peer) loopbackHub() *LoopbackHub {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.loopback
+}
+
+// processFrameFromLoopback answers through the hub, the routers are used if the caller has left it
+func (c *Peer) processFrameFromLoopback(hub *LoopbackHub, frame []byte) {
+	if c.frameDeduplicator.Seen(frame) {
+		return
+	}
+	responses := c.processFrame("loopback", frame)
+	for _, f := range responses {
+		if hub.send(f) != nil {
+			c.sendFrame(c.Network(), f)
+		}
+	}
+}
+
+// RemotePeerTransportLoopback delivers frames to the peer of the same process
+type RemotePeerTransportLoopback struct {
+	remotePeer *RemotePeer
+}
+
+func NewRemotePeerTransportLoopback(remotePeer *RemotePeer) *RemotePeerTransportLoopback {
+	var c RemotePeerTransportLoopback
+	c.remotePeer = remotePeer
+	return &c
+}
+
+func (c *RemotePeerTransportLoopback) Id() string {
+	return "loopback"
+}
+
+func (c *RemotePeerTransportLoopback) hub() *LoopbackHub {
+	localPeer := c.remotePeer.LocalPeer()
+	if localPeer == nil {
+		return nil
+	}
+	return localPeer.loopbackHub()
+}
+
+// Check passes if the remote peer is registered in the hub, the public key is requested through the hub
+func (c *RemotePeerTransportLoopback) Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) error {
+	hub := c.hub()
+	if hub == nil || hub.peer(hex.EncodeToString(c.remotePeer.RemoteAddress())) == nil {
+		return errors.New(ERR_XCHG_PEER_LOOPBACK_NOT_FOUND)
+	}
+	if frame20 != nil && !remotePublicKeyExists {
+		return hub.send(frame20)
+	}
+	return nil
+}
+
+// DeclareError is not needed: the delivery either fails in Send or never does
+func (c *RemotePeerTransportLoopback) DeclareError(sentViaTransportMap map[string]struct{}) {
+}
+
+func (c *RemotePeerTransportLoopback) Send(network *Network, tr *Transaction) error {
+	hub := c.hub()
+	if hub == nil {
+		return errors.New(ERR_XCHG_PEER_LOOPBACK_NOT_FOUND)
+	}
+	return hub.send(tr)
+}
+
+func (c *RemotePeerTransportLoopback) SetRemoteUDPAddress(udpAddress *net.UDPAddr) {
+}
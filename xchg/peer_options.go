@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"time"
+
+	xchgrouter "github.com/xchgn/xchg/router"
+)
+
+type PeerOptions struct {
+	// A new key is generated if it is nil
+	PrivateKey ed25519.PrivateKey
+
+	// RouterEnabled starts the embedded router.
+	// The peers of the process share one router per listen address, the options of the first peer are used.
+	RouterEnabled bool
+	RouterOptions xchgrouter.RouterOptions
+
+	// LoopbackHub connects the peers of the process directly, nil disables it
+	LoopbackHub *LoopbackHub
+
+	// Routers of the network, the embedded router is used if the list is empty
+	Routers []*RouterInfo
+
+	// HttpTimeout of the router requests, LongPollingDelay of the mailbox reads
+	HttpTimeout      time.Duration
+	LongPollingDelay time.Duration
+
+	// Clock of the session expiry, the system clock is used if it is nil
+	Clock Clock
+
+	// Created by the peer if they are nil
+	Logger         Logger
+	HttpClient     *http.Client
+	HttpClientLong *http.Client
+}
+
+// DefaultPeerOptions starts the embedded router on the default ports and joins DefaultLoopbackHub
+func DefaultPeerOptions() PeerOptions {
+	var options PeerOptions
+	options.LoopbackHub = DefaultLoopbackHub
+	options.RouterEnabled = true
+	options.RouterOptions = xchgrouter.DefaultRouterOptions()
+	options.HttpTimeout = XchgHttpTimeout
+	options.LongPollingDelay = XchgLongPollingDelay
+	return options
+}
+
+// Clock is the time source of the sessions, the tests replace it
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -23,6 +23,8 @@
 package xchg
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"time"
@@ -44,10 +46,20 @@ func (c *Peer) processFrame(routerHost string, frame []byte) (responseFrames []*
 		responseFrames = c.processFrameCallRequest(routerHost, frame)
 	case XchgFrameCallResponse:
 		c.processFrameCallResponse(routerHost, frame)
+	case XchgFrameCancelRequest:
+		c.processFrameCancelRequest(frame)
+	case XchgFrameAck:
+		c.processFrameAck(frame)
+	case XchgFrameNack:
+		responseFrames = c.processFrameNack(frame)
 	case XchgFrameGetPublicKeyRequest:
 		responseFrames = c.processFrameGetPublicKeyRequest(frame)
 	case XchgFrameGetPublicKeyResponse:
 		c.processFrameGetPublicKeyResponse(routerHost, frame)
+	case XchgFrameUdpEndpointOffer:
+		responseFrames = c.processFrameUdpEndpointOffer(frame)
+	case XchgFrameUdpEndpointAnswer:
+		c.processFrameUdpEndpointAnswer(frame)
 	}
 
 	return
@@ -94,6 +106,7 @@ func (c *Peer) processFrameCallRequest(routerHost string, frame []byte) (respons
 	}
 
 	incomingTransaction.AppendReceivedData(transaction)
+	incomingTransaction.LastReceivedDT = time.Now()
 
 	if incomingTransaction.Complete {
 		incomingTransaction.Data = incomingTransaction.Result
@@ -104,15 +117,34 @@ func (c *Peer) processFrameCallRequest(routerHost string, frame []byte) (respons
 	}
 
 	delete(c.incomingTransactions, incomingTransactionCode)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.runningCalls[incomingTransactionCode] = cancel
 	c.mtx.Unlock()
 
+	if incomingTransaction.TotalSize > XchgMaxFrameSize {
+		go c.ackRequest(incomingTransaction)
+	}
+
+	defer func() {
+		c.mtx.Lock()
+		delete(c.runningCalls, incomingTransactionCode)
+		c.mtx.Unlock()
+		cancel()
+	}()
+
 	srcAddress := transaction.SrcAddress[:]
 
 	//generatedLocalCheque := &Cheque{}
 
 	// fmt.Println("---", hex.EncodeToString(incomingTransaction.SrcAddress[:]))
 
-	resp, dontSendResponse := c.onEdgeReceivedCall(incomingTransaction.SessionId, incomingTransaction.Data, incomingTransaction.SrcAddress[:])
+	resp, dontSendResponse := c.onEdgeReceivedCall(ctx, incomingTransaction.SessionId, incomingTransaction.Data, incomingTransaction.SrcAddress[:])
+
+	// The caller has gone away
+	if ctx.Err() != nil {
+		dontSendResponse = true
+	}
+
 	if !dontSendResponse {
 		trResponse := NewTransaction(0x11,
 			publicKey,
@@ -148,6 +180,11 @@ func (c *Peer) processFrameCallRequest(routerHost string, frame []byte) (respons
 			responseFrames = append(responseFrames, blockTransaction)
 			offset += currentBlockSize
 		}
+
+		if len(responseFrames) > 1 {
+			trResponse.FromLocalNode = incomingTransaction.FromLocalNode
+			c.cacheResponse(incomingTransactionCode, trResponse)
+		}
 	}
 	return
 }
@@ -158,20 +195,45 @@ func (c *Peer) processFrameCallResponse(routerHost string, frame []byte) {
 		return
 	}
 
-	var remotePeer *RemotePeer
 	// Find the peer in local remote peers collection
+	remotePeer := c.remotePeerByAddress(tr.SrcAddress[:])
+	if remotePeer != nil {
+		remotePeer.processFrame(routerHost, frame)
+	}
+}
+
+// Cancel Request
+// This frame received by server
+// The caller does not wait for the response anymore
+func (c *Peer) processFrameCancelRequest(frame []byte) {
+	transaction, err := Parse(frame)
+	if err != nil {
+		return
+	}
+
 	c.mtx.Lock()
-	for _, peer := range c.remotePeers {
+	session, ok := c.sessionsById[transaction.SessionId]
+	c.mtx.Unlock()
+	if !ok || session == nil {
+		return
+	}
 
-		srcAddress := tr.SrcAddress[:]
-		if hex.EncodeToString(peer.RemoteAddress()) == hex.EncodeToString(srcAddress) {
-			remotePeer = peer
-			break
-		}
+	// Only the owner of the session can cancel the call
+	transactionIdBS, err := utils.DecryptAESGCM(transaction.Data, session.aesKey)
+	if err != nil || len(transactionIdBS) != 8 {
+		return
 	}
+	if binary.LittleEndian.Uint64(transactionIdBS) != transaction.TransactionId {
+		return
+	}
+
+	incomingTransactionCode := fmt.Sprint(transaction.SrcAddress, "-", transaction.TransactionId)
+	c.mtx.Lock()
+	delete(c.incomingTransactions, incomingTransactionCode)
+	cancel, ok := c.runningCalls[incomingTransactionCode]
 	c.mtx.Unlock()
-	if remotePeer != nil {
-		remotePeer.processFrame(routerHost, frame)
+	if ok {
+		cancel()
 	}
 }
 
@@ -1,29 +1,51 @@
 package xchg
 
 import (
+	"context"
 	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"fmt"
-)
 
-func (c *Peer) getFramesFromRouters() {
-	c.mtx.Lock()
-	network := c.network
-	c.mtx.Unlock()
+	xchgrouter "github.com/xchgn/xchg/router"
+	"github.com/xchgn/xchg/utils"
+)
 
+// receiveFromRouter reads the mailbox by the best transport of the router
+func (c *Peer) receiveFromRouter(ctx context.Context, addr string) (err error) {
+	network := c.Network()
 	if network == nil {
+		err = errors.New(ERR_XCHG_NETWORK_NO_ROUTERS)
 		return
 	}
 
-	addr := network.GetRouterAddr(hex.EncodeToString(c.Address()))
-	c.getFramesFromRouter(addr)
+	if network.GetRouterTcpAddr(addr) != "" {
+		err = c.getFramesFromRouterTcp(ctx, addr)
+		if ctx.Err() == nil {
+			c.reportRouter(addr, 0, err)
+		}
+		return
+	}
+	if c.routerWSAllowed(addr) {
+		var connected bool
+		connected, err = c.getFramesFromRouterWS(ctx, addr)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			c.reportRouter(addr, 0, err)
+			return
+		}
+		c.declareRouterWSFailed(addr)
+	}
+	return c.getFramesFromRouter(ctx, addr)
 }
 
-func (c *Peer) getFramesFromRouter(router string) {
+func (c *Peer) getFramesFromRouter(ctx context.Context, router string) (err error) {
 	c.mtx.Lock()
 	processing := c.gettingFromInternet[router]
 	c.mtx.Unlock()
 	if processing {
+		err = errors.New("already receiving")
 		return
 	}
 	c.mtx.Lock()
@@ -42,31 +64,57 @@ func (c *Peer) getFramesFromRouter(router string) {
 	{
 		c.mtx.Lock()
 		fromMessageId := c.lastReceivedMessageId[router]
+		nonce := c.routerNonces[router]
 		c.mtx.Unlock()
-		getMessageRequest := make([]byte, 8+8+32)
+
+		if len(nonce) != xchgrouter.NONCE_SIZE {
+			nonce, err = c.httpCallContext(ctx, c.httpClient, router, "n", nil)
+			if err != nil || len(nonce) != xchgrouter.NONCE_SIZE {
+				if err == nil {
+					err = errors.New(ERR_XCHG_PEER_ROUTER_NONCE)
+				}
+				return
+			}
+		}
+
+		// Only the owner of the private key can read the mailbox
+		getMessageRequest := make([]byte, xchgrouter.READ_REQUEST_SIZE)
 		binary.LittleEndian.PutUint64(getMessageRequest[0:], fromMessageId)
 		binary.LittleEndian.PutUint64(getMessageRequest[8:], 10*1024*1024)
 		copy(getMessageRequest[16:], c.localAddressBS)
+		copy(getMessageRequest[48:], nonce)
+		copy(getMessageRequest[48+xchgrouter.NONCE_SIZE:], utils.SignMessage(c.privateKey, getMessageRequest[:48+xchgrouter.NONCE_SIZE]))
 		//logger.Println("GETTING .......................", hex.EncodeToString(c.Address())[:8])
-		res, err := c.httpCall(c.httpClientLong, router, "r", getMessageRequest)
+		var res []byte
+		res, err = c.httpCallContext(ctx, c.httpClientLong, router, "r", getMessageRequest)
 		//logger.Println("GETTING .......................OK", hex.EncodeToString(c.Address())[:8])
+
+		// The nonce is used, the next one comes with the response
+		c.mtx.Lock()
+		delete(c.routerNonces, router)
+		c.mtx.Unlock()
+
 		if err != nil {
-			fmt.Println("HTTP Error: ", err)
+			if ctx.Err() == nil {
+				fmt.Println("HTTP Error: ", err)
+			}
 			return
 		}
 
-		if len(res) >= 8 {
+		if len(res) >= xchgrouter.READ_RESPONSE_HEADER_SIZE {
 			lastReceivedMessageId := binary.LittleEndian.Uint64(res[0:])
 			c.mtx.Lock()
 			c.lastReceivedMessageId[router] = lastReceivedMessageId
+			c.routerNonces[router] = res[8:xchgrouter.READ_RESPONSE_HEADER_SIZE]
 			c.mtx.Unlock()
-			go c.processFramesFromInternet(res, router)
+			go c.processFramesFromInternet(res[xchgrouter.READ_RESPONSE_HEADER_SIZE:], router)
 		}
 	}
+	return
 }
 
 func (c *Peer) processFramesFromInternet(res []byte, router string) {
-	offset := 8
+	offset := 0
 
 	//fmt.Println("processFramesFromInternet", res)
 
@@ -81,6 +129,16 @@ func (c *Peer) processFramesFromInternet(res []byte, router string) {
 			if offset+frameLen <= len(res) {
 				framesCount++
 				//logger.Println("RCV:", utils.TransactionSummary(res[offset:offset+frameLen]))
+				if c.frameDeduplicator.Seen(res[offset : offset+frameLen]) {
+					offset += frameLen
+					continue
+				}
+				// The handler of the call may wait (stream reads), the rest of the frames must not
+				if res[offset+4] == XchgFrameCallRequest {
+					go c.processCallFromInternet(router, res[offset:offset+frameLen])
+					offset += frameLen
+					continue
+				}
 				responseFrames := c.processFrame(router, res[offset:offset+frameLen])
 				responses = append(responses, responseFrames...)
 				responsesCount += len(responseFrames)
@@ -94,10 +152,19 @@ func (c *Peer) processFramesFromInternet(res []byte, router string) {
 	}
 
 	if len(responses) > 0 {
+		network := c.Network()
+		for _, f := range responses {
+			go c.sendFrame(network, f)
+		}
+	}
+}
+
+func (c *Peer) processCallFromInternet(router string, frame []byte) {
+	responses := c.processFrame(router, frame)
+	if len(responses) > 0 {
+		network := c.Network()
 		for _, f := range responses {
-			addr := c.network.GetRouterAddr(f.DestAddressString())
-			frame := f.Marshal()
-			go c.httpCall(c.httpClient, addr, "w", frame)
+			c.sendFrame(network, f)
 		}
 	}
 }
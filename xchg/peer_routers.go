@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"errors"
+)
+
+type criticalCallKey struct{}
+
+// WithCriticalCall marks the calls of the context: their frames are sent through all routers of the destination
+func WithCriticalCall(ctx context.Context) context.Context {
+	return context.WithValue(ctx, criticalCallKey{}, true)
+}
+
+func IsCriticalCall(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	critical, _ := ctx.Value(criticalCallKey{}).(bool)
+	return critical
+}
+
+// homeRouters returns the routers keeping the mailbox of the peer
+func (c *Peer) homeRouters(network *Network) []string {
+	return network.GetHomeRouterAddrs(c.AddressHex())
+}
+
+// sendFrame sends the frame to the healthiest router of the destination and fails over to the next one.
+// Critical frames go to all routers, the receiver drops the copies.
+// router is the one that accepted the frame, the first one for the critical frames.
+func (c *Peer) sendFrame(network *Network, tr *Transaction) (router string, err error) {
+	if network == nil {
+		err = errors.New(ERR_XCHG_NETWORK_NO_ROUTERS)
+		return
+	}
+	routers := c.routersFor(network, tr.DestAddressString())
+	frame := tr.Marshal()
+
+	if tr.Critical {
+		for _, r := range routers {
+			if sendErr := c.sendToRouter(r, frame); sendErr != nil {
+				err = sendErr
+				continue
+			}
+			if router == "" {
+				router = r
+			}
+		}
+		if router != "" {
+			err = nil
+		}
+		return
+	}
+
+	for _, r := range routers {
+		err = c.sendToRouter(r, frame)
+		if err == nil {
+			router = r
+			return
+		}
+	}
+	return
+}
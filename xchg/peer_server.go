@@ -23,11 +23,11 @@
 package xchg
 
 import (
+	"context"
 	"crypto/ed25519"
 	"encoding/binary"
 	"errors"
 	"log"
-	"time"
 
 	"github.com/xchgn/xchg/utils"
 )
@@ -36,7 +36,7 @@ const (
 	INTERNAL_ERROR = "#internal_error#"
 )
 
-func (c *Peer) onEdgeReceivedCall(sessionId uint64, data []byte, remoteRealPublicKey ed25519.PublicKey) (response []byte, dontSendResponse bool) {
+func (c *Peer) onEdgeReceivedCall(ctx context.Context, sessionId uint64, data []byte, remoteRealPublicKey ed25519.PublicKey) (response []byte, dontSendResponse bool) {
 
 	var err error
 	// Find the session
@@ -80,7 +80,9 @@ func (c *Peer) onEdgeReceivedCall(sessionId uint64, data []byte, remoteRealPubli
 			return
 		}
 		data = data[8:]
-		session.lastAccessDT = time.Now()
+		c.mtx.Lock()
+		session.lastAccessDT = c.clock.Now()
+		c.mtx.Unlock()
 	} else {
 		if len(data) < 1 {
 			response = prepareResponseError(errors.New(ERR_XCHG_SRV_CONN_WRONG_LEN1))
@@ -109,12 +111,10 @@ func (c *Peer) onEdgeReceivedCall(sessionId uint64, data []byte, remoteRealPubli
 			nonce := c.authNonces.Next()
 			resp = nonce[:]
 		case "/xchg-auth":
-			resp, err = c.processAuth(functionParameter, remoteRealPublicKey)
-			if err != nil {
-				if err.Error() == INTERNAL_ERROR {
-					dontSendResponse = true
-					return
-				}
+			// The rejection of the auth handler is sent to the caller, the broken requests are not answered
+			resp, err = c.processAuth(ctx, functionParameter, remoteRealPublicKey)
+			if err != nil && err.Error() == INTERNAL_ERROR {
+				dontSendResponse = true
 				return
 			}
 		}
@@ -124,12 +124,28 @@ func (c *Peer) onEdgeReceivedCall(sessionId uint64, data []byte, remoteRealPubli
 			authData = session.authData
 		}
 		var p Param
+		p.Context = ctx
 		p.AuthData = authData
 		p.Function = function
 		p.Parameter = functionParameter
 		p.LocalPeer = c
+		p.SessionId = sessionId
 		p.RemoteAddress = session.remoteRealPublicKey
-		resp, err = callFunc(&p)
+		if callFunc == nil {
+			callFunc = func(param *Param) ([]byte, error) {
+				return nil, &FunctionNotFoundError{Function: param.Function}
+			}
+		}
+		// The built-in functions pass the middlewares too
+		handler := callFunc
+		if function == FunctionDescribe {
+			handler = func(param *Param) ([]byte, error) {
+				return c.describe()
+			}
+		} else if isStreamFunction(function) {
+			handler = c.processStreamCall
+		}
+		resp, err = c.handlerWithMiddlewares(handler)(&p)
 	}
 
 	if err != nil {
@@ -149,7 +165,7 @@ func (c *Peer) onEdgeReceivedCall(sessionId uint64, data []byte, remoteRealPubli
 	return
 }
 
-func (c *Peer) processAuth(functionParameter []byte, remoteRealPublicKey ed25519.PublicKey) (response []byte, err error) {
+func (c *Peer) processAuth(ctx context.Context, functionParameter []byte, remoteRealPublicKey ed25519.PublicKey) (response []byte, err error) {
 	if len(functionParameter) < XchgPublicKeySize {
 		err = errors.New(INTERNAL_ERROR)
 		return
@@ -178,15 +194,20 @@ func (c *Peer) processAuth(functionParameter []byte, remoteRealPublicKey ed25519
 
 	authData := parameter[XchgNonceSize:]
 
+	c.mtx.Lock()
 	callbackFunc := c.Callback
+	c.mtx.Unlock()
 
-	var p Param
-	p.LocalPeer = c
-	p.RemoteAddress = remoteRealPublicKey
-	p.AuthData = authData
-	_, err = callbackFunc(&p)
-	if err != nil {
-		return
+	if callbackFunc != nil {
+		var p Param
+		p.Context = ctx
+		p.LocalPeer = c
+		p.RemoteAddress = remoteRealPublicKey
+		p.AuthData = authData
+		_, err = c.handlerWithMiddlewares(callbackFunc)(&p)
+		if err != nil {
+			return
+		}
 	}
 
 	c.mtx.Lock()
@@ -195,9 +216,9 @@ func (c *Peer) processAuth(functionParameter []byte, remoteRealPublicKey ed25519
 	c.nextSessionId++
 	session := &Session{}
 	session.id = sessionId
-	session.lastAccessDT = time.Now()
+	session.lastAccessDT = c.clock.Now()
 	session.aesKey = aesKey
-	session.snakeCounter = NewSnakeCounter(100, 0)
+	session.snakeCounter = NewSnakeCounter(XchgSessionCounterWindow, 0)
 	session.authData = authData
 	session.remoteRealPublicKey = remoteRealPublicKey
 	c.sessionsById[sessionId] = session
@@ -211,10 +232,11 @@ func (c *Peer) processAuth(functionParameter []byte, remoteRealPublicKey ed25519
 	return
 }
 
-func (c *Peer) purgeSessions() {
+// PurgeSessions removes the sessions idle for 60 seconds and the idle streams, the peer calls it every 5 seconds
+func (c *Peer) PurgeSessions() {
 	c.logger.Println("Peer::purgeSessions")
 
-	now := time.Now()
+	now := c.clock.Now()
 	c.mtx.Lock()
 	if now.Sub(c.lastPurgeSessionsTime).Seconds() > 60 {
 		for sessionId, session := range c.sessionsById {
@@ -223,9 +245,11 @@ func (c *Peer) purgeSessions() {
 				log.Println("Session removed", sessionId)
 			}
 		}
-		c.lastPurgeSessionsTime = time.Now()
+		c.lastPurgeSessionsTime = now
 	}
 	c.mtx.Unlock()
+
+	c.purgeStreams()
 }
 
 func prepareResponseError(err error) []byte {
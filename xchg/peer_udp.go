@@ -0,0 +1,468 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+
+	xchgrouter "github.com/xchgn/xchg/router"
+	"github.com/xchgn/xchg/utils"
+)
+
+// udpPeer is the direct UDP path to the remote peer
+type udpPeer struct {
+	endpoint    *net.UDPAddr // signed by the remote peer
+	confirmedDT time.Time    // the last packet from the endpoint
+	offeredDT   time.Time    // the last offer of our endpoint
+	lan         bool         // found by the LAN ARP request
+}
+
+// startUdp opens the socket for the direct delivery, the errors only disable it
+func (c *Peer) startUdp(ctx context.Context) {
+	c.mtx.Lock()
+	enabled := c.udpEnabled
+	c.mtx.Unlock()
+	if !enabled {
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		c.logger.Println("UDP is disabled:", err)
+		return
+	}
+	conn.SetReadBuffer(XchgUdpSocketBufferSize)
+	conn.SetWriteBuffer(XchgUdpSocketBufferSize)
+
+	c.mtx.Lock()
+	c.udpConn = conn
+	c.mtx.Unlock()
+
+	go c.thUdpReceive(ctx, conn)
+	c.udpRequestEndpoint()
+	c.startLan(ctx)
+}
+
+func (c *Peer) stopUdp() {
+	c.stopLan()
+
+	c.mtx.Lock()
+	conn := c.udpConn
+	c.udpConn = nil
+	c.udpEndpoint = nil
+	c.udpPeers = make(map[string]*udpPeer)
+	c.mtx.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// SetDirectUdp enables the direct UDP delivery (default). It takes effect on Start.
+func (c *Peer) SetDirectUdp(enabled bool) {
+	c.mtx.Lock()
+	c.udpEnabled = enabled
+	c.mtx.Unlock()
+}
+
+// UdpEndpoint returns the public endpoint of the UDP socket observed by the home router
+func (c *Peer) UdpEndpoint() *net.UDPAddr {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.udpEndpoint
+}
+
+// udpRequestEndpoint asks the home router for the observed endpoint, it also keeps the NAT mapping
+func (c *Peer) udpRequestEndpoint() {
+	c.mtx.Lock()
+	conn := c.udpConn
+	network := c.network
+	c.mtx.Unlock()
+	if conn == nil || network == nil {
+		return
+	}
+
+	routerUdpAddr, err := net.ResolveUDPAddr("udp", network.GetRouterUdpAddr(c.homeRouters(network)[0]))
+	if err != nil {
+		return
+	}
+	c.mtx.Lock()
+	c.udpRouterAddr = routerUdpAddr
+	c.mtx.Unlock()
+	conn.WriteToUDP(xchgrouter.MakeStreamFrame(xchgrouter.UDP_FRAME_ENDPOINT_REQUEST, nil), routerUdpAddr)
+}
+
+// udpKeepAlive refreshes the endpoint and the holes to the confirmed peers
+func (c *Peer) udpKeepAlive() {
+	c.udpRequestEndpoint()
+
+	c.mtx.Lock()
+	conn := c.udpConn
+	endpoints := make([]*net.UDPAddr, 0)
+	for address, p := range c.udpPeers {
+		if time.Since(p.confirmedDT) < XchgUdpPeerTimeout {
+			endpoints = append(endpoints, p.endpoint)
+		} else if time.Since(p.offeredDT) > XchgUdpPeerTimeout {
+			delete(c.udpPeers, address)
+		}
+	}
+	c.mtx.Unlock()
+
+	if conn == nil {
+		return
+	}
+	punch := c.udpPunchFrame()
+	for _, endpoint := range endpoints {
+		conn.WriteToUDP(punch, endpoint)
+	}
+}
+
+// Punch: [len 4][0x0E][reserved 3][src address 32]
+func (c *Peer) udpPunchFrame() []byte {
+	return xchgrouter.MakeStreamFrame(XchgFrameUdpPunch, c.localAddressBS)
+}
+
+func (c *Peer) udpPunch(endpoint *net.UDPAddr) {
+	c.mtx.Lock()
+	conn := c.udpConn
+	c.mtx.Unlock()
+	if conn != nil && endpoint != nil {
+		conn.WriteToUDP(c.udpPunchFrame(), endpoint)
+	}
+}
+
+func (c *Peer) thUdpReceive(ctx context.Context, conn *net.UDPConn) {
+	buffer := make([]byte, 64*1024)
+	for ctx.Err() == nil {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if n < xchgrouter.TCP_FRAME_HEADER_SIZE || int(binary.LittleEndian.Uint32(buffer)) != n {
+			continue
+		}
+		frame := make([]byte, n)
+		copy(frame, buffer[:n])
+
+		switch frame[4] {
+		case xchgrouter.UDP_FRAME_ENDPOINT_RESPONSE:
+			c.processUdpEndpointResponse(addr, frame)
+		case XchgFrameLanArpResponse:
+			c.processFrameLanArpResponse(addr, frame)
+		case XchgFrameUdpPunch:
+			if len(frame) == xchgrouter.TCP_FRAME_HEADER_SIZE+XchgAddressSize {
+				if c.udpConfirm(hex.EncodeToString(frame[xchgrouter.TCP_FRAME_HEADER_SIZE:]), addr) {
+					// The first punch of the remote peer - answer to open our side
+					c.udpPunch(addr)
+				}
+			}
+		default:
+			if len(frame) < TransactionHeaderSize {
+				continue
+			}
+			c.udpConfirm(hex.EncodeToString(frame[32:64]), addr)
+			if c.frameDeduplicator.Seen(frame) {
+				continue
+			}
+			go c.processFrameFromUdp(frame)
+		}
+	}
+}
+
+// processFrameFromUdp answers over UDP only to the confirmed endpoint of the peer,
+// the source of the datagram may be spoofed, so the other answers go through the routers
+func (c *Peer) processFrameFromUdp(frame []byte) {
+	responses := c.processFrame("udp", frame)
+	for _, f := range responses {
+		if c.sendUdp(f) != nil {
+			c.sendFrame(c.Network(), f)
+		}
+	}
+}
+
+func (c *Peer) processUdpEndpointResponse(addr *net.UDPAddr, frame []byte) {
+	c.mtx.Lock()
+	routerUdpAddr := c.udpRouterAddr
+	c.mtx.Unlock()
+	if routerUdpAddr == nil || !routerUdpAddr.IP.Equal(addr.IP) || routerUdpAddr.Port != addr.Port {
+		return
+	}
+	endpoint, err := xchgrouter.ParseUdpEndpointResponse(frame)
+	if err != nil {
+		return
+	}
+	c.mtx.Lock()
+	c.udpEndpoint = endpoint
+	c.mtx.Unlock()
+}
+
+// udpConfirm marks the path as working if the packet comes from the endpoint signed by the peer.
+// Returns true for the first confirmation.
+func (c *Peer) udpConfirm(address string, addr *net.UDPAddr) (first bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	p, ok := c.udpPeers[address]
+	if !ok || p.endpoint == nil || !p.endpoint.IP.Equal(addr.IP) || p.endpoint.Port != addr.Port {
+		return
+	}
+	first = time.Since(p.confirmedDT) >= XchgUdpPeerTimeout
+	p.confirmedDT = time.Now()
+	return
+}
+
+func (c *Peer) udpUnconfirm(address string) {
+	c.mtx.Lock()
+	if p, ok := c.udpPeers[address]; ok {
+		p.confirmedDT = time.Time{}
+	}
+	c.mtx.Unlock()
+}
+
+// udpConfirmedEndpoint returns the endpoint of the peer if the direct path works
+func (c *Peer) udpConfirmedEndpoint(address string) *net.UDPAddr {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.udpConn == nil {
+		return nil
+	}
+	p, ok := c.udpPeers[address]
+	if !ok || time.Since(p.confirmedDT) >= XchgUdpPeerTimeout {
+		return nil
+	}
+	return p.endpoint
+}
+
+// setUdpPeerEndpoint accepts the endpoint of the remote peer and punches the hole to it
+func (c *Peer) setUdpPeerEndpoint(address string, endpoint *net.UDPAddr) {
+	c.mtx.Lock()
+	p, ok := c.udpPeers[address]
+	if !ok {
+		p = &udpPeer{}
+		c.udpPeers[address] = p
+	}
+	if p.endpoint == nil || !p.endpoint.IP.Equal(endpoint.IP) || p.endpoint.Port != endpoint.Port {
+		p.endpoint = endpoint
+		p.confirmedDT = time.Time{}
+	}
+	c.mtx.Unlock()
+	c.udpPunch(endpoint)
+}
+
+// sendUdp delivers the transaction directly to the confirmed endpoint
+func (c *Peer) sendUdp(tr *Transaction) (err error) {
+	endpoint := c.udpConfirmedEndpoint(tr.DestAddressString())
+	if endpoint == nil {
+		err = errors.New(ERR_XCHG_PEER_UDP_NOT_CONFIRMED)
+		return
+	}
+	return c.sendUdpTo(tr, endpoint)
+}
+
+// sendUdpTo splits the data into datagrams
+func (c *Peer) sendUdpTo(tr *Transaction, endpoint *net.UDPAddr) (err error) {
+	c.mtx.Lock()
+	conn := c.udpConn
+	c.mtx.Unlock()
+	if conn == nil {
+		err = errors.New(ERR_XCHG_PEER_UDP_NOT_CONFIRMED)
+		return
+	}
+
+	if len(tr.Data) <= XchgUdpMaxDataSize {
+		_, err = conn.WriteToUDP(tr.Marshal(), endpoint)
+		return
+	}
+
+	for offset := 0; offset < len(tr.Data); offset += XchgUdpMaxDataSize {
+		end := offset + XchgUdpMaxDataSize
+		if end > len(tr.Data) {
+			end = len(tr.Data)
+		}
+		block := NewTransaction(tr.FrameType, tr.SrcAddress[:], tr.DestAddress[:], tr.TransactionId, tr.SessionId, int(tr.Offset)+offset, int(tr.TotalSize), tr.Data[offset:end])
+		block.Comment = tr.Comment
+		_, err = conn.WriteToUDP(block.Marshal(), endpoint)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Endpoint offer and answer: [ip 16][port 2][signature 64], the signature covers [src 32][dest 32][ip 16][port 2]
+func (c *Peer) makeUdpEndpointFrame(frameType byte, destAddress []byte, endpoint *net.UDPAddr) *Transaction {
+	data := make([]byte, 18+64)
+	copy(data, endpoint.IP.To16())
+	binary.LittleEndian.PutUint16(data[16:], uint16(endpoint.Port))
+	tr := NewTransaction(frameType, c.localAddressBS, destAddress, 0, 0, 0, 0, nil)
+	copy(data[18:], utils.SignMessage(c.privateKey, udpEndpointSignedData(tr.SrcAddress[:], tr.DestAddress[:], data[:18])))
+	tr.Data = data
+	return tr
+}
+
+func udpEndpointSignedData(srcAddress []byte, destAddress []byte, endpoint []byte) []byte {
+	signed := make([]byte, 0, 32+32+18)
+	signed = append(signed, srcAddress...)
+	signed = append(signed, destAddress...)
+	signed = append(signed, endpoint...)
+	return signed
+}
+
+func parseUdpEndpointFrame(tr *Transaction) (endpoint *net.UDPAddr, err error) {
+	if len(tr.Data) != 18+64 {
+		err = errors.New(ERR_XCHG_PEER_UDP_WRONG_ENDPOINT)
+		return
+	}
+	if !utils.VerifySignature(tr.SrcAddress[:], udpEndpointSignedData(tr.SrcAddress[:], tr.DestAddress[:], tr.Data[:18]), tr.Data[18:]) {
+		err = errors.New(ERR_XCHG_PEER_UDP_WRONG_ENDPOINT)
+		return
+	}
+	ip := make(net.IP, 16)
+	copy(ip, tr.Data)
+	endpoint = &net.UDPAddr{IP: ip, Port: int(binary.LittleEndian.Uint16(tr.Data[16:]))}
+	return
+}
+
+// sendUdpOffer sends our endpoint to the remote peer through the router
+func (c *Peer) sendUdpOffer(network *Network, remoteAddress []byte) (err error) {
+	endpoint := c.UdpEndpoint()
+	if endpoint == nil {
+		c.mtx.Lock()
+		requestEndpoint := time.Since(c.udpEndpointRequestDT) > XchgUdpOfferInterval
+		if requestEndpoint {
+			c.udpEndpointRequestDT = time.Now()
+		}
+		c.mtx.Unlock()
+		if requestEndpoint {
+			c.udpRequestEndpoint()
+		}
+		err = errors.New(ERR_XCHG_PEER_UDP_NO_ENDPOINT)
+		return
+	}
+
+	address := hex.EncodeToString(remoteAddress)
+	c.mtx.Lock()
+	p, ok := c.udpPeers[address]
+	if !ok {
+		p = &udpPeer{}
+		c.udpPeers[address] = p
+	}
+	if time.Since(p.offeredDT) < XchgUdpOfferInterval {
+		c.mtx.Unlock()
+		return
+	}
+	p.offeredDT = time.Now()
+	c.mtx.Unlock()
+
+	offer := c.makeUdpEndpointFrame(XchgFrameUdpEndpointOffer, remoteAddress, endpoint)
+	c.sendFrame(network, offer)
+	return
+}
+
+// processFrameUdpEndpointOffer answers with our endpoint and punches the hole to the caller
+func (c *Peer) processFrameUdpEndpointOffer(frame []byte) (responseFrames []*Transaction) {
+	tr, err := Parse(frame)
+	if err != nil {
+		return
+	}
+	remoteEndpoint, err := parseUdpEndpointFrame(tr)
+	if err != nil {
+		return
+	}
+	endpoint := c.UdpEndpoint()
+	if endpoint == nil {
+		return
+	}
+	c.setUdpPeerEndpoint(tr.SrcAddressString(), remoteEndpoint)
+	responseFrames = append(responseFrames, c.makeUdpEndpointFrame(XchgFrameUdpEndpointAnswer, tr.SrcAddress[:], endpoint))
+	return
+}
+
+func (c *Peer) processFrameUdpEndpointAnswer(frame []byte) {
+	tr, err := Parse(frame)
+	if err != nil {
+		return
+	}
+	remoteEndpoint, err := parseUdpEndpointFrame(tr)
+	if err != nil {
+		return
+	}
+	c.setUdpPeerEndpoint(tr.SrcAddressString(), remoteEndpoint)
+}
+
+// RemotePeerTransportUdp delivers frames directly to the endpoint exchanged through the routers
+type RemotePeerTransportUdp struct {
+	TransportFailures
+	remotePeer *RemotePeer
+}
+
+func NewRemotePeerTransportUdp(remotePeer *RemotePeer) *RemotePeerTransportUdp {
+	var c RemotePeerTransportUdp
+	c.remotePeer = remotePeer
+	return &c
+}
+
+func (c *RemotePeerTransportUdp) Id() string {
+	return "udp"
+}
+
+// Check offers our endpoint to the remote peer until the direct path is confirmed
+func (c *RemotePeerTransportUdp) Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) error {
+	localPeer := c.remotePeer.LocalPeer()
+	if localPeer == nil || c.Failed() {
+		return errors.New(ERR_XCHG_PEER_UDP_NOT_CONFIRMED)
+	}
+	if localPeer.udpConfirmedEndpoint(hex.EncodeToString(c.remotePeer.RemoteAddress())) != nil {
+		return nil
+	}
+	localPeer.sendUdpOffer(network, c.remotePeer.RemoteAddress())
+	return errors.New(ERR_XCHG_PEER_UDP_NOT_CONFIRMED)
+}
+
+func (c *RemotePeerTransportUdp) DeclareError(sentViaTransportMap map[string]struct{}) {
+	if _, ok := sentViaTransportMap[c.Id()]; !ok {
+		return
+	}
+	c.DeclareFailure()
+	if localPeer := c.remotePeer.LocalPeer(); localPeer != nil {
+		localPeer.udpUnconfirm(hex.EncodeToString(c.remotePeer.RemoteAddress()))
+	}
+}
+
+func (c *RemotePeerTransportUdp) Send(network *Network, tr *Transaction) error {
+	localPeer := c.remotePeer.LocalPeer()
+	if localPeer == nil {
+		return errors.New(ERR_XCHG_PEER_UDP_NOT_CONFIRMED)
+	}
+	return localPeer.sendUdp(tr)
+}
+
+// SetRemoteUDPAddress sets the known endpoint of the remote peer, e.g. a static one
+func (c *RemotePeerTransportUdp) SetRemoteUDPAddress(udpAddress *net.UDPAddr) {
+	if localPeer := c.remotePeer.LocalPeer(); localPeer != nil && udpAddress != nil {
+		localPeer.setUdpPeerEndpoint(hex.EncodeToString(c.remotePeer.RemoteAddress()), udpAddress)
+	}
+}
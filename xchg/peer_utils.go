@@ -2,17 +2,37 @@ package xchg
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"time"
 )
 
 func (c *Peer) httpCall(httpClient *http.Client, routerHost string, function string, frame []byte) (result []byte, err error) {
+	return c.httpCallContext(context.Background(), httpClient, routerHost, function, frame)
+}
+
+func (c *Peer) httpCallContext(ctx context.Context, httpClient *http.Client, routerHost string, function string, frame []byte) (result []byte, err error) {
 	if len(routerHost) == 0 {
 		return
 	}
 
+	// The latency of the long polling is not measured
+	dtBegin := time.Now()
+	defer func() {
+		if ctx.Err() != nil {
+			return
+		}
+		var latency time.Duration
+		if function != "r" {
+			latency = time.Since(dtBegin)
+		}
+		c.reportRouter(routerHost, latency, err)
+	}()
+
 	var body bytes.Buffer
 	writer := multipart.NewWriter(&body)
 	{
@@ -24,7 +44,7 @@ func (c *Peer) httpCall(httpClient *http.Client, routerHost string, function str
 
 	addr := "http://" + routerHost
 
-	response, err := c.Post(httpClient, addr+"/api/"+function, writer.FormDataContentType(), &body, "https://"+addr)
+	response, err := c.post(ctx, httpClient, addr+"/api/"+function, writer.FormDataContentType(), &body)
 
 	if err != nil {
 		return
@@ -35,14 +55,22 @@ func (c *Peer) httpCall(httpClient *http.Client, routerHost string, function str
 			response.Body.Close()
 			return
 		}
-		result, err = base64.StdEncoding.DecodeString(string(content))
 		response.Body.Close()
+		if response.StatusCode == http.StatusForbidden {
+			err = errors.New(ERR_XCHG_ROUTER_ACCESS_DENIED)
+			return
+		}
+		result, err = base64.StdEncoding.DecodeString(string(content))
 	}
 	return
 }
 
 func (c *Peer) Post(httpClient *http.Client, url, contentType string, body io.Reader, host string) (resp *http.Response, err error) {
-	req, err := http.NewRequest("POST", url, body)
+	return c.post(context.Background(), httpClient, url, contentType, body)
+}
+
+func (c *Peer) post(ctx context.Context, httpClient *http.Client, url, contentType string, body io.Reader) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return nil, err
 	}
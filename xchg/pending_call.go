@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"crypto/ed25519"
+)
+
+// PendingCall is an asynchronous call started by Peer.Go
+type PendingCall struct {
+	RemoteAddress ed25519.PublicKey
+	Function      string
+	Data          []byte
+
+	Result []byte
+	Err    error
+
+	// Receives the call itself when it is complete
+	Done chan *PendingCall
+
+	complete chan struct{}
+}
+
+func (c *PendingCall) done() {
+	close(c.complete)
+	select {
+	case c.Done <- c:
+	default:
+		// The channel has no free space - the caller is responsible for the capacity
+	}
+}
+
+// Wait blocks until the call is complete. It does not read from Done.
+func (c *PendingCall) Wait() ([]byte, error) {
+	<-c.complete
+	return c.Result, c.Err
+}
+
+// Go invokes the function asynchronously. The call is sent to done when it is complete.
+// If done is nil a new channel is allocated. done must be buffered, otherwise Go panics.
+// Calls to the same remote peer share one session, concurrent calls wait for the handshake in progress.
+func (c *Peer) Go(ctx context.Context, remoteAddress ed25519.PublicKey, authData string, function string, data []byte, done chan *PendingCall) *PendingCall {
+	if done == nil {
+		done = make(chan *PendingCall, 1)
+	} else if cap(done) == 0 {
+		panic("xchg: done channel is unbuffered")
+	}
+
+	var call PendingCall
+	call.RemoteAddress = remoteAddress
+	call.Function = function
+	call.Data = data
+	call.Done = done
+	call.complete = make(chan struct{})
+
+	go func() {
+		call.Result, call.Err = c.CallContext(ctx, remoteAddress, authData, function, data)
+		call.done()
+	}()
+
+	return &call
+}
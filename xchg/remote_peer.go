@@ -24,10 +24,10 @@ package xchg
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -62,7 +62,14 @@ type RemotePeer struct {
 	privateKey ed25519.PrivateKey
 	publicKey  ed25519.PublicKey
 
-	remoteTransportPublicKey ed25519.PublicKey
+	// Frames go through the router connection of the local peer if it is set
+	localPeer *Peer
+
+	// Ordered by preference, the router transport is the last
+	transports []RemotePeerTransport
+
+	remoteTransportPublicKey         ed25519.PublicKey
+	remoteTransportPublicKeyReceived chan struct{}
 
 	// tempPrivateKey ed25519.PrivateKey
 
@@ -71,7 +78,8 @@ type RemotePeer struct {
 	httpClient *http.Client
 
 	//findingConnection    bool
-	authProcessing       bool
+	handshakeDone        chan struct{}
+	handshakeErr         error
 	aesKey               []byte
 	sessionId            uint64
 	sessionNonceCounter  uint64
@@ -88,10 +96,12 @@ func NewRemotePeer(remoteAddress ed25519.PublicKey, authData string, privateKey
 	c.outgoingTransactions = make(map[uint64]*Transaction)
 	c.nextTransactionId = 1
 	c.nonces = NewNonces(100)
+	c.remoteTransportPublicKeyReceived = make(chan struct{})
+	c.transports = []RemotePeerTransport{NewRemotePeerTransportRouter(&c)}
 
 	c.TransportPrivateKey, c.TransportPublicKey, _ = utils.GenerateCurve25519KeyPair()
 
-	tr := &http.Transport{}
+	tr := &http.Transport{MaxIdleConnsPerHost: XchgHttpMaxIdleConnsPerHost}
 	jar, _ := cookiejar.New(nil)
 	c.httpClient = &http.Client{Transport: tr, Jar: jar}
 	c.httpClient.Timeout = 1 * time.Second
@@ -103,6 +113,10 @@ func (c *RemotePeer) RemoteAddress() ed25519.PublicKey {
 	return c.remoteAddress
 }
 
+func (c *RemotePeer) LocalPeer() *Peer {
+	return c.localPeer
+}
+
 func (c *RemotePeer) processFrame(routerHost string, frame []byte) {
 	frameType := frame[4]
 
@@ -129,10 +143,11 @@ func (c *RemotePeer) processFrame11(routerHost string, frame []byte) {
 	if t, ok := c.outgoingTransactions[transaction.TransactionId]; ok {
 		if transaction.Err == nil {
 			t.AppendReceivedData(transaction)
+			t.LastReceivedDT = time.Now()
 		} else {
 			t.Result = transaction.Data
 			t.Err = transaction.Err
-			t.Complete = true
+			t.SetComplete()
 		}
 	}
 	c.mtx.Unlock()
@@ -142,56 +157,28 @@ func (c *RemotePeer) setRemoteTransportPublicKey(routerHost string, transportPub
 	_ = routerHost
 	c.mtx.Lock()
 	c.remoteTransportPublicKey = transportPublicKey
+	select {
+	case <-c.remoteTransportPublicKeyReceived:
+	default:
+		close(c.remoteTransportPublicKeyReceived)
+	}
 	c.mtx.Unlock()
 	//fmt.Println("Received Transport Public Key for", hex.EncodeToString(c.remoteAddress), ":", hex.EncodeToString(transportPublicKey))
 }
 
 func (c *RemotePeer) Call(network *Network, function string, data []byte, timeout time.Duration) (result []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.CallContext(ctx, network, function, data)
+}
+
+func (c *RemotePeer) CallContext(ctx context.Context, network *Network, function string, data []byte) (result []byte, err error) {
 	c.mtx.Lock()
 	sessionId := c.sessionId
 	c.mtx.Unlock()
 
-	if c.remoteTransportPublicKey == nil {
-		//addressBS := c.remoteAddress
-		//generatedLocalCheque := &Cheque{}
-
-		/*message := make([]byte, 32+64)
-		copy(message, c.TransportPublicKey)
-		signature := utils.SignMessage(c.privateKey, c.TransportPublicKey)
-		copy(message[32:], signature)*/
-
-		transaction := NewTransaction(XchgFrameGetPublicKeyRequest,
-			c.publicKey,
-			c.remoteAddress,
-			0,
-			0,
-			0,
-			0,
-			nil)
-		//transaction.Data = make([]byte, XchgAddressSize)
-
-		copy(transaction.Comment[:], []byte("GET_KEY"))
-
-		//copy(transaction.Data, addressBS)
-		addr := network.GetRouterAddr(hex.EncodeToString(c.remoteAddress))
-		c.httpCall(addr, "w", transaction.Marshal())
-
-		// Wait for public key for 1 second
-		for i := 0; i < 200; i++ {
-			time.Sleep(10 * time.Millisecond)
-			if c.remoteTransportPublicKey != nil {
-				break
-			}
-		}
-	}
-
-	if c.remoteTransportPublicKey == nil {
-		//logger.Println("NO PUBLIC KEY ERROR")
-		return nil, errors.New("NO remote transport public key KEY")
-	}
-
 	if sessionId == 0 {
-		err = c.auth(network, 1000*time.Millisecond)
+		err = c.handshake(ctx, network)
 		if err != nil {
 			return
 		}
@@ -202,29 +189,89 @@ func (c *RemotePeer) Call(network *Network, function string, data []byte, timeou
 	copy(aesKey, c.aesKey)
 	c.mtx.Unlock()
 
-	result, err = c.regularCall(network, function, data, aesKey, timeout)
+	result, err = c.regularCall(ctx, network, function, data, aesKey)
 
 	return
 }
 
-func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
-	c.mtx.Lock()
-	if c.authProcessing {
+// handshake gets the transport public key and opens the session.
+// Concurrent callers wait for the handshake in progress instead of starting their own.
+func (c *RemotePeer) handshake(ctx context.Context, network *Network) (err error) {
+	for {
+		c.mtx.Lock()
+		if c.sessionId != 0 {
+			c.mtx.Unlock()
+			return nil
+		}
+		done := c.handshakeDone
+		if done == nil {
+			break
+		}
 		c.mtx.Unlock()
-		err = errors.New("auth processing")
-		return
-	}
-	c.authProcessing = true
-	c.mtx.Unlock()
 
-	defer func() {
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case <-done:
+		}
+
 		c.mtx.Lock()
-		c.authProcessing = false
+		err = c.handshakeErr
 		c.mtx.Unlock()
-	}()
 
+		// The context of the leading caller is not ours - try again
+		if err != nil && !IsCancelled(err) {
+			return
+		}
+	}
+	done := make(chan struct{})
+	c.handshakeDone = done
+	c.mtx.Unlock()
+
+	err = c.getRemoteTransportPublicKey(ctx, network)
+	if err == nil {
+		authCtx, cancel := context.WithTimeout(ctx, 1000*time.Millisecond)
+		err = c.auth(authCtx, network)
+		cancel()
+	}
+
+	c.mtx.Lock()
+	c.handshakeErr = err
+	c.handshakeDone = nil
+	close(done)
+	c.mtx.Unlock()
+	return
+}
+
+func (c *RemotePeer) getRemoteTransportPublicKey(ctx context.Context, network *Network) (err error) {
+	c.mtx.Lock()
+	remoteTransportPublicKey := c.remoteTransportPublicKey
+	received := c.remoteTransportPublicKeyReceived
+	c.mtx.Unlock()
+
+	if remoteTransportPublicKey != nil {
+		return
+	}
+
+	c.checkTransports(network)
+
+	// Wait for public key for 2 seconds
+	timer := time.NewTimer(2 * time.Second)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return contextError(ctx)
+	case <-received:
+		return
+	case <-timer.C:
+	}
+
+	return errors.New("NO remote transport public key KEY")
+}
+
+func (c *RemotePeer) auth(ctx context.Context, network *Network) (err error) {
 	var nonce []byte
-	nonce, err = c.regularCall(network, "/xchg-get-nonce", nil, nil, timeout)
+	nonce, err = c.regularCall(ctx, network, "/xchg-get-nonce", nil, nil)
 	if err != nil {
 		fmt.Println("get nonce error", err)
 		err = errors.New(ERR_XCHG_CL_CONN_AUTH_GET_NONCE + ":" + err.Error())
@@ -254,7 +301,8 @@ func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
 		return
 	}
 
-	c.aesKey, err = utils.GetSharedKey(c.TransportPrivateKey, c.remoteTransportPublicKey)
+	var aesKey []byte
+	aesKey, err = utils.GetSharedKey(c.TransportPrivateKey, remotePublicKey)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -263,7 +311,7 @@ func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
 	copy(authFrameSecret[0:], nonce)
 	copy(authFrameSecret[16:], authData)
 	var encryptedAuthFrame []byte
-	encryptedAuthFrame, err = utils.EncryptAESGCM(authFrameSecret, c.aesKey)
+	encryptedAuthFrame, err = utils.EncryptAESGCM(authFrameSecret, aesKey)
 	if err != nil {
 		err = errors.New(ERR_XCHG_CL_CONN_AUTH_ENC + ":" + err.Error())
 		return
@@ -274,13 +322,13 @@ func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
 	copy(authFrame[len(c.TransportPublicKey):], encryptedAuthFrame)
 
 	var result []byte
-	result, err = c.regularCall(network, "/xchg-auth", authFrame, nil, timeout)
+	result, err = c.regularCall(ctx, network, "/xchg-auth", authFrame, nil)
 	if err != nil {
 		err = errors.New(ERR_XCHG_CL_CONN_AUTH_AUTH + ":" + err.Error())
 		return
 	}
 
-	result, err = utils.DecryptAESGCM(result, c.aesKey)
+	result, err = utils.DecryptAESGCM(result, aesKey)
 	if err != nil {
 		err = errors.New(ERR_XCHG_CL_CONN_AUTH_DECR + ":" + err.Error())
 		return
@@ -292,13 +340,14 @@ func (c *RemotePeer) auth(network *Network, timeout time.Duration) (err error) {
 	}
 
 	c.mtx.Lock()
+	c.aesKey = aesKey
 	c.sessionId = binary.LittleEndian.Uint64(result)
 	c.mtx.Unlock()
 
 	return
 }
 
-func (c *RemotePeer) regularCall(network *Network, function string, data []byte, aesKey []byte, timeout time.Duration) (result []byte, err error) {
+func (c *RemotePeer) regularCall(ctx context.Context, network *Network, function string, data []byte, aesKey []byte) (result []byte, err error) {
 	if len(function) > 255 {
 		err = errors.New(ERR_XCHG_CL_CONN_CALL_WRONG_FUNCTION_LEN)
 		return
@@ -355,13 +404,18 @@ func (c *RemotePeer) regularCall(network *Network, function string, data []byte,
 		copy(frame[1+len(function):], data)
 	}
 
-	result, err = c.executeTransaction(network, sessionId, frame, timeout, aesKey, function)
+	result, err = c.executeTransaction(ctx, network, sessionId, frame, aesKey, function)
 
 	if NeedToChangeNode(err) {
+		c.changeNode(err)
 		c.Reset()
 		return
 	}
 
+	if IsCancelled(err) {
+		return
+	}
+
 	if err != nil {
 		err = errors.New(ERR_XCHG_CL_CONN_CALL_ERR + ":" + err.Error())
 		return
@@ -401,7 +455,9 @@ func (c *RemotePeer) regularCall(network *Network, function string, data []byte,
 		err = errors.New(ERR_XCHG_CL_CONN_CALL_FROM_PEER + ":" + string(result[1:]))
 		if NeedToMakeSession(err) {
 			// Any server error - make new session
+			c.mtx.Lock()
 			c.sessionId = 0
+			c.mtx.Unlock()
 		}
 		result = nil
 		return
@@ -423,7 +479,7 @@ func (c *RemotePeer) reset() {
 	c.aesKey = nil
 }
 
-func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data []byte, timeout time.Duration, aesKeyOriginal []byte, comment string) (result []byte, err error) {
+func (c *RemotePeer) executeTransaction(ctx context.Context, network *Network, sessionId uint64, data []byte, aesKeyOriginal []byte, comment string) (result []byte, err error) {
 
 	// Get transaction ID
 	var transactionId uint64
@@ -439,9 +495,13 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 	t := NewTransaction(FrameTypeCall, publicKey, c.remoteAddress, transactionId, sessionId, 0, len(data), data)
 	c.outgoingTransactions[transactionId] = t
 	copy(t.Comment[:], []byte(comment))
+	t.Critical = IsCriticalCall(ctx)
+	t.BeginDT = time.Now()
+	t.deliveryKey = aesKeyOriginal
 	c.mtx.Unlock()
 
 	// Send transaction
+	sentViaTransportMap := make(map[string]struct{})
 	sentCount := 0
 	sendCounter := 0
 	offset := 0
@@ -455,8 +515,10 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 
 		blockTransaction := NewTransaction(FrameTypeCall, publicKey, c.remoteAddress, transactionId, sessionId, offset, len(data), data[offset:offset+currentBlockSize])
 		copy(blockTransaction.Comment[:], []byte(comment))
+		blockTransaction.Critical = IsCriticalCall(ctx)
 
-		err = c.Send(network, blockTransaction)
+		var transportId string
+		transportId, err = c.send(network, blockTransaction)
 
 		if err != nil {
 			c.mtx.Lock()
@@ -464,6 +526,7 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 			c.mtx.Unlock()
 			return
 		}
+		sentViaTransportMap[transportId] = struct{}{}
 		sentCount++
 		offset += currentBlockSize
 	}
@@ -472,12 +535,13 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 		return nil, errors.New("no route")
 	}
 
-	// Wait for response
-	waitingDurationInMilliseconds := timeout.Milliseconds()
-	waitingTick := int64(10)
-	waitingIterationCount := waitingDurationInMilliseconds / waitingTick
-	for i := int64(0); i < waitingIterationCount; i++ {
-		if t.Complete {
+	// Wait for response, the lost blocks are retransmitted meanwhile
+	deliveryTicker := time.NewTicker(XchgNackInterval)
+	defer deliveryTicker.Stop()
+	waiting := true
+	for waiting {
+		select {
+		case <-t.Done():
 			// Transaction complete
 			c.mtx.Lock()
 			delete(c.outgoingTransactions, t.TransactionId)
@@ -491,11 +555,15 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 			}
 
 			// Success
+			c.ackResponse(network, t)
 			result = t.Result
 			err = nil
 			return
+		case <-deliveryTicker.C:
+			c.checkDelivery(network, t)
+		case <-ctx.Done():
+			waiting = false
 		}
-		time.Sleep(time.Duration(waitingTick) * time.Millisecond)
 	}
 
 	// Clear transactions map
@@ -503,7 +571,15 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 	delete(c.outgoingTransactions, t.TransactionId)
 	c.mtx.Unlock()
 
+	// Let the server drop the work
+	c.sendCancel(network, transactionId, sessionId, aesKeyOriginal)
+
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, contextError(ctx)
+	}
+
 	fmt.Println("exec transaction timeout")
+	c.declareError(sentViaTransportMap)
 
 	c.mtx.Lock()
 
@@ -527,6 +603,32 @@ func (c *RemotePeer) executeTransaction(network *Network, sessionId uint64, data
 	return nil, errors.New(ERR_XCHG_PEER_CONN_TR_TIMEOUT)
 }
 
+// sendCancel notifies the server that the caller is no longer waiting for the transaction.
+// The transaction id is encrypted with the session key so that nobody else can cancel the call.
+func (c *RemotePeer) sendCancel(network *Network, transactionId uint64, sessionId uint64, aesKey []byte) {
+	if sessionId == 0 || len(aesKey) != 32 {
+		return
+	}
+
+	transactionIdBS := make([]byte, 8)
+	binary.LittleEndian.PutUint64(transactionIdBS, transactionId)
+	encryptedTransactionId, err := utils.EncryptAESGCM(transactionIdBS, aesKey)
+	if err != nil {
+		return
+	}
+
+	tr := NewTransaction(XchgFrameCancelRequest, c.publicKey, c.remoteAddress, transactionId, sessionId, 0, 0, encryptedTransactionId)
+	copy(tr.Comment[:], []byte("CANCEL"))
+	go c.Send(network, tr)
+}
+
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.New(ERR_XCHG_PEER_CONN_TR_TIMEOUT)
+	}
+	return errors.New(ERR_XCHG_PEER_CONN_TR_CANCELLED + ":" + ctx.Err().Error())
+}
+
 func (c *RemotePeer) httpCall(routerHost string, function string, frame []byte) (result []byte, err error) {
 	if len(routerHost) == 0 {
 		return
@@ -575,9 +677,8 @@ func (c *RemotePeer) Post(url, contentType string, body io.Reader, host string)
 	return c.httpClient.Do(req)
 }
 
+// Send delivers the frame by the first available transport
 func (c *RemotePeer) Send(network *Network, tr *Transaction) (err error) {
-	addr := network.GetRouterAddr(tr.DestAddressString())
-	bs := tr.Marshal()
-	c.httpCall(addr, "w", bs)
+	_, err = c.send(network, tr)
 	return
 }
@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// RemotePeerTransportFactory creates a transport for every remote peer of the local peer
+type RemotePeerTransportFactory func(remotePeer *RemotePeer) RemotePeerTransport
+
+// RemotePeerTransportRouter delivers frames through the home routers of the remote peer.
+// It is always the last transport of the remote peer and never gives up.
+type RemotePeerTransportRouter struct {
+	mtx        sync.Mutex
+	remotePeer *RemotePeer
+	lastRouter string
+}
+
+func NewRemotePeerTransportRouter(remotePeer *RemotePeer) *RemotePeerTransportRouter {
+	var c RemotePeerTransportRouter
+	c.remotePeer = remotePeer
+	return &c
+}
+
+func (c *RemotePeerTransportRouter) Id() string {
+	return "router"
+}
+
+// Check sends the public key request if the key is unknown
+func (c *RemotePeerTransportRouter) Check(frame20 *Transaction, network *Network, remotePublicKeyExists bool) error {
+	if frame20 != nil && !remotePublicKeyExists {
+		return c.Send(network, frame20)
+	}
+	return nil
+}
+
+// DeclareError counts the timeout for the router used last, the next calls go through another router
+func (c *RemotePeerTransportRouter) DeclareError(sentViaTransportMap map[string]struct{}) {
+	if _, ok := sentViaTransportMap[c.Id()]; !ok {
+		return
+	}
+	c.ChangeNode(errors.New(ERR_XCHG_PEER_CONN_TR_TIMEOUT))
+}
+
+// ChangeNode declares the failure of the router used last
+func (c *RemotePeerTransportRouter) ChangeNode(err error) {
+	c.mtx.Lock()
+	router := c.lastRouter
+	c.lastRouter = ""
+	c.mtx.Unlock()
+
+	localPeer := c.remotePeer.LocalPeer()
+	if localPeer != nil && router != "" {
+		localPeer.reportRouter(router, 0, err)
+	}
+}
+
+// Send uses the healthiest router of the remote peer, all of them for the critical calls
+func (c *RemotePeerTransportRouter) Send(network *Network, tr *Transaction) (err error) {
+	if localPeer := c.remotePeer.LocalPeer(); localPeer != nil {
+		var router string
+		router, err = localPeer.sendFrame(network, tr)
+		if err == nil {
+			c.mtx.Lock()
+			c.lastRouter = router
+			c.mtx.Unlock()
+		}
+		return
+	}
+	_, err = c.remotePeer.httpCall(network.GetRouterAddr(tr.DestAddressString()), "w", tr.Marshal())
+	return
+}
+
+func (c *RemotePeerTransportRouter) SetRemoteUDPAddress(udpAddress *net.UDPAddr) {
+}
+
+// TransportFailures skips the transport for a while after DeclareError.
+// Custom transports can embed it.
+type TransportFailures struct {
+	mtx          sync.Mutex
+	failedUntil  time.Time
+	FailureDelay time.Duration
+}
+
+// DeclareFailure is called from DeclareError if the transport is in the map
+func (c *TransportFailures) DeclareFailure() {
+	delay := c.FailureDelay
+	if delay == 0 {
+		delay = XchgTransportFailureDelay
+	}
+	c.mtx.Lock()
+	c.failedUntil = time.Now().Add(delay)
+	c.mtx.Unlock()
+}
+
+func (c *TransportFailures) Failed() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return time.Now().Before(c.failedUntil)
+}
+
+// AddTransport adds the transport in front of the already added ones, the router transport stays the last
+func (c *RemotePeer) AddTransport(transport RemotePeerTransport) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	transports := make([]RemotePeerTransport, 0, len(c.transports)+1)
+	transports = append(transports, transport)
+	for _, t := range c.transports {
+		if t.Id() != transport.Id() {
+			transports = append(transports, t)
+		}
+	}
+	c.transports = transports
+}
+
+func (c *RemotePeer) Transports() []RemotePeerTransport {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	transports := make([]RemotePeerTransport, len(c.transports))
+	copy(transports, c.transports)
+	return transports
+}
+
+// SetRemoteUDPAddress passes the observed UDP endpoint of the remote peer to the transports
+func (c *RemotePeer) SetRemoteUDPAddress(udpAddress *net.UDPAddr) {
+	for _, t := range c.Transports() {
+		t.SetRemoteUDPAddress(udpAddress)
+	}
+}
+
+// frame20 is the public key request, the transports use it to find the remote peer
+func (c *RemotePeer) frame20() *Transaction {
+	transaction := NewTransaction(XchgFrameGetPublicKeyRequest, c.publicKey, c.remoteAddress, 0, 0, 0, 0, nil)
+	copy(transaction.Comment[:], []byte("GET_KEY"))
+	return transaction
+}
+
+// checkTransports asks every transport to look for the remote peer
+func (c *RemotePeer) checkTransports(network *Network) {
+	c.mtx.Lock()
+	remotePublicKeyExists := c.remoteTransportPublicKey != nil
+	c.mtx.Unlock()
+
+	frame20 := c.frame20()
+	for _, t := range c.Transports() {
+		t.Check(frame20, network, remotePublicKeyExists)
+	}
+}
+
+// send uses the first transport that passes Check and accepts the frame
+func (c *RemotePeer) send(network *Network, tr *Transaction) (transportId string, err error) {
+	c.mtx.Lock()
+	remotePublicKeyExists := c.remoteTransportPublicKey != nil
+	c.mtx.Unlock()
+
+	for _, t := range c.Transports() {
+		if t.Check(nil, network, remotePublicKeyExists) != nil {
+			continue
+		}
+		err = t.Send(network, tr)
+		if err == nil {
+			transportId = t.Id()
+			return
+		}
+	}
+	if err == nil {
+		err = errors.New(ERR_XCHG_PEER_NO_TRANSPORT + ":" + hex.EncodeToString(c.remoteAddress))
+	}
+	return
+}
+
+// declareError is called when the transaction sent via the transports is not answered
+func (c *RemotePeer) declareError(sentViaTransportMap map[string]struct{}) {
+	if len(sentViaTransportMap) == 0 {
+		return
+	}
+	for _, t := range c.Transports() {
+		t.DeclareError(sentViaTransportMap)
+	}
+}
+
+// changeNode moves the next calls to another router of the remote peer
+func (c *RemotePeer) changeNode(err error) {
+	for _, t := range c.Transports() {
+		if routerTransport, ok := t.(*RemotePeerTransportRouter); ok {
+			routerTransport.ChangeNode(err)
+		}
+	}
+}
+
+// RegisterTransport adds the transport to every remote peer created after the call.
+// The transports registered later are preferred.
+func (c *Peer) RegisterTransport(factory RemotePeerTransportFactory) {
+	c.mtx.Lock()
+	c.transportFactories = append(c.transportFactories, factory)
+	c.mtx.Unlock()
+}
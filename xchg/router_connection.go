@@ -22,16 +22,310 @@
 
 package xchg
 
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	xchgrouter "github.com/xchgn/xchg/router"
+	"github.com/xchgn/xchg/utils"
+)
+
+// RouterConnection is the length-prefixed TCP stream to the router.
+// It subscribes to the mailbox of the private key and reconnects until Stop.
 type RouterConnection struct {
 	IPAddress string
-	// Address   common.Address
+
+	mtx        sync.Mutex
+	privateKey ed25519.PrivateKey
+	address    ed25519.PublicKey
+	processor  func(frames []byte)
+
+	conn     net.Conn
+	writeMtx sync.Mutex
+	lastErr  error // why the last connection is lost or the last attempt failed
+
+	lastReceivedMessageId uint64
+
+	started    bool
+	stopCancel context.CancelFunc
+	stopped    chan struct{}
+}
+
+// NewRouterConnection creates the connection to ipAddress (host:port of the TCP endpoint).
+// processor receives the frames of the mailbox.
+func NewRouterConnection(ipAddress string, privateKey ed25519.PrivateKey, processor func(frames []byte)) *RouterConnection {
+	var c RouterConnection
+	c.IPAddress = ipAddress
+	c.privateKey = privateKey
+	c.processor = processor
+	c.Init()
+	return &c
 }
 
 func (c *RouterConnection) Init() {
+	c.address = utils.ExtractPublicKey(c.privateKey)
+	c.lastReceivedMessageId = 0
+}
+
+func (c *RouterConnection) Start() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.started {
+		return
+	}
+	c.started = true
+	var ctx context.Context
+	ctx, c.stopCancel = context.WithCancel(context.Background())
+	c.stopped = make(chan struct{})
+	go c.thConnect(ctx, c.stopped)
+}
+
+func (c *RouterConnection) Stop() {
+	c.mtx.Lock()
+	if !c.started {
+		c.mtx.Unlock()
+		return
+	}
+	c.started = false
+	c.stopCancel()
+	stopped := c.stopped
+	conn := c.conn
+	c.mtx.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+	<-stopped
+}
+
+func (c *RouterConnection) Connected() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.conn != nil
+}
+
+// Err returns nil while the connection is established, otherwise the last error
+func (c *RouterConnection) Err() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn != nil {
+		return nil
+	}
+	if c.lastErr != nil {
+		return c.lastErr
+	}
+	return errors.New(ERR_XCHG_ROUTER_CONN_NOT_CONNECTED)
+}
+
+// Write sends the frames as they are, every frame starts with its length
+func (c *RouterConnection) Write(frames []byte) (err error) {
+	c.mtx.Lock()
+	conn := c.conn
+	c.mtx.Unlock()
+	if conn == nil {
+		err = errors.New(ERR_XCHG_ROUTER_CONN_NOT_CONNECTED)
+		return
+	}
+	return c.write(conn, frames)
 }
 
-func (c *RouterConnection) Write() {
+func (c *RouterConnection) write(conn net.Conn, frames []byte) (err error) {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(xchgrouter.TCP_READ_TIMEOUT))
+	_, err = conn.Write(frames)
+	return
 }
 
-func (c *RouterConnection) Read() {
+func (c *RouterConnection) thConnect(ctx context.Context, stopped chan struct{}) {
+	defer close(stopped)
+
+	delay := XchgRouterConnReconnectDelayMin
+	for ctx.Err() == nil {
+		conn, reader, err := c.connect(ctx)
+		if err == nil {
+			delay = XchgRouterConnReconnectDelayMin
+			c.Read(ctx, conn, reader)
+			continue
+		}
+		c.mtx.Lock()
+		c.lastErr = err
+		c.mtx.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > XchgRouterConnReconnectDelayMax {
+			delay = XchgRouterConnReconnectDelayMax
+		}
+	}
+}
+
+// connect dials the router and subscribes to the mailbox starting after the last received message
+func (c *RouterConnection) connect(ctx context.Context) (conn net.Conn, reader *bufio.Reader, err error) {
+	dialer := net.Dialer{Timeout: xchgrouter.TCP_HANDSHAKE_TIMEOUT, KeepAlive: -1}
+	conn, err = dialer.DialContext(ctx, "tcp", c.IPAddress)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}()
+
+	reader = bufio.NewReaderSize(conn, 64*1024)
+	conn.SetReadDeadline(time.Now().Add(xchgrouter.TCP_HANDSHAKE_TIMEOUT))
+	frame, err := xchgrouter.ReadStreamFrame(reader)
+	if err != nil {
+		return
+	}
+	if frame[4] != xchgrouter.TCP_FRAME_NONCE || len(frame) != xchgrouter.TCP_FRAME_HEADER_SIZE+xchgrouter.NONCE_SIZE {
+		err = errors.New(ERR_XCHG_ROUTER_CONN_WRONG_FRAME_TYPE)
+		return
+	}
+
+	c.mtx.Lock()
+	fromMessageId := c.lastReceivedMessageId
+	c.mtx.Unlock()
+
+	readRequest := make([]byte, xchgrouter.READ_REQUEST_SIZE)
+	binary.LittleEndian.PutUint64(readRequest[0:], fromMessageId)
+	binary.LittleEndian.PutUint64(readRequest[8:], xchgrouter.TCP_MAX_BATCH_SIZE)
+	copy(readRequest[16:], c.address)
+	copy(readRequest[48:], frame[xchgrouter.TCP_FRAME_HEADER_SIZE:])
+	copy(readRequest[48+xchgrouter.NONCE_SIZE:], utils.SignMessage(c.privateKey, readRequest[:48+xchgrouter.NONCE_SIZE]))
+	err = c.write(conn, xchgrouter.MakeStreamFrame(xchgrouter.TCP_FRAME_READ, readRequest))
+	if err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	if !c.started {
+		c.mtx.Unlock()
+		err = errors.New(ERR_XCHG_ROUTER_CONN_NOT_CONNECTED)
+		return
+	}
+	c.conn = conn
+	c.lastErr = nil
+	c.mtx.Unlock()
+	return
+}
+
+// Read processes the stream until the connection is lost
+func (c *RouterConnection) Read(ctx context.Context, conn net.Conn, reader *bufio.Reader) {
+	var err error
+	connCtx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		c.mtx.Lock()
+		if c.conn == conn {
+			c.conn = nil
+			c.lastErr = err
+		}
+		c.mtx.Unlock()
+		conn.Close()
+	}()
+
+	go func() {
+		pingTicker := time.NewTicker(xchgrouter.TCP_PING_INTERVAL)
+		defer pingTicker.Stop()
+		for {
+			select {
+			case <-connCtx.Done():
+				conn.Close()
+				return
+			case <-pingTicker.C:
+				if c.write(conn, xchgrouter.MakeStreamFrame(xchgrouter.TCP_FRAME_PING, nil)) != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(xchgrouter.TCP_READ_TIMEOUT))
+		var frame []byte
+		frame, err = xchgrouter.ReadStreamFrame(reader)
+		if err != nil {
+			return
+		}
+		switch frame[4] {
+		case xchgrouter.TCP_FRAME_PING:
+			err = c.write(conn, xchgrouter.MakeStreamFrame(xchgrouter.TCP_FRAME_PONG, nil))
+		case xchgrouter.TCP_FRAME_PONG:
+		case xchgrouter.TCP_FRAME_MAILBOX:
+			if len(frame) < xchgrouter.TCP_FRAME_HEADER_SIZE+8 {
+				err = errors.New(ERR_XCHG_ROUTER_CONN_WRONG_FRAME_TYPE)
+				return
+			}
+			c.mtx.Lock()
+			c.lastReceivedMessageId = binary.LittleEndian.Uint64(frame[xchgrouter.TCP_FRAME_HEADER_SIZE:])
+			c.mtx.Unlock()
+			c.processor(frame[xchgrouter.TCP_FRAME_HEADER_SIZE+8:])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// routerConnection returns the running TCP connection to the router, nil if the router has no TCP endpoint
+func (c *Peer) routerConnection(router string) *RouterConnection {
+	tcpAddress := c.Network().GetRouterTcpAddr(router)
+	if tcpAddress == "" {
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	routerConnection, ok := c.routerConnections[router]
+	if ok && routerConnection.IPAddress == tcpAddress {
+		return routerConnection
+	}
+	if ok {
+		go routerConnection.Stop()
+	}
+	if !c.started || c.stopping {
+		return nil
+	}
+	routerConnection = NewRouterConnection(tcpAddress, c.privateKey, func(frames []byte) {
+		c.mtx.Lock()
+		c.routerStatRead[router]++
+		c.mtx.Unlock()
+		go c.processFramesFromInternet(frames, router)
+	})
+	c.routerConnections[router] = routerConnection
+	routerConnection.Start()
+	return routerConnection
+}
+
+// getFramesFromRouterTcp keeps the TCP connection to the home router, the frames come to the processor.
+// Returns the state of the connection after the delay.
+func (c *Peer) getFramesFromRouterTcp(ctx context.Context, router string) (err error) {
+	routerConnection := c.routerConnection(router)
+	if routerConnection == nil {
+		err = errors.New(ERR_XCHG_ROUTER_CONN_NOT_CONNECTED)
+		return
+	}
+
+	// The home router is checked again after the delay
+	timer := time.NewTimer(c.longPollingDelay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+	return routerConnection.Err()
 }
@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// RouterHealth is the state of a router as the peer sees it
+type RouterHealth struct {
+	Router              string        `json:"router"`
+	Latency             time.Duration `json:"latency"`
+	ErrorRate           float64       `json:"error_rate"`
+	Requests            uint64        `json:"requests"`
+	Errors              uint64        `json:"errors"`
+	Timeouts            uint64        `json:"timeouts"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	LastError           string        `json:"last_error,omitempty"`
+	LastErrorDT         time.Time     `json:"last_error_dt"`
+	LastSuccessDT       time.Time     `json:"last_success_dt"`
+	Available           bool          `json:"available"`
+	Score               float64       `json:"score"`
+}
+
+// routerHealth keeps the moving averages of the latency and the errors
+type routerHealth struct {
+	latency             float64
+	errorRate           float64
+	requests            uint64
+	errors              uint64
+	timeouts            uint64
+	consecutiveFailures int
+	lastError           string
+	lastErrorDT         time.Time
+	lastSuccessDT       time.Time
+}
+
+// available is false for a while after a failure, a success makes the router available again
+func (c *routerHealth) available() bool {
+	return c.consecutiveFailures == 0 || time.Since(c.lastErrorDT) > XchgRouterFailureDelay
+}
+
+// score is 1 for an ideal router, it falls with the errors and the latency
+func (c *routerHealth) score() float64 {
+	if !c.available() {
+		return 0
+	}
+	latencyRef := float64(XchgRouterHealthLatencyRef)
+	return (1 - c.errorRate) * latencyRef / (latencyRef + c.latency)
+}
+
+func (c *routerHealth) report(latency time.Duration, err error) {
+	c.requests++
+	if err == nil {
+		c.errorRate *= 1 - XchgRouterHealthAlpha
+		c.consecutiveFailures = 0
+		c.lastSuccessDT = time.Now()
+		if latency > 0 {
+			if c.latency == 0 {
+				c.latency = float64(latency)
+			} else {
+				c.latency += XchgRouterHealthAlpha * (float64(latency) - c.latency)
+			}
+		}
+		return
+	}
+
+	c.errorRate += XchgRouterHealthAlpha * (1 - c.errorRate)
+	c.errors++
+	if isTimeout(err) {
+		c.timeouts++
+	}
+	c.consecutiveFailures++
+	c.lastError = err.Error()
+	c.lastErrorDT = time.Now()
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// reportRouter updates the health of the router, zero latency means it is not measured
+func (c *Peer) reportRouter(router string, latency time.Duration, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	health, ok := c.routerHealth[router]
+	if !ok {
+		health = &routerHealth{}
+		c.routerHealth[router] = health
+	}
+	health.report(latency, err)
+}
+
+// RouterHealth returns the health of the routers used by the peer, the best one first
+func (c *Peer) RouterHealth() []*RouterHealth {
+	c.mtx.Lock()
+	result := make([]*RouterHealth, 0, len(c.routerHealth))
+	for router, health := range c.routerHealth {
+		result = append(result, &RouterHealth{
+			Router:              router,
+			Latency:             time.Duration(health.latency),
+			ErrorRate:           health.errorRate,
+			Requests:            health.requests,
+			Errors:              health.errors,
+			Timeouts:            health.timeouts,
+			ConsecutiveFailures: health.consecutiveFailures,
+			LastError:           health.lastError,
+			LastErrorDT:         health.lastErrorDT,
+			LastSuccessDT:       health.lastSuccessDT,
+			Available:           health.available(),
+			Score:               health.score(),
+		})
+	}
+	c.mtx.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Router < result[j].Router
+	})
+	return result
+}
+
+// routersFor returns the routers of the address ordered by the health.
+// Scores are compared in steps so that close routers keep the order of the network.
+func (c *Peer) routersFor(network *Network, address string) []string {
+	routers := network.GetHomeRouterAddrs(address)
+	steps := make(map[string]float64, len(routers))
+
+	c.mtx.Lock()
+	for _, router := range routers {
+		score := 1.0
+		if health, ok := c.routerHealth[router]; ok {
+			score = health.score()
+		}
+		steps[router] = math.Floor(score / XchgRouterHealthScoreStep)
+	}
+	c.mtx.Unlock()
+
+	sort.SliceStable(routers, func(i, j int) bool {
+		return steps[routers[i]] > steps[routers[j]]
+	})
+	return routers
+}
@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	xchgrouter "github.com/xchgn/xchg/router"
+	"github.com/xchgn/xchg/utils"
+)
+
+// routerWS is the persistent connection to the home router, frames are sent without base64
+type routerWS struct {
+	mtx  sync.Mutex
+	conn *websocket.Conn
+}
+
+func (c *routerWS) write(frames []byte) (err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(xchgrouter.WS_READ_TIMEOUT))
+	return c.conn.WriteMessage(websocket.BinaryMessage, frames)
+}
+
+func (c *routerWS) ping() (err error) {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(xchgrouter.WS_READ_TIMEOUT))
+}
+
+// dialRouterWS opens /api/ws and subscribes to the mailbox of the peer
+func (c *Peer) dialRouterWS(ctx context.Context, router string) (ws *routerWS, err error) {
+	dialer := websocket.Dialer{
+		HandshakeTimeout: xchgrouter.WS_HANDSHAKE_TIMEOUT,
+		ReadBufferSize:   64 * 1024,
+		WriteBufferSize:  64 * 1024,
+	}
+	conn, response, err := dialer.DialContext(ctx, "ws://"+router+"/api/ws", nil)
+	if err != nil {
+		return
+	}
+	if response != nil && response.Body != nil {
+		response.Body.Close()
+	}
+	conn.SetReadLimit(xchgrouter.WS_MAX_MESSAGE_SIZE)
+
+	conn.SetReadDeadline(time.Now().Add(xchgrouter.WS_HANDSHAKE_TIMEOUT))
+	_, nonce, err := conn.ReadMessage()
+	if err != nil || len(nonce) != xchgrouter.NONCE_SIZE {
+		conn.Close()
+		if err == nil {
+			err = errors.New(ERR_XCHG_PEER_ROUTER_NONCE)
+		}
+		return
+	}
+
+	c.mtx.Lock()
+	fromMessageId := c.lastReceivedMessageId[router]
+	c.mtx.Unlock()
+
+	readRequest := make([]byte, xchgrouter.READ_REQUEST_SIZE)
+	binary.LittleEndian.PutUint64(readRequest[0:], fromMessageId)
+	binary.LittleEndian.PutUint64(readRequest[8:], xchgrouter.WS_MAX_BATCH_SIZE)
+	copy(readRequest[16:], c.localAddressBS)
+	copy(readRequest[48:], nonce)
+	copy(readRequest[48+xchgrouter.NONCE_SIZE:], utils.SignMessage(c.privateKey, readRequest[:48+xchgrouter.NONCE_SIZE]))
+
+	conn.SetWriteDeadline(time.Now().Add(xchgrouter.WS_HANDSHAKE_TIMEOUT))
+	err = conn.WriteMessage(websocket.BinaryMessage, readRequest)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	ws = &routerWS{conn: conn}
+	return
+}
+
+// getFramesFromRouterWS receives the mailbox of the peer until the connection is lost.
+// connected is false if the router did not accept the connection.
+func (c *Peer) getFramesFromRouterWS(ctx context.Context, router string) (connected bool, err error) {
+	ws, err := c.dialRouterWS(ctx, router)
+	if err != nil {
+		return
+	}
+	connected = true
+
+	c.mtx.Lock()
+	c.routerWS[router] = ws
+	c.mtx.Unlock()
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		c.mtx.Lock()
+		if c.routerWS[router] == ws {
+			delete(c.routerWS, router)
+		}
+		c.mtx.Unlock()
+	}()
+
+	// Closing the connection interrupts ReadMessage
+	go func() {
+		pingTicker := time.NewTicker(xchgrouter.WS_PING_INTERVAL)
+		defer pingTicker.Stop()
+		for {
+			select {
+			case <-connCtx.Done():
+				ws.conn.Close()
+				return
+			case <-pingTicker.C:
+				if ws.ping() != nil {
+					ws.conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	ws.conn.SetReadDeadline(time.Now().Add(xchgrouter.WS_READ_TIMEOUT))
+	ws.conn.SetPingHandler(func(appData string) error {
+		ws.conn.SetReadDeadline(time.Now().Add(xchgrouter.WS_READ_TIMEOUT))
+		return ws.conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(xchgrouter.WS_READ_TIMEOUT))
+	})
+	ws.conn.SetPongHandler(func(string) error {
+		ws.conn.SetReadDeadline(time.Now().Add(xchgrouter.WS_READ_TIMEOUT))
+		return nil
+	})
+
+	for {
+		var message []byte
+		_, message, err = ws.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		ws.conn.SetReadDeadline(time.Now().Add(xchgrouter.WS_READ_TIMEOUT))
+		if len(message) < 8 {
+			continue
+		}
+
+		c.mtx.Lock()
+		c.routerStatRead[router]++
+		c.lastReceivedMessageId[router] = binary.LittleEndian.Uint64(message[0:])
+		c.mtx.Unlock()
+		go c.processFramesFromInternet(message[8:], router)
+	}
+}
+
+// sendToRouter uses the TCP connection if the router has the TCP endpoint.
+// Otherwise the WebSocket connection is used if it is open, HTTP if it is not.
+func (c *Peer) sendToRouter(router string, frame []byte) (err error) {
+	// The frames go by HTTP while the TCP connection is being established
+	if routerConnection := c.routerConnection(router); routerConnection != nil && routerConnection.Write(frame) == nil {
+		c.reportRouter(router, 0, nil)
+		return
+	}
+
+	c.mtx.Lock()
+	ws := c.routerWS[router]
+	c.mtx.Unlock()
+
+	if ws != nil && ws.write(frame) == nil {
+		c.reportRouter(router, 0, nil)
+		return
+	}
+	_, err = c.httpCall(c.httpClient, router, "w", frame)
+	return
+}
+
+// routerWSAllowed returns false for a while after the router refused the WebSocket connection
+func (c *Peer) routerWSAllowed(router string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return !c.httpOnly && time.Now().After(c.routerWSRetryTime[router])
+}
+
+func (c *Peer) declareRouterWSFailed(router string) {
+	c.mtx.Lock()
+	c.routerWSRetryTime[router] = time.Now().Add(XchgRouterWSRetryDelay)
+	c.mtx.Unlock()
+}
+
+// SetHttpOnly disables the WebSocket transport, the peer uses /api/w and /api/r
+func (c *Peer) SetHttpOnly(httpOnly bool) {
+	c.mtx.Lock()
+	c.httpOnly = httpOnly
+	c.mtx.Unlock()
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"reflect"
+)
+
+type TypedHandlerFunc[Req any, Resp any] func(param *Param, req Req) (Resp, error)
+
+// Invoke calls a typed function using the JSON codec
+func Invoke[Req any, Resp any](ctx context.Context, peer *Peer, remoteAddress ed25519.PublicKey, authData string, function string, req Req) (resp Resp, err error) {
+	return InvokeWithCodec[Req, Resp](ctx, peer, &JsonCodec{}, remoteAddress, authData, function, req)
+}
+
+func InvokeWithCodec[Req any, Resp any](ctx context.Context, peer *Peer, codec Codec, remoteAddress ed25519.PublicKey, authData string, function string, req Req) (resp Resp, err error) {
+	data, err := encodeWithCodec(codec, req)
+	if err != nil {
+		return
+	}
+
+	result, err := peer.CallContext(ctx, remoteAddress, authData, function, data)
+	if err != nil {
+		return
+	}
+
+	respCodec, payload, err := decodeCodecHeader(result)
+	if err != nil {
+		return
+	}
+	if respCodec.Id() != codec.Id() {
+		err = errors.New(ERR_XCHG_CODEC_MISMATCH + ":" + codec.Name() + "!=" + respCodec.Name())
+		return
+	}
+
+	err = codec.Unmarshal(payload, &resp)
+	if err != nil {
+		err = errors.New(ERR_XCHG_CODEC_UNMARSHAL + ":" + err.Error())
+	}
+	return
+}
+
+// TypedHandler converts the typed handler into a CallbackFunc.
+// The response is encoded with the codec of the request. A non-nil codec rejects other codecs.
+func TypedHandler[Req any, Resp any](handler TypedHandlerFunc[Req, Resp], codec Codec) CallbackFunc {
+	return func(param *Param) (response []byte, err error) {
+		reqCodec, payload, err := decodeCodecHeader(param.Parameter)
+		if err != nil {
+			return
+		}
+		if codec != nil && reqCodec.Id() != codec.Id() {
+			err = errors.New(ERR_XCHG_CODEC_MISMATCH + ":" + codec.Name() + "!=" + reqCodec.Name())
+			return
+		}
+
+		var req Req
+		err = reqCodec.Unmarshal(payload, &req)
+		if err != nil {
+			err = errors.New(ERR_XCHG_CODEC_UNMARSHAL + ":" + err.Error())
+			return
+		}
+
+		resp, err := handler(param, req)
+		if err != nil {
+			return
+		}
+		return encodeWithCodec(reqCodec, resp)
+	}
+}
+
+func HandleTyped[Req any, Resp any](mux *ServeMux, pattern string, handler TypedHandlerFunc[Req, Resp]) {
+	HandleTypedWithOptions(mux, pattern, handler, RouteOptions{})
+}
+
+func HandleTypedWithOptions[Req any, Resp any](mux *ServeMux, pattern string, handler TypedHandlerFunc[Req, Resp], options RouteOptions) {
+	mux.handle(pattern, TypedHandler(handler, options.Codec), options, reflect.TypeOf((*Req)(nil)).Elem(), reflect.TypeOf((*Resp)(nil)).Elem())
+}
@@ -0,0 +1,284 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RouteOptions struct {
+	// Timeout cancels Param.Context of the handler and returns ERR_XCHG_SRV_FUNCTION_TIMEOUT
+	Timeout time.Duration
+
+	// AuthRequired rejects sessions opened without auth data
+	AuthRequired bool
+
+	// Authorize is an additional check of the caller
+	Authorize func(param *Param) error
+
+	// Codec restricts typed handlers to one codec, any registered codec is accepted by default
+	Codec Codec
+
+	// Version and Description are published by /xchg-describe
+	Version     string
+	Description string
+}
+
+type route struct {
+	pattern string
+	prefix  bool
+	handler CallbackFunc
+	options RouteOptions
+
+	// Typed handlers only
+	typed        bool
+	requestType  reflect.Type
+	responseType reflect.Type
+}
+
+// ServeMux dispatches calls by Param.Function.
+// A pattern ending with "*" matches every function with that prefix, the longest prefix wins.
+// Exact patterns take precedence over prefixes.
+type ServeMux struct {
+	mtx      sync.Mutex
+	routes   map[string]*route
+	prefixes []*route
+	streams  map[string]*streamRoute
+	notFound CallbackFunc
+	auth     CallbackFunc
+}
+
+type FunctionNotFoundError struct {
+	Function string
+}
+
+func (c *FunctionNotFoundError) Error() string {
+	return ERR_XCHG_SRV_FUNCTION_NOT_FOUND + ":" + c.Function
+}
+
+func NewServeMux() *ServeMux {
+	var c ServeMux
+	c.routes = make(map[string]*route)
+	c.prefixes = make([]*route, 0)
+	c.streams = make(map[string]*streamRoute)
+	return &c
+}
+
+func (c *ServeMux) Handle(pattern string, handler CallbackFunc) {
+	c.HandleWithOptions(pattern, handler, RouteOptions{})
+}
+
+func (c *ServeMux) HandleWithOptions(pattern string, handler CallbackFunc, options RouteOptions) {
+	c.handle(pattern, handler, options, nil, nil)
+}
+
+// handle registers the route, request and response types are set for typed handlers
+func (c *ServeMux) handle(pattern string, handler CallbackFunc, options RouteOptions, requestType reflect.Type, responseType reflect.Type) {
+	if len(pattern) == 0 {
+		panic("xchg: empty pattern")
+	}
+	if handler == nil {
+		panic("xchg: nil handler")
+	}
+
+	var r route
+	r.pattern = pattern
+	r.handler = handler
+	r.options = options
+	r.typed = requestType != nil
+	r.requestType = requestType
+	r.responseType = responseType
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if strings.HasSuffix(pattern, "*") {
+		r.prefix = true
+		r.pattern = strings.TrimSuffix(pattern, "*")
+		prefixes := make([]*route, 0, len(c.prefixes)+1)
+		for _, p := range c.prefixes {
+			if p.pattern != r.pattern {
+				prefixes = append(prefixes, p)
+			}
+		}
+		prefixes = append(prefixes, &r)
+		sort.Slice(prefixes, func(i, j int) bool {
+			return len(prefixes[i].pattern) > len(prefixes[j].pattern)
+		})
+		c.prefixes = prefixes
+		return
+	}
+
+	c.routes[pattern] = &r
+}
+
+// HandleStream registers the handler of the streaming calls (Peer.CallStream).
+// Stream functions are matched exactly and do not go through the middlewares.
+func (c *ServeMux) HandleStream(function string, handler StreamHandlerFunc) {
+	c.HandleStreamWithOptions(function, handler, RouteOptions{})
+}
+
+// HandleStreamWithOptions applies Timeout to the whole stream, AuthRequired and Authorize to its opening
+func (c *ServeMux) HandleStreamWithOptions(function string, handler StreamHandlerFunc, options RouteOptions) {
+	if len(function) == 0 {
+		panic("xchg: empty stream function")
+	}
+	if handler == nil {
+		panic("xchg: nil stream handler")
+	}
+
+	var r streamRoute
+	r.function = function
+	r.handler = handler
+	r.options = options
+
+	c.mtx.Lock()
+	c.streams[function] = &r
+	c.mtx.Unlock()
+}
+
+func (c *ServeMux) matchStream(function string) *streamRoute {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.streams[function]
+}
+
+// HandleNotFound replaces the default handler that returns FunctionNotFoundError
+func (c *ServeMux) HandleNotFound(handler CallbackFunc) {
+	c.mtx.Lock()
+	c.notFound = handler
+	c.mtx.Unlock()
+}
+
+// HandleAuth sets the handler of the session opening (Param.Function is empty).
+// Without it every session is accepted.
+func (c *ServeMux) HandleAuth(handler CallbackFunc) {
+	c.mtx.Lock()
+	c.auth = handler
+	c.mtx.Unlock()
+}
+
+func (c *ServeMux) match(function string) *route {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if r, ok := c.routes[function]; ok {
+		return r
+	}
+	for _, r := range c.prefixes {
+		if strings.HasPrefix(function, r.pattern) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Serve makes ServeMux a Handler: StartServerPeerHandler(privateKey, mux)
+func (c *ServeMux) Serve(param *Param) (response []byte, err error) {
+	if param.Function == "" {
+		c.mtx.Lock()
+		auth := c.auth
+		c.mtx.Unlock()
+		if auth == nil {
+			return
+		}
+		return auth(param)
+	}
+
+	r := c.match(param.Function)
+	if r == nil {
+		c.mtx.Lock()
+		notFound := c.notFound
+		c.mtx.Unlock()
+		if notFound != nil {
+			return notFound(param)
+		}
+		err = &FunctionNotFoundError{Function: param.Function}
+		return
+	}
+
+	if r.options.AuthRequired && len(param.AuthData) == 0 {
+		err = errors.New(ERR_XCHG_ACCESS_DENIED)
+		return
+	}
+	if r.options.Authorize != nil {
+		err = r.options.Authorize(param)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.options.Timeout > 0 {
+		return serveWithTimeout(r.handler, param, r.options.Timeout)
+	}
+	return r.handler(param)
+}
+
+func serveWithTimeout(handler CallbackFunc, param *Param, timeout time.Duration) (response []byte, err error) {
+	parentCtx := param.Context
+	if parentCtx == nil {
+		parentCtx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+
+	p := *param
+	p.Context = ctx
+
+	type result struct {
+		response []byte
+		err      error
+		panicked interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() {
+			// The panic is raised again in the goroutine of the call
+			res.panicked = recover()
+			done <- res
+		}()
+		res.response, res.err = handler(&p)
+	}()
+
+	select {
+	case res := <-done:
+		if res.panicked != nil {
+			panic(res.panicked)
+		}
+		return res.response, res.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = errors.New(ERR_XCHG_SRV_FUNCTION_TIMEOUT)
+		} else {
+			err = ctx.Err()
+		}
+		return
+	}
+}
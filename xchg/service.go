@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+type paramContextKey struct{}
+
+var (
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ParamFromContext returns the Param of the call inside service methods
+func ParamFromContext(ctx context.Context) *Param {
+	param, _ := ctx.Value(paramContextKey{}).(*Param)
+	return param
+}
+
+// RegisterService exposes every exported method of the form
+//
+//	func (s *Service) Method(ctx context.Context, args *Args) (*Reply, error)
+//
+// as the function "Service.Method". Arguments and replies use the codec of the request.
+func (c *ServeMux) RegisterService(rcvr interface{}) error {
+	return c.RegisterServiceName("", rcvr)
+}
+
+// RegisterServiceName is RegisterService with the name instead of the receiver's type name
+func (c *ServeMux) RegisterServiceName(name string, rcvr interface{}) error {
+	rcvrType := reflect.TypeOf(rcvr)
+	rcvrValue := reflect.ValueOf(rcvr)
+	if rcvrType == nil {
+		return errors.New(ERR_XCHG_SRV_SERVICE_NO_NAME)
+	}
+	if name == "" {
+		name = reflect.Indirect(rcvrValue).Type().Name()
+	}
+	if name == "" {
+		return errors.New(ERR_XCHG_SRV_SERVICE_NO_NAME)
+	}
+
+	registered := 0
+	for i := 0; i < rcvrType.NumMethod(); i++ {
+		method := rcvrType.Method(i)
+		if !isServiceMethod(method) {
+			continue
+		}
+		c.handle(name+"."+method.Name, serviceMethodHandler(rcvrValue, method), RouteOptions{}, method.Type.In(2), method.Type.Out(0))
+		registered++
+	}
+
+	if registered == 0 {
+		return errors.New(ERR_XCHG_SRV_SERVICE_NO_METHODS + ":" + name)
+	}
+	return nil
+}
+
+func isServiceMethod(method reflect.Method) bool {
+	if !method.IsExported() {
+		return false
+	}
+	mType := method.Type
+	if mType.NumIn() != 3 || mType.NumOut() != 2 {
+		return false
+	}
+	if mType.In(1) != typeOfContext || mType.In(2).Kind() != reflect.Pointer {
+		return false
+	}
+	if mType.Out(0).Kind() != reflect.Pointer || mType.Out(1) != typeOfError {
+		return false
+	}
+	return true
+}
+
+func serviceMethodHandler(rcvrValue reflect.Value, method reflect.Method) CallbackFunc {
+	argsType := method.Type.In(2).Elem()
+	return func(param *Param) (response []byte, err error) {
+		reqCodec, payload, err := decodeCodecHeader(param.Parameter)
+		if err != nil {
+			return
+		}
+
+		args := reflect.New(argsType)
+		err = reqCodec.Unmarshal(payload, args.Interface())
+		if err != nil {
+			err = errors.New(ERR_XCHG_CODEC_UNMARSHAL + ":" + err.Error())
+			return
+		}
+
+		ctx := param.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx = context.WithValue(ctx, paramContextKey{}, param)
+
+		out := method.Func.Call([]reflect.Value{rcvrValue, reflect.ValueOf(ctx), args})
+		if errValue := out[1].Interface(); errValue != nil {
+			err = errValue.(error)
+			return
+		}
+		return encodeWithCodec(reqCodec, out[0].Interface())
+	}
+}
+
+// RegisterService registers the service in the mux of the peer.
+// A peer started with a CallbackFunc keeps it for the sessions and for the other functions.
+func (c *Peer) RegisterService(rcvr interface{}) error {
+	return c.ensureMux().RegisterService(rcvr)
+}
+
+func (c *Peer) RegisterServiceName(name string, rcvr interface{}) error {
+	return c.ensureMux().RegisterServiceName(name, rcvr)
+}
+
+func (c *Peer) ensureMux() *ServeMux {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.mux == nil {
+		mux := NewServeMux()
+		if c.Callback != nil {
+			mux.HandleNotFound(c.Callback)
+			mux.HandleAuth(c.Callback)
+		}
+		c.mux = mux
+		c.Callback = mux.Serve
+	}
+	return c.mux
+}
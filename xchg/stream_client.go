@@ -0,0 +1,290 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// clientStream sends the request and prefetches the response with XchgStreamWindow chunk calls in flight
+type clientStream struct {
+	mtx           sync.Mutex
+	peer          *Peer
+	remoteAddress ed25519.PublicKey
+	authData      string
+	id            uint64
+	ctx           context.Context
+	cancel        context.CancelFunc
+	err           error
+
+	// Response: the results of the chunk calls in the order of the chunks
+	fetches      chan chan streamFetch
+	fetchCancels map[uint64]context.CancelFunc
+	eofSeq       uint64
+	eofSeen      bool
+	data         []byte
+	eof          bool
+}
+
+type streamFetch struct {
+	flags byte
+	data  []byte
+	err   error
+}
+
+// CallStream calls the stream handler of the remote peer (ServeMux.HandleStream).
+// The body is sent while the response is read, the size of both is not limited.
+// ctx covers the whole stream, the response must be closed.
+func (c *Peer) CallStream(ctx context.Context, remoteAddress ed25519.PublicKey, authData string, function string, body io.Reader) (response io.ReadCloser, err error) {
+	result, err := c.CallContext(ctx, remoteAddress, authData, FunctionStreamOpen, []byte(function))
+	if err != nil {
+		return
+	}
+	if len(result) != 8 {
+		err = errors.New(ERR_XCHG_CL_STREAM_WRONG_RESPONSE)
+		return
+	}
+
+	var s clientStream
+	s.peer = c
+	s.remoteAddress = remoteAddress
+	s.authData = authData
+	s.id = binary.LittleEndian.Uint64(result)
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.fetches = make(chan chan streamFetch, XchgStreamWindow-1)
+	s.fetchCancels = make(map[uint64]context.CancelFunc)
+
+	go s.thWrite(body)
+	go s.thFetch()
+
+	response = &s
+	return
+}
+
+func (c *clientStream) fail(err error) {
+	c.mtx.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mtx.Unlock()
+	c.cancel()
+}
+
+func (c *clientStream) error() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return contextError(c.ctx)
+}
+
+// call repeats the chunk call while the server answers "pending" and up to XchgStreamRetries times on the transport errors
+func (c *clientStream) call(ctx context.Context, function string, param []byte) (flags byte, data []byte, err error) {
+	errorsCount := 0
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, XchgStreamCallTimeout)
+		var result []byte
+		result, err = c.peer.CallContext(callCtx, c.remoteAddress, c.authData, function, param)
+		cancel()
+		if ctx.Err() != nil {
+			err = contextError(ctx)
+			return
+		}
+		if err != nil {
+			errorsCount++
+			if strings.Contains(err.Error(), ERR_XCHG_CL_CONN_CALL_FROM_PEER) || errorsCount > XchgStreamRetries {
+				return
+			}
+			continue
+		}
+		if len(result) < 1 {
+			err = errors.New(ERR_XCHG_CL_STREAM_WRONG_RESPONSE)
+			return
+		}
+		if result[0]&streamFlagPending != 0 {
+			continue
+		}
+		flags = result[0]
+		data = result[1:]
+		return
+	}
+}
+
+// thWrite sends the body in chunks, the last one has the EOF flag
+func (c *clientStream) thWrite(body io.Reader) {
+	window := make(chan struct{}, XchgStreamWindow)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for seq := uint64(0); ; seq++ {
+		data := make([]byte, XchgStreamChunkSize)
+		n := 0
+		var err error = io.EOF
+		if body != nil {
+			n, err = io.ReadFull(body, data)
+		}
+		flags := byte(0)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			flags = streamFlagEOF
+		default:
+			c.fail(err)
+			return
+		}
+
+		select {
+		case window <- struct{}{}:
+		case <-c.ctx.Done():
+			return
+		}
+
+		param := make([]byte, 8+8+1+n)
+		binary.LittleEndian.PutUint64(param, c.id)
+		binary.LittleEndian.PutUint64(param[8:], seq)
+		param[16] = flags
+		copy(param[17:], data[:n])
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-window }()
+			if _, _, err := c.call(c.ctx, FunctionStreamWrite, param); err != nil {
+				c.fail(err)
+			}
+		}()
+
+		if flags&streamFlagEOF != 0 {
+			return
+		}
+	}
+}
+
+// thFetch starts the reads of the chunks ahead of the reader until the last chunk is received
+func (c *clientStream) thFetch() {
+	for seq := uint64(0); ; seq++ {
+		c.mtx.Lock()
+		if c.eofSeen && seq > c.eofSeq {
+			c.mtx.Unlock()
+			return
+		}
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.fetchCancels[seq] = cancel
+		c.mtx.Unlock()
+
+		result := make(chan streamFetch, 1)
+		select {
+		case c.fetches <- result:
+		case <-c.ctx.Done():
+			cancel()
+			return
+		}
+
+		param := make([]byte, 16)
+		binary.LittleEndian.PutUint64(param, c.id)
+		binary.LittleEndian.PutUint64(param[8:], seq)
+		go c.fetch(ctx, seq, param, result)
+	}
+}
+
+func (c *clientStream) fetch(ctx context.Context, seq uint64, param []byte, result chan streamFetch) {
+	var f streamFetch
+	f.flags, f.data, f.err = c.call(ctx, FunctionStreamRead, param)
+
+	c.mtx.Lock()
+	if cancel, ok := c.fetchCancels[seq]; ok {
+		cancel()
+		delete(c.fetchCancels, seq)
+	}
+	// The reads after the last chunk are not needed
+	if f.err == nil && f.flags&streamFlagEOF != 0 && (!c.eofSeen || seq < c.eofSeq) {
+		c.eofSeen = true
+		c.eofSeq = seq
+		for s, cancel := range c.fetchCancels {
+			if s > seq {
+				cancel()
+				delete(c.fetchCancels, s)
+			}
+		}
+	}
+	c.mtx.Unlock()
+
+	result <- f
+}
+
+func (c *clientStream) Read(p []byte) (n int, err error) {
+	for len(c.data) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		var result chan streamFetch
+		select {
+		case result = <-c.fetches:
+		case <-c.ctx.Done():
+			return 0, c.error()
+		}
+		var f streamFetch
+		select {
+		case f = <-result:
+		case <-c.ctx.Done():
+			return 0, c.error()
+		}
+
+		if f.err != nil {
+			c.fail(f.err)
+			return 0, c.error()
+		}
+		if f.flags&streamFlagError != 0 {
+			c.fail(errors.New(ERR_XCHG_CL_CONN_CALL_FROM_PEER + ":" + string(f.data)))
+			return 0, c.error()
+		}
+		c.data = f.data
+		c.eof = f.flags&streamFlagEOF != 0
+	}
+
+	n = copy(p, c.data)
+	c.data = c.data[n:]
+	return
+}
+
+// Close stops the stream, the server drops it
+func (c *clientStream) Close() error {
+	c.cancel()
+
+	param := make([]byte, 8)
+	binary.LittleEndian.PutUint64(param, c.id)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), XchgStreamCallTimeout)
+		defer cancel()
+		c.peer.CallContext(ctx, c.remoteAddress, c.authData, FunctionStreamClose, param)
+	}()
+	return nil
+}
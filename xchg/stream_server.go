@@ -0,0 +1,485 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Streaming calls are made of the ordinary calls of the session to the reserved functions:
+//
+//	/xchg-stream-open  [function]                         -> [streamId 8]
+//	/xchg-stream-write [streamId 8][seq 8][flags 1][data] -> [flags 1]
+//	/xchg-stream-read  [streamId 8][seq 8]                -> [flags 1][data]
+//	/xchg-stream-close [streamId 8]                       -> []
+//
+// Every chunk call carries up to XchgStreamChunkSize bytes, XchgStreamWindow calls are in flight
+// per direction. The server answers "pending" instead of blocking longer than XchgStreamPollTimeout,
+// the window of the kept chunks makes the repeated calls safe.
+const (
+	FunctionStreamOpen  = "/xchg-stream-open"
+	FunctionStreamWrite = "/xchg-stream-write"
+	FunctionStreamRead  = "/xchg-stream-read"
+	FunctionStreamClose = "/xchg-stream-close"
+)
+
+func isStreamFunction(function string) bool {
+	switch function {
+	case FunctionStreamOpen, FunctionStreamWrite, FunctionStreamRead, FunctionStreamClose:
+		return true
+	}
+	return false
+}
+
+// Flags of the chunk
+const (
+	streamFlagEOF     = byte(0x01)
+	streamFlagError   = byte(0x02)
+	streamFlagPending = byte(0x04)
+)
+
+// StreamParam is the call parameter of the stream handler.
+// Body is the request stream, the data written to Response goes to the caller.
+type StreamParam struct {
+	Param
+	Body     io.Reader
+	Response io.Writer
+}
+
+// StreamHandlerFunc returns after the response is written, the error is passed to the reader of the response
+type StreamHandlerFunc func(param *StreamParam) error
+
+type streamRoute struct {
+	function string
+	handler  StreamHandlerFunc
+	options  RouteOptions
+}
+
+type streamChunk struct {
+	flags byte
+	data  []byte
+}
+
+// serverStream belongs to the address of the caller - the session may be opened again during the stream
+type serverStream struct {
+	mtx           sync.Mutex
+	id            uint64
+	remoteAddress ed25519.PublicKey
+	ctx           context.Context
+	cancel        context.CancelFunc
+	changed       chan struct{}
+	accessDT      time.Time
+
+	// Request: the received chunks, the next chunk for the handler and the rest of the current one
+	requestChunks map[uint64]*streamChunk
+	requestSeq    uint64
+	requestData   []byte
+	requestEOF    bool
+
+	// Response: the chunks kept for the repeated reads from responseBase, the chunk being filled
+	responseChunks map[uint64]*streamChunk
+	responseBase   uint64
+	responseSeq    uint64
+	responseData   []byte
+	responseDone   bool
+}
+
+func newServerStream(ctx context.Context, id uint64, remoteAddress ed25519.PublicKey, now time.Time) *serverStream {
+	var c serverStream
+	c.id = id
+	c.remoteAddress = remoteAddress
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.changed = make(chan struct{})
+	c.accessDT = now
+	c.requestChunks = make(map[uint64]*streamChunk)
+	c.responseChunks = make(map[uint64]*streamChunk)
+	return &c
+}
+
+// notify wakes up the waiters, called under the lock
+func (c *serverStream) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases the lock until the state is changed, returns false if the stream is closed or the timer fired
+func (c *serverStream) wait(timer <-chan time.Time) bool {
+	changed := c.changed
+	c.mtx.Unlock()
+	defer c.mtx.Lock()
+	select {
+	case <-changed:
+		return true
+	case <-c.ctx.Done():
+		return false
+	case <-timer:
+		return false
+	}
+}
+
+// write accepts the chunk of the request, pending is set if the window is full
+func (c *serverStream) write(seq uint64, chunk *streamChunk) (pending bool, err error) {
+	timer := time.NewTimer(XchgStreamPollTimeout)
+	defer timer.Stop()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for {
+		if c.ctx.Err() != nil {
+			err = errors.New(ERR_XCHG_SRV_STREAM_CLOSED)
+			return
+		}
+		// Repeated chunk or the handler does not read the body anymore
+		if seq < c.requestSeq || c.requestChunks[seq] != nil || c.responseDone {
+			return
+		}
+		if seq < c.requestSeq+2*XchgStreamWindow {
+			c.requestChunks[seq] = chunk
+			c.notify()
+			return
+		}
+		if !c.wait(timer.C) {
+			pending = c.ctx.Err() == nil
+			if !pending {
+				err = errors.New(ERR_XCHG_SRV_STREAM_CLOSED)
+			}
+			return
+		}
+	}
+}
+
+// read returns the chunk of the response, the chunks older than 2 windows are not requested anymore
+func (c *serverStream) read(seq uint64) (chunk *streamChunk, err error) {
+	timer := time.NewTimer(XchgStreamPollTimeout)
+	defer timer.Stop()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for {
+		if c.ctx.Err() != nil {
+			err = errors.New(ERR_XCHG_SRV_STREAM_CLOSED)
+			return
+		}
+		// The reader never runs ahead of the produced chunks more than its window
+		if seq > c.responseSeq+3*XchgStreamWindow {
+			err = errors.New(ERR_XCHG_SRV_STREAM_WRONG_PARAM)
+			return
+		}
+		if seq >= 2*XchgStreamWindow {
+			base := seq - 2*XchgStreamWindow
+			if base > c.responseSeq {
+				base = c.responseSeq
+			}
+			if base > c.responseBase {
+				for ; c.responseBase < base; c.responseBase++ {
+					delete(c.responseChunks, c.responseBase)
+				}
+				c.notify()
+			}
+		}
+		if seq < c.responseBase {
+			err = errors.New(ERR_XCHG_SRV_STREAM_WRONG_PARAM)
+			return
+		}
+		if chunk = c.responseChunks[seq]; chunk != nil {
+			return
+		}
+		// The reader waits for the chunk being filled
+		if seq == c.responseSeq && len(c.responseData) > 0 {
+			c.commit(0)
+			continue
+		}
+		if !c.wait(timer.C) {
+			if c.ctx.Err() == nil {
+				chunk = &streamChunk{flags: streamFlagPending}
+				return
+			}
+			err = errors.New(ERR_XCHG_SRV_STREAM_CLOSED)
+			return
+		}
+	}
+}
+
+// commit closes the chunk being filled, called under the lock
+func (c *serverStream) commit(flags byte) {
+	c.responseChunks[c.responseSeq] = &streamChunk{flags: flags, data: c.responseData}
+	c.responseSeq++
+	c.responseData = nil
+	c.notify()
+}
+
+// finish sends the rest of the response and the result of the handler
+func (c *serverStream) finish(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err != nil {
+		if len(c.responseData) > 0 {
+			c.commit(0)
+		}
+		c.responseData = []byte(err.Error())
+		c.commit(streamFlagEOF | streamFlagError)
+	} else {
+		c.commit(streamFlagEOF)
+	}
+	c.responseDone = true
+	c.requestChunks = make(map[uint64]*streamChunk)
+}
+
+// streamBody is the request stream of the handler
+type streamBody struct {
+	stream *serverStream
+}
+
+func (c *streamBody) Read(p []byte) (n int, err error) {
+	s := c.stream
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for {
+		if len(s.requestData) > 0 {
+			n = copy(p, s.requestData)
+			s.requestData = s.requestData[n:]
+			return
+		}
+		if s.requestEOF {
+			return 0, io.EOF
+		}
+		if chunk, ok := s.requestChunks[s.requestSeq]; ok {
+			delete(s.requestChunks, s.requestSeq)
+			s.requestSeq++
+			s.requestData = chunk.data
+			s.requestEOF = chunk.flags&streamFlagEOF != 0
+			s.notify()
+			continue
+		}
+		if !s.wait(nil) {
+			return 0, s.ctx.Err()
+		}
+	}
+}
+
+// streamResponse fills the chunks of the response, the writer waits while the reader is 3 windows behind
+type streamResponse struct {
+	stream *serverStream
+}
+
+func (c *streamResponse) Write(p []byte) (n int, err error) {
+	s := c.stream
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for n < len(p) {
+		if s.ctx.Err() != nil {
+			err = s.ctx.Err()
+			return
+		}
+		space := XchgStreamChunkSize - len(s.responseData)
+		if space == 0 {
+			if s.responseSeq-s.responseBase >= 3*XchgStreamWindow {
+				s.wait(nil)
+				continue
+			}
+			s.commit(0)
+			continue
+		}
+		if space > len(p)-n {
+			space = len(p) - n
+		}
+		s.responseData = append(s.responseData, p[n:n+space]...)
+		n += space
+	}
+	return
+}
+
+// HandleStream registers the stream handler in the mux of the peer
+func (c *Peer) HandleStream(function string, handler StreamHandlerFunc) {
+	c.ensureMux().HandleStream(function, handler)
+}
+
+// processStreamCall serves the reserved stream functions
+func (c *Peer) processStreamCall(param *Param) (response []byte, err error) {
+	if param.Function == FunctionStreamOpen {
+		return c.openStream(param)
+	}
+
+	if len(param.Parameter) < 8 {
+		err = errors.New(ERR_XCHG_SRV_STREAM_WRONG_PARAM)
+		return
+	}
+	streamId := binary.LittleEndian.Uint64(param.Parameter)
+
+	c.mtx.Lock()
+	stream, ok := c.streams[streamId]
+	if ok && !bytes.Equal(stream.remoteAddress, param.RemoteAddress) {
+		ok = false
+	}
+	if ok && param.Function == FunctionStreamClose {
+		delete(c.streams, streamId)
+	}
+	c.mtx.Unlock()
+	if !ok {
+		err = errors.New(ERR_XCHG_SRV_STREAM_NOT_FOUND)
+		return
+	}
+
+	stream.mtx.Lock()
+	stream.accessDT = c.clock.Now()
+	stream.mtx.Unlock()
+
+	switch param.Function {
+	case FunctionStreamWrite:
+		if len(param.Parameter) < 8+8+1 {
+			err = errors.New(ERR_XCHG_SRV_STREAM_WRONG_PARAM)
+			return
+		}
+		seq := binary.LittleEndian.Uint64(param.Parameter[8:])
+		data := make([]byte, len(param.Parameter)-17)
+		copy(data, param.Parameter[17:])
+		var pending bool
+		pending, err = stream.write(seq, &streamChunk{flags: param.Parameter[16], data: data})
+		response = []byte{0}
+		if pending {
+			response[0] = streamFlagPending
+		}
+	case FunctionStreamRead:
+		if len(param.Parameter) < 8+8 {
+			err = errors.New(ERR_XCHG_SRV_STREAM_WRONG_PARAM)
+			return
+		}
+		var chunk *streamChunk
+		chunk, err = stream.read(binary.LittleEndian.Uint64(param.Parameter[8:]))
+		if err != nil {
+			return
+		}
+		response = make([]byte, 1+len(chunk.data))
+		response[0] = chunk.flags
+		copy(response[1:], chunk.data)
+	case FunctionStreamClose:
+		stream.cancel()
+	default:
+		err = &FunctionNotFoundError{Function: param.Function}
+	}
+	return
+}
+
+// openStream starts the handler, the stream lives until it is closed, idle or the peer is stopped
+func (c *Peer) openStream(param *Param) (response []byte, err error) {
+	function := string(param.Parameter)
+
+	var r *streamRoute
+	if mux := c.Mux(); mux != nil {
+		r = mux.matchStream(function)
+	}
+	if r == nil {
+		err = &FunctionNotFoundError{Function: function}
+		return
+	}
+
+	var p StreamParam
+	p.Param = *param
+	p.Function = function
+	p.Parameter = nil
+
+	if r.options.AuthRequired && len(p.AuthData) == 0 {
+		err = errors.New(ERR_XCHG_ACCESS_DENIED)
+		return
+	}
+	if r.options.Authorize != nil {
+		err = r.options.Authorize(&p.Param)
+		if err != nil {
+			return
+		}
+	}
+
+	c.mtx.Lock()
+	ctx := c.stopCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	streamId := c.nextStreamId
+	c.nextStreamId++
+	stream := newServerStream(ctx, streamId, param.RemoteAddress, c.clock.Now())
+	c.streams[streamId] = stream
+	c.mtx.Unlock()
+
+	handlerCtx, handlerCancel := stream.ctx, context.CancelFunc(func() {})
+	if r.options.Timeout > 0 {
+		handlerCtx, handlerCancel = context.WithTimeout(stream.ctx, r.options.Timeout)
+	}
+	p.Context = handlerCtx
+	p.Body = &streamBody{stream: stream}
+	p.Response = &streamResponse{stream: stream}
+
+	go func() {
+		var handlerErr error
+		defer func() {
+			if rec := recover(); rec != nil {
+				c.logger.Println("panic in stream", function, ":", rec)
+				handlerErr = errors.New(ERR_XCHG_SRV_FUNCTION_PANIC + ":" + fmt.Sprint(rec))
+			}
+			if handlerErr == nil && errors.Is(handlerCtx.Err(), context.DeadlineExceeded) {
+				handlerErr = errors.New(ERR_XCHG_SRV_FUNCTION_TIMEOUT)
+			}
+			handlerCancel()
+			stream.finish(handlerErr)
+		}()
+		handlerErr = r.handler(&p)
+	}()
+
+	response = make([]byte, 8)
+	binary.LittleEndian.PutUint64(response, streamId)
+	return
+}
+
+// purgeStreams drops the streams without the calls.
+// The streams are checked outside the lock of the peer - a busy stream must not block the peer.
+func (c *Peer) purgeStreams() {
+	now := c.clock.Now()
+	c.mtx.Lock()
+	streams := make([]*serverStream, 0, len(c.streams))
+	for _, stream := range c.streams {
+		streams = append(streams, stream)
+	}
+	c.mtx.Unlock()
+
+	for _, stream := range streams {
+		stream.mtx.Lock()
+		idle := now.Sub(stream.accessDT) > XchgStreamIdleTimeout
+		stream.mtx.Unlock()
+		if !idle {
+			continue
+		}
+		stream.cancel()
+		c.mtx.Lock()
+		if c.streams[stream.id] == stream {
+			delete(c.streams, stream.id)
+		}
+		c.mtx.Unlock()
+	}
+}
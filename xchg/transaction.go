@@ -28,6 +28,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/xchgn/xchg/utils"
@@ -59,6 +60,9 @@ type Transaction struct {
 
 	FromLocalNode bool
 
+	// Critical frames are sent through all routers of the destination, not marshalled
+	Critical bool
+
 	// Execution Result
 	BeginDT        time.Time
 	ReceivedFrames []*Transaction
@@ -66,6 +70,21 @@ type Transaction struct {
 	Complete bool
 	Result   []byte
 	Err      error
+
+	// Reliable delivery: the last block received, the requests of the missing blocks,
+	// the retransmissions on the requests of the other side, the acknowledgement of the request
+	// and the session key of the ACK/NACK frames
+	LastReceivedDT time.Time
+	nackCount      int
+	retransmits    int
+	acked          bool
+	deliveryKey    []byte
+
+	// The sorted [begin, end) ranges of the received data and the sum of their sizes
+	receivedRanges [][2]uint32
+	receivedSize   uint32
+
+	done chan struct{}
 }
 
 const (
@@ -94,9 +113,25 @@ func NewTransaction(frameType byte, srcAddress ed25519.PublicKey, destAddress ed
 	c.Data = data
 
 	c.ReceivedFrames = make([]*Transaction, 0)
+	c.done = make(chan struct{})
 	return &c
 }
 
+// Done is closed when the transaction is complete
+func (c *Transaction) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Transaction) SetComplete() {
+	if c.Complete {
+		return
+	}
+	c.Complete = true
+	if c.done != nil {
+		close(c.done)
+	}
+}
+
 func (c *Transaction) SrcAddressString() string {
 	return hex.EncodeToString(c.SrcAddress[:])
 }
@@ -163,15 +198,21 @@ func (c *Transaction) Marshal() (result []byte) {
 	return res
 }*/
 
+// AppendReceivedData collects the blocks of the multi-frame transaction.
+// The blocks may have any size and overlap: the UDP datagrams are smaller than a frame
+// and the retransmissions may be cut differently, so the received ranges are merged.
 func (c *Transaction) AppendReceivedData(transaction *Transaction) {
+	if uint64(transaction.Offset)+uint64(len(transaction.Data)) > uint64(transaction.TotalSize) {
+		return
+	}
+	if len(c.ReceivedFrames) > 0 && c.ReceivedFrames[0].TotalSize != transaction.TotalSize {
+		return
+	}
+
 	if len(c.ReceivedFrames) < 100000 {
-		found := false
-		for _, trvTr := range c.ReceivedFrames {
-			if trvTr.Offset == transaction.Offset {
-				found = true
-			}
-		}
-		if !found {
+		added := c.addReceivedRange(transaction.Offset, transaction.Offset+uint32(len(transaction.Data)))
+		if added > 0 || len(c.ReceivedFrames) == 0 {
+			c.receivedSize += added
 			c.ReceivedFrames = append(c.ReceivedFrames, transaction)
 		}
 	} else {
@@ -182,18 +223,57 @@ func (c *Transaction) AppendReceivedData(transaction *Transaction) {
 		c.FromLocalNode = true
 	}
 
-	receivedDataLen := 0
-	for _, trvTr := range c.ReceivedFrames {
-		receivedDataLen += int(len(trvTr.Data))
-	}
-
-	if receivedDataLen == int(transaction.TotalSize) {
+	if c.receivedSize == transaction.TotalSize {
 		if len(c.Result) != int(transaction.TotalSize) {
 			c.Result = make([]byte, transaction.TotalSize)
 		}
 		for _, trvTr := range c.ReceivedFrames {
 			copy(c.Result[trvTr.Offset:], trvTr.Data)
 		}
-		c.Complete = true
+		c.SetComplete()
 	}
 }
+
+// addReceivedRange merges [begin, end) into the received ranges and returns the number of the new bytes
+func (c *Transaction) addReceivedRange(begin uint32, end uint32) (added uint32) {
+	// The ranges from i to j touch the new one
+	i := sort.Search(len(c.receivedRanges), func(i int) bool {
+		return c.receivedRanges[i][1] >= begin
+	})
+	j := i
+	covered := uint32(0)
+	for ; j < len(c.receivedRanges) && c.receivedRanges[j][0] <= end; j++ {
+		r := c.receivedRanges[j]
+		covered += r[1] - r[0]
+		if r[0] < begin {
+			begin = r[0]
+		}
+		if r[1] > end {
+			end = r[1]
+		}
+	}
+	added = end - begin - covered
+	c.receivedRanges = append(c.receivedRanges[:i], append([][2]uint32{{begin, end}}, c.receivedRanges[j:]...)...)
+	return
+}
+
+// MissingRanges returns the [offset, size] of the data not received yet,
+// the total size is taken from the received blocks
+func (c *Transaction) MissingRanges() (ranges [][2]uint32) {
+	if len(c.ReceivedFrames) == 0 {
+		return
+	}
+	totalSize := c.ReceivedFrames[0].TotalSize
+
+	covered := uint32(0)
+	for _, r := range c.receivedRanges {
+		if r[0] > covered {
+			ranges = append(ranges, [2]uint32{covered, r[0] - covered})
+		}
+		covered = r[1]
+	}
+	if covered < totalSize {
+		ranges = append(ranges, [2]uint32{covered, totalSize - covered})
+	}
+	return
+}
@@ -22,7 +22,10 @@
 
 package xchg
 
-import "strings"
+import (
+	"errors"
+	"strings"
+)
 
 const (
 	/*ERR_XCHG_ACCESS_DENIED   = "{ERR_XCHG_ACCESS_DENIED}"
@@ -51,6 +54,8 @@ const (
 	ERR_XCHG_CL_CONN_CALL_DECRYPT              = "{ERR_XCHG_CL_CONN_CALL_DECRYPT}"
 	ERR_XCHG_CL_CONN_CALL_UNPACK               = "{ERR_XCHG_CL_CONN_CALL_UNPACK}"
 	ERR_XCHG_CL_CONN_CALL_FROM_PEER            = "{ERR_XCHG_CL_CONN_FROM_PEER}"
+	ERR_XCHG_CL_CONN_CALL_DESCRIBE             = "{ERR_XCHG_CL_CONN_CALL_DESCRIBE}"
+	ERR_XCHG_CL_STREAM_WRONG_RESPONSE          = "{ERR_XCHG_CL_STREAM_WRONG_RESPONSE}"
 
 	// Auth
 	ERR_XCHG_CL_CONN_AUTH_GET_NONCE            = "{ERR_XCHG_CL_CONN_AUTH_GET_NONCE}"
@@ -65,9 +70,18 @@ const (
 	// Peer Connection
 	ERR_XCHG_PEER_CONN_LOSS               = "{ERR_XCHG_PEER_CONN_LOSS}"
 	ERR_XCHG_PEER_CONN_TR_TIMEOUT         = "{ERR_XCHG_PEER_CONN_TR_TIMEOUT}"
+	ERR_XCHG_PEER_CONN_TR_CANCELLED       = "{ERR_XCHG_PEER_CONN_TR_CANCELLED}"
 	ERR_XCHG_PEER_CONN_REQ_SID_SIZE       = "{ERR_XCHG_PEER_CONN_REQ_SID_SIZE}"
 	ERR_XCHG_PEER_CONN_WRONG_PROT_VERSION = "{ERR_XCHG_PEER_CONN_WRONG_PROT_VERSION}"
 	ERR_XCHG_PEER_CONN_RCVD_ERR           = "{ERR_XCHG_PEER_CONN_RCVD_ERR}"
+	ERR_XCHG_PEER_ROUTER_NONCE            = "{ERR_XCHG_PEER_ROUTER_NONCE}"
+	ERR_XCHG_PEER_NO_TRANSPORT            = "{ERR_XCHG_PEER_NO_TRANSPORT}"
+	ERR_XCHG_PEER_UDP_NOT_CONFIRMED       = "{ERR_XCHG_PEER_UDP_NOT_CONFIRMED}"
+	ERR_XCHG_PEER_UDP_NO_ENDPOINT         = "{ERR_XCHG_PEER_UDP_NO_ENDPOINT}"
+	ERR_XCHG_PEER_UDP_WRONG_ENDPOINT      = "{ERR_XCHG_PEER_UDP_WRONG_ENDPOINT}"
+	ERR_XCHG_PEER_LAN_NOT_FOUND           = "{ERR_XCHG_PEER_LAN_NOT_FOUND}"
+	ERR_XCHG_PEER_LOOPBACK_NOT_FOUND      = "{ERR_XCHG_PEER_LOOPBACK_NOT_FOUND}"
+	ERR_XCHG_PEER_DELIVERY_WRONG_FRAME    = "{ERR_XCHG_PEER_DELIVERY_WRONG_FRAME}"
 
 	// Server Connection
 	ERR_XCHG_SRV_CONN_WRONG_SESSION       = "{ERR_XCHG_SRV_CONN_WRONG_SESSION}"
@@ -83,6 +97,16 @@ const (
 	ERR_XCHG_SRV_CONN_AUTH_DATA_LEN_PK    = "{ERR_XCHG_SRV_CONN_AUTH_DATA_LEN_PK}"
 	ERR_XCHG_SRV_CONN_AUTH_WRONG_NONCE    = "{ERR_XCHG_SRV_CONN_AUTH_WRONG_NONCE}"
 
+	// Server Functions
+	ERR_XCHG_SRV_FUNCTION_NOT_FOUND = "{ERR_XCHG_SRV_FUNCTION_NOT_FOUND}"
+	ERR_XCHG_SRV_FUNCTION_TIMEOUT   = "{ERR_XCHG_SRV_FUNCTION_TIMEOUT}"
+	ERR_XCHG_SRV_FUNCTION_PANIC     = "{ERR_XCHG_SRV_FUNCTION_PANIC}"
+	ERR_XCHG_SRV_SERVICE_NO_NAME    = "{ERR_XCHG_SRV_SERVICE_NO_NAME}"
+	ERR_XCHG_SRV_SERVICE_NO_METHODS = "{ERR_XCHG_SRV_SERVICE_NO_METHODS}"
+	ERR_XCHG_SRV_STREAM_NOT_FOUND   = "{ERR_XCHG_SRV_STREAM_NOT_FOUND}"
+	ERR_XCHG_SRV_STREAM_WRONG_PARAM = "{ERR_XCHG_SRV_STREAM_WRONG_PARAM}"
+	ERR_XCHG_SRV_STREAM_CLOSED      = "{ERR_XCHG_SRV_STREAM_CLOSED}"
+
 	// Router
 	ERR_XCHG_ROUTER_CONFIG_IS_DIRECTORY         = "{ERR_XCHG_ROUTER_CONFIG_IS_DIRECTORY}"
 	ERR_XCHG_ROUTER_CONN_WRONG_FRAME_TYPE       = "{ERR_XCHG_ROUTER_CONN_WRONG_FRAME_TYPE}"
@@ -92,10 +116,23 @@ const (
 	ERR_XCHG_ROUTER_CONN_DECR4                  = "{ERR_XCHG_ROUTER_CONN_DECR4}"
 	ERR_XCHG_ROUTER_CONN_DECR5                  = "{ERR_XCHG_ROUTER_CONN_DECR5}"
 	ERR_XCHG_ROUTER_CONN_NO_ROUTE_TO_PEER       = "{ERR_XCHG_ROUTER_CONN_NO_ROUTE_TO_PEER}"
+	ERR_XCHG_ROUTER_CONN_NOT_CONNECTED          = "{ERR_XCHG_ROUTER_CONN_NOT_CONNECTED}"
 	ERR_XCHG_ROUTER_SERVER_ALREADY_STARTED      = "{ERR_XCHG_ROUTER_SERVER_ALREADY_STARTED}"
 	ERR_XCHG_ROUTER_SERVER_IS_NOT_STARTED       = "{ERR_XCHG_ROUTER_SERVER_IS_NOT_STARTED}"
 	ERR_XCHG_ROUTER_ALREADY_STARTED             = "{ERR_XCHG_ROUTER_ALREADY_STARTED}"
 	ERR_XCHG_ROUTER_IS_NOT_STARTED              = "{ERR_XCHG_ROUTER_IS_NOT_STARTED}"
+	ERR_XCHG_ROUTER_ACCESS_DENIED               = "{ERR_XCHG_ROUTER_ACCESS_DENIED}"
+
+	// Codec
+	ERR_XCHG_CODEC_NO_HEADER = "{ERR_XCHG_CODEC_NO_HEADER}"
+	ERR_XCHG_CODEC_UNKNOWN   = "{ERR_XCHG_CODEC_UNKNOWN}"
+	ERR_XCHG_CODEC_MISMATCH  = "{ERR_XCHG_CODEC_MISMATCH}"
+	ERR_XCHG_CODEC_MARSHAL   = "{ERR_XCHG_CODEC_MARSHAL}"
+	ERR_XCHG_CODEC_UNMARSHAL = "{ERR_XCHG_CODEC_UNMARSHAL}"
+
+	// Network
+	ERR_XCHG_NETWORK_NO_ROUTERS  = "{ERR_XCHG_NETWORK_NO_ROUTERS}"
+	ERR_XCHG_NETWORK_HTTP_STATUS = "{ERR_XCHG_NETWORK_HTTP_STATUS}"
 
 	// Other
 	ERR_XCHG_NOT_IMPLEMENTED = "{ERR_XCHG_NOT_IMPLEMENTED}"
@@ -118,3 +155,25 @@ func NeedToChangeNode(err error) bool {
 	errStr := err.Error()
 	return strings.Contains(errStr, "{ERR_XCHG_ROUTER_")
 }
+
+// The caller has cancelled the call
+func IsCancelled(err error) bool {
+	if err == nil {
+		return false
+	}
+	errStr := err.Error()
+	return strings.Contains(errStr, ERR_XCHG_PEER_CONN_TR_CANCELLED)
+}
+
+// The server has no handler for the function
+func IsFunctionNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	var notFoundErr *FunctionNotFoundError
+	if errors.As(err, &notFoundErr) {
+		return true
+	}
+	errStr := err.Error()
+	return strings.Contains(errStr, ERR_XCHG_SRV_FUNCTION_NOT_FOUND)
+}
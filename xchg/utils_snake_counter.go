@@ -28,10 +28,12 @@ import (
 	"sync"
 )
 
+// SnakeCounter accepts every counter once within the window of the last size counters.
+// The window is a ring of bits, the counter n is the bit n % size.
 type SnakeCounter struct {
 	mtx           sync.Mutex
 	size          int
-	data          []byte
+	bits          []uint64
 	lastProcessed int
 }
 
@@ -39,44 +41,50 @@ func NewSnakeCounter(size int, initValue int) *SnakeCounter {
 	var c SnakeCounter
 	c.size = size
 	c.lastProcessed = -1
-	c.data = make([]byte, size)
-	for i := 0; i < c.size; i++ {
-		c.data[i] = 1
+	c.bits = make([]uint64, (size+63)/64)
+	for i := range c.bits {
+		c.bits[i] = ^uint64(0)
 	}
 	c.TestAndDeclare(initValue)
 	return &c
 }
 
+func (c *SnakeCounter) bit(counter int) (word int, mask uint64) {
+	index := counter % c.size
+	if index < 0 {
+		index += c.size
+	}
+	return index / 64, 1 << uint(index%64)
+}
+
 func (c *SnakeCounter) TestAndDeclare(counter int) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	if counter < c.lastProcessed-len(c.data) {
+	if counter < c.lastProcessed-c.size {
 		return errors.New("too less")
 	}
 
 	if counter > c.lastProcessed {
-		shiftRange := counter - c.lastProcessed
-		newData := make([]byte, c.size)
-		for i := 0; i < len(c.data); i++ {
-			b := byte(0)
-			oldAddressOfCell := i - shiftRange
-			if oldAddressOfCell >= 0 && oldAddressOfCell < len(c.data) {
-				b = c.data[oldAddressOfCell]
-			}
-			newData[i] = b
+		// The counters skipped by the shift are not used yet
+		from := c.lastProcessed + 1
+		if from < counter-c.size+1 {
+			from = counter - c.size + 1
 		}
-		c.data = newData
-		c.data[0] = 1
+		for n := from; n < counter; n++ {
+			word, mask := c.bit(n)
+			c.bits[word] &^= mask
+		}
+		word, mask := c.bit(counter)
+		c.bits[word] |= mask
 		c.lastProcessed = counter
 		return nil
 	}
 
-	index := c.lastProcessed - counter
-	if index >= 0 && index < c.size {
-
-		if c.data[index] == 0 {
-			c.data[c.lastProcessed-counter] = 1
+	if c.lastProcessed-counter < c.size {
+		word, mask := c.bit(counter)
+		if c.bits[word]&mask == 0 {
+			c.bits[word] |= mask
 			return nil
 		}
 	}
@@ -94,7 +102,12 @@ func (c *SnakeCounter) LastProcessed() int {
 func (c *SnakeCounter) Print() {
 	fmt.Println("--------------------")
 	fmt.Println("Header:", c.lastProcessed)
-	for i, v := range c.data {
+	for i := 0; i < c.size; i++ {
+		word, mask := c.bit(c.lastProcessed - i)
+		v := 0
+		if c.bits[word]&mask != 0 {
+			v = 1
+		}
 		fmt.Println(c.lastProcessed-i, v)
 	}
 	fmt.Println("--------------------")
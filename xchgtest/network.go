@@ -0,0 +1,328 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package xchgtest runs routers and peers in memory for the integration tests.
+// Peers reach the routers through an in-memory HTTP transport that can delay, drop,
+// reorder and duplicate the frames and take routers down. No ports are opened.
+//
+// Run executes the test on the simulated time of testing/synctest: the frame delays,
+// the long polling, the retransmission timers and the background loops of the peers
+// wait for the fake clock, which moves only when every goroutine of the test is blocked.
+// The network decides the faults of the frames written at the same moment in the order
+// of their headers and the keys of the peers come from the seed, so the delivery order
+// depends only on the seed. Outside of Run the network works on real time without this guarantee.
+// The manual Clock drives the expiry of the sessions and streams in both cases.
+package xchgtest
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	xchgrouter "github.com/xchgn/xchg/router"
+	"github.com/xchgn/xchg/xchg"
+)
+
+type Options struct {
+	// Seed of the fault decisions and of the keys of the peers added without a key
+	Seed int64
+
+	// Routers keeping the mailbox of every address
+	Redundancy int
+
+	// LongPollingTimeout of the routers, 1 second by default
+	LongPollingTimeout time.Duration
+
+	// Start of the clock, 2024-01-01 by default
+	ClockStart time.Time
+
+	// Logger of the peers, the peers are silent by default
+	Logger xchg.Logger
+}
+
+// Faults are applied to every frame a peer writes to a router.
+// Latency and delays are simulated inside Run and real time outside of it.
+type Faults struct {
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Probabilities from 0 to 1
+	Loss        float64
+	Duplication float64
+	Reordering  float64
+
+	// Delay of the reordered frames, later frames overtake them
+	ReorderDelay time.Duration
+}
+
+type Stat struct {
+	Frames     int
+	Delivered  int
+	Lost       int
+	Duplicated int
+	Reordered  int
+	Rejected   int
+}
+
+type Network struct {
+	mtx     sync.Mutex
+	options Options
+	rnd     *rand.Rand
+	keys    *rand.Rand
+	faults  Faults
+	stat    Stat
+	clock   *Clock
+	routers map[string]*Router
+	order   []*Router
+	peers   []*xchg.Peer
+	closed  bool
+
+	// The frames waiting for the fault decisions and the frames waiting for their delay
+	pending    []*queuedFrame
+	queue      []*queuedFrame
+	seq        uint64
+	flushTimer *time.Timer
+	queueTimer *time.Timer
+
+	httpClient *http.Client
+}
+
+type Router struct {
+	mtx        sync.Mutex
+	name       string
+	address    string
+	router     *xchgrouter.Router
+	httpServer *xchgrouter.HttpServer
+	down       bool
+	inflight   map[*inflightRequest]struct{}
+}
+
+type silentLogger struct{}
+
+func (silentLogger) Println(v ...interface{}) {
+}
+
+func NewNetwork(options Options) *Network {
+	var c Network
+	c.options = options
+	if c.options.Redundancy <= 0 {
+		c.options.Redundancy = xchg.XchgRouterRedundancy
+	}
+	if c.options.LongPollingTimeout <= 0 {
+		c.options.LongPollingTimeout = time.Second
+	}
+	if c.options.ClockStart.IsZero() {
+		c.options.ClockStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if c.options.Logger == nil {
+		c.options.Logger = silentLogger{}
+	}
+	c.rnd = rand.New(rand.NewSource(c.options.Seed))
+	c.keys = rand.New(rand.NewSource(c.options.Seed))
+	c.clock = NewClock(c.options.ClockStart)
+	c.routers = make(map[string]*Router)
+	c.httpClient = &http.Client{Transport: &transport{network: &c}}
+	return &c
+}
+
+func (c *Network) Clock() *Clock {
+	return c.clock
+}
+
+// AddRouter starts the router, the peers added later use it
+func (c *Network) AddRouter() *Router {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var r Router
+	r.name = "router" + fmt.Sprint(len(c.order))
+	r.address = r.name + ".xchgtest:" + fmt.Sprint(xchgrouter.HTTP_PORT)
+	r.router = xchgrouter.NewRouter(xchgrouter.RouterOptions{LongPollingTimeout: c.options.LongPollingTimeout})
+	r.router.Start()
+	r.httpServer = xchgrouter.NewHttpServer()
+	r.httpServer.SetRouter(r.router)
+	r.inflight = make(map[*inflightRequest]struct{})
+	c.routers[r.address] = &r
+	c.order = append(c.order, &r)
+	return &r
+}
+
+func (c *Network) Routers() []*Router {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	routers := make([]*Router, len(c.order))
+	copy(routers, c.order)
+	return routers
+}
+
+func (c *Network) router(address string) *Router {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.routers[address]
+}
+
+// RouterOf returns the router of the address with the given index in the preference order
+func (c *Network) RouterOf(address ed25519.PublicKey, index int) *Router {
+	addrs := c.xchgNetwork().GetRouterAddrs(fmt.Sprintf("%x", []byte(address)), index+1)
+	if index >= len(addrs) {
+		return nil
+	}
+	return c.router(addrs[index])
+}
+
+func (c *Network) xchgNetwork() *xchg.Network {
+	c.mtx.Lock()
+	routers := make([]*xchg.RouterInfo, 0, len(c.order))
+	for _, r := range c.order {
+		routers = append(routers, &xchg.RouterInfo{Name: r.name, NetAddress: r.address})
+	}
+	c.mtx.Unlock()
+
+	network := xchg.NewNetworkFromRouters(routers)
+	network.SetRedundancy(c.options.Redundancy)
+	return network
+}
+
+// AddPeer starts the peer connected to the routers added before.
+// The key is generated from the seed if privateKey is nil.
+func (c *Network) AddPeer(privateKey ed25519.PrivateKey, callback xchg.CallbackFunc) *xchg.Peer {
+	if privateKey == nil {
+		seed := make([]byte, ed25519.SeedSize)
+		c.mtx.Lock()
+		c.keys.Read(seed)
+		c.mtx.Unlock()
+		privateKey = ed25519.NewKeyFromSeed(seed)
+	}
+
+	options := xchg.DefaultPeerOptions()
+	options.PrivateKey = privateKey
+	options.RouterEnabled = false
+	options.LoopbackHub = nil
+	options.Clock = c.clock
+	options.Logger = c.options.Logger
+	options.HttpClient = c.httpClient
+	options.HttpClientLong = c.httpClient
+	options.LongPollingDelay = c.options.LongPollingTimeout + time.Second
+
+	peer := xchg.NewPeerWithOptions(options)
+	peer.Callback = callback
+	peer.SetNetwork(c.xchgNetwork())
+	peer.SetHttpOnly(true)
+	peer.SetDirectUdp(false)
+	peer.SetLanDiscovery(false)
+	peer.Start()
+
+	c.mtx.Lock()
+	c.peers = append(c.peers, peer)
+	c.mtx.Unlock()
+	return peer
+}
+
+func (c *Network) SetFaults(faults Faults) {
+	c.mtx.Lock()
+	c.faults = faults
+	c.mtx.Unlock()
+}
+
+func (c *Network) Stat() Stat {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.stat
+}
+
+// Advance moves the clock and lets the peers expire their sessions
+func (c *Network) Advance(d time.Duration) {
+	c.clock.Advance(d)
+	c.mtx.Lock()
+	peers := make([]*xchg.Peer, len(c.peers))
+	copy(peers, c.peers)
+	c.mtx.Unlock()
+	for _, peer := range peers {
+		peer.PurgeSessions()
+	}
+}
+
+// Close stops the peers and the routers
+func (c *Network) Close() {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return
+	}
+	c.closed = true
+	peers := c.peers
+	routers := c.order
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+	}
+	if c.queueTimer != nil {
+		c.queueTimer.Stop()
+	}
+	c.mtx.Unlock()
+
+	for _, peer := range peers {
+		peer.Stop()
+	}
+	for _, r := range routers {
+		r.SetDown(true)
+		r.router.Stop()
+	}
+}
+
+func (c *Router) Name() string {
+	return c.name
+}
+
+// Address is the network address of the router in the router list of the peers
+func (c *Router) Address() string {
+	return c.address
+}
+
+func (c *Router) Router() *xchgrouter.Router {
+	return c.router
+}
+
+// SetDown makes the router unreachable, the requests in progress fail
+func (c *Router) SetDown(down bool) {
+	c.mtx.Lock()
+	c.down = down
+	inflight := c.inflight
+	if down {
+		c.inflight = make(map[*inflightRequest]struct{})
+	}
+	c.mtx.Unlock()
+
+	if down {
+		for request := range inflight {
+			request.cancel()
+		}
+	}
+}
+
+func (c *Router) Down() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.down
+}
@@ -0,0 +1,256 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (c) 2024 Xchg-Network Authors
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package xchgtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+
+	xchgrouter "github.com/xchgn/xchg/router"
+	"github.com/xchgn/xchg/xchg"
+)
+
+const (
+	maxRequestSize = 16 * 1024 * 1024
+
+	// The frames written within batchDelay get the fault decisions together
+	batchDelay = time.Microsecond
+)
+
+// transport is the HTTP client transport of the peers: the requests go to the in-memory routers
+type transport struct {
+	network *Network
+}
+
+type inflightRequest struct {
+	cancel context.CancelFunc
+}
+
+func unreachable(address string) error {
+	return errors.New("xchgtest: router " + address + " is unreachable")
+}
+
+func (c *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := c.network.router(req.URL.Host)
+	if r == nil || r.Down() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, unreachable(req.URL.Host)
+	}
+
+	if req.URL.Path == "/api/w" {
+		return c.write(r, req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	request := &inflightRequest{cancel: cancel}
+	r.mtx.Lock()
+	if r.down {
+		r.mtx.Unlock()
+		return nil, unreachable(r.address)
+	}
+	r.inflight[request] = struct{}{}
+	r.mtx.Unlock()
+	defer func() {
+		r.mtx.Lock()
+		delete(r.inflight, request)
+		r.mtx.Unlock()
+	}()
+
+	serverReq := req.Clone(ctx)
+	serverReq.RequestURI = req.URL.RequestURI()
+	recorder := httptest.NewRecorder()
+	r.httpServer.ServeHTTP(recorder, serverReq)
+
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, unreachable(r.address)
+	}
+	response := recorder.Result()
+	response.Request = req
+	return response, nil
+}
+
+// write applies the faults to every frame of the request
+func (c *transport) write(r *Router, req *http.Request) (*http.Response, error) {
+	serverReq := req.Clone(req.Context())
+	if err := serverReq.ParseMultipartForm(maxRequestSize); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(serverReq.FormValue("d"))
+	if err != nil {
+		return nil, err
+	}
+
+	offset := 0
+	for offset+xchgrouter.FRAME_MIN_SIZE <= len(data) {
+		frameLen := int(binary.LittleEndian.Uint32(data[offset:]))
+		if frameLen < xchgrouter.FRAME_MIN_SIZE || offset+frameLen > len(data) {
+			break
+		}
+		frame := make([]byte, frameLen)
+		copy(frame, data[offset:offset+frameLen])
+		c.network.deliver(r, frame)
+		offset += frameLen
+	}
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+type queuedFrame struct {
+	router *Router
+	frame  []byte
+	due    time.Time
+	seq    uint64
+}
+
+// key orders the frames by the router and the transaction header, the data is encrypted with random nonces
+func (c *queuedFrame) key() []byte {
+	header := c.frame
+	if len(header) > xchg.TransactionHeaderSize {
+		header = header[:xchg.TransactionHeaderSize]
+	}
+	return append([]byte(c.router.address+"/"), header...)
+}
+
+// deliver queues the frame, the faults are decided when the writers of the moment are done
+func (c *Network) deliver(r *Router, frame []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.stat.Frames++
+	c.pending = append(c.pending, &queuedFrame{router: r, frame: frame})
+	if c.flushTimer == nil && !c.closed {
+		c.flushTimer = time.AfterFunc(batchDelay, c.flush)
+	}
+}
+
+// flush decides the faults of the pending frames in the order of their keys,
+// so the decisions do not depend on the goroutine that has written its frame first
+func (c *Network) flush() {
+	c.mtx.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.flushTimer = nil
+	sort.SliceStable(batch, func(i, j int) bool {
+		return bytes.Compare(batch[i].key(), batch[j].key()) < 0
+	})
+
+	now := time.Now()
+	faults := c.faults
+	for _, f := range batch {
+		if faults.Loss > 0 && c.rnd.Float64() < faults.Loss {
+			c.stat.Lost++
+			continue
+		}
+		copies := 1
+		if faults.Duplication > 0 && c.rnd.Float64() < faults.Duplication {
+			copies = 2
+			c.stat.Duplicated++
+		}
+		for i := 0; i < copies; i++ {
+			delay := faults.Latency
+			if faults.Jitter > 0 {
+				delay += time.Duration(c.rnd.Int63n(int64(faults.Jitter)))
+			}
+			if faults.Reordering > 0 && c.rnd.Float64() < faults.Reordering {
+				reorderDelay := faults.ReorderDelay
+				if reorderDelay <= 0 {
+					reorderDelay = 10 * time.Millisecond
+				}
+				delay += reorderDelay
+				c.stat.Reordered++
+			}
+			c.seq++
+			c.queue = append(c.queue, &queuedFrame{router: f.router, frame: f.frame, due: now.Add(delay), seq: c.seq})
+		}
+	}
+	sort.Slice(c.queue, func(i, j int) bool {
+		if !c.queue[i].due.Equal(c.queue[j].due) {
+			return c.queue[i].due.Before(c.queue[j].due)
+		}
+		return c.queue[i].seq < c.queue[j].seq
+	})
+	c.mtx.Unlock()
+
+	c.deliverDue()
+}
+
+// deliverDue puts the frames whose delay has passed to the routers and waits for the next one
+func (c *Network) deliverDue() {
+	c.mtx.Lock()
+	now := time.Now()
+	count := 0
+	for count < len(c.queue) && !c.queue[count].due.After(now) {
+		count++
+	}
+	due := make([]*queuedFrame, count)
+	copy(due, c.queue)
+	c.queue = c.queue[count:]
+	if c.queueTimer != nil {
+		c.queueTimer.Stop()
+		c.queueTimer = nil
+	}
+	if len(c.queue) > 0 && !c.closed {
+		c.queueTimer = time.AfterFunc(c.queue[0].due.Sub(now), c.deliverDue)
+	}
+	c.mtx.Unlock()
+
+	for _, f := range due {
+		c.put(f.router, f.frame)
+	}
+}
+
+func (c *Network) put(r *Router, frame []byte) {
+	if r.Down() {
+		c.mtx.Lock()
+		c.stat.Rejected++
+		c.mtx.Unlock()
+		return
+	}
+	r.router.Put(frame)
+	c.mtx.Lock()
+	c.stat.Delivered++
+	c.mtx.Unlock()
+}